@@ -7,39 +7,108 @@ import (
 	page_map "github.com/gjc13/gsdl/utils/page_map"
 )
 
+// Each free map page covers the pages from itself up to the next free map page
+func freeMapPgNumberOf(pgNumber uint32, pgSize uint32) uint32 {
+	return (pgNumber-1)/(pgSize*8)*(pgSize*8) + 1
+}
+
 func createFreeMapPage(wt *pager.WriteTransaction, pgNumber uint32) error {
 	pageMap := &freeMapPage{
 		pgNumber:    pgNumber,
-		freePageMap: page_map.MakeFreePageMap(pgNumber, int(pager.PGSIZE)*8),
+		freePageMap: page_map.MakeFreePageMap(pgNumber, int(wt.PageSize())*8),
 	}
 	pageMap.freePageMap.Set(pgNumber)
 	return wt.WritePage(pgNumber, pageMap.toPageData())
 }
 
+// Data pages are given to a table in extents of this many contiguous pages, so its scans read the file in order
+const EXTENT_PAGES uint32 = 8
+
+// No free map page before the hint has a free page, the hint is kept in the header
+func firstFreeMapPgNumber(ctx *DbContext) uint32 {
+	if ctx.metaPage == nil || ctx.metaPage.FirstFreeMapPageNumber == 0 {
+		return 1
+	}
+	return ctx.metaPage.FirstFreeMapPageNumber
+}
+
+func setFirstFreeMapPgNumber(ctx *DbContext, wt *pager.WriteTransaction, pgNumber uint32) error {
+	if ctx.metaPage == nil || firstFreeMapPgNumber(ctx) == pgNumber {
+		return nil
+	}
+	ctx.metaPage.FirstFreeMapPageNumber = pgNumber
+	return wt.WritePage(0, ctx.metaPage.toPageData(wt.PageSize()))
+}
+
+// Number of free pages of each free map page read in this session, so full ones are skipped without reading them
+func freeCounts(ctx *DbContext) map[uint32]int {
+	if ctx.freeCounts == nil {
+		ctx.freeCounts = map[uint32]int{}
+	}
+	return ctx.freeCounts
+}
+
+// Free map pages beyond the end of file are created
+func loadFreeMapPage(ctx *DbContext, wt *pager.WriteTransaction, pgNumber uint32) (*freeMapPage, error) {
+	data, err := wt.ReadPage(pgNumber)
+	if err == io.EOF {
+		if err1 := createFreeMapPage(wt, pgNumber); err1 != nil {
+			return nil, err1
+		}
+		data, err = wt.ReadPage(pgNumber)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmp := freeMapPageFromPageData(pgNumber, data)
+	freeCounts(ctx)[pgNumber] = fmp.freePageMap.NumFree()
+	return fmp, nil
+}
+
 func allocPage(ctx *DbContext) (uint32, error) {
+	return allocPages(ctx, 1)
+}
+
+// Allocate numPages contiguous pages covered by one free map page, returns the first of them
+func allocPages(ctx *DbContext, numPages uint32) (uint32, error) {
 	wt, ok := ctx.transaction.(*pager.WriteTransaction)
 	if !ok {
 		panic("Transaction error: Not write transaction when allocating page")
 	}
-	var pgNumber uint32 = 1
-	for {
-		data, err := wt.ReadPage(pgNumber)
-		if err == io.EOF {
-			err1 := createFreeMapPage(wt, pgNumber)
+	mapSize := wt.PageSize() * 8
+	//A run cannot be longer than the pages covered by one free map page besides itself
+	if numPages == 0 || numPages >= mapSize {
+		return 0, ERR_ALLOC
+	}
+	counts := freeCounts(ctx)
+	//The first free map page with a free page after the allocation
+	var first uint32
+	for pgNumber := firstFreeMapPgNumber(ctx); ; pgNumber += mapSize {
+		numFree, known := counts[pgNumber]
+		if !known || numFree >= int(numPages) {
+			fmp, err1 := loadFreeMapPage(ctx, wt, pgNumber)
 			if err1 != nil {
 				return 0, err1
 			}
-			return allocPage(ctx)
-		} else if err != nil {
-			return 0, err
+			if allocPgNumber := fmp.freePageMap.NextFreeRun(int(numPages)); allocPgNumber != 0 {
+				for i := uint32(0); i < numPages; i++ {
+					fmp.freePageMap.Set(allocPgNumber + i)
+				}
+				counts[pgNumber] = fmp.freePageMap.NumFree()
+				if err2 := wt.WritePage(pgNumber, fmp.toPageData()); err2 != nil {
+					return 0, err2
+				}
+				if first == 0 && counts[pgNumber] > 0 {
+					first = pgNumber
+				} else if first == 0 {
+					first = pgNumber + mapSize
+				}
+				return allocPgNumber, setFirstFreeMapPgNumber(ctx, wt, first)
+			}
+			numFree = fmp.freePageMap.NumFree()
 		}
-		fmp := freeMapPageFromPageData(pgNumber, data)
-		allocPgNumber := fmp.freePageMap.NextFreePageNumber()
-		if allocPgNumber == 0 {
-			pgNumber += uint32(fmp.freePageMap.Size())
-		} else {
-			fmp.freePageMap.Set(allocPgNumber)
-			return allocPgNumber, wt.WritePage(pgNumber, fmp.toPageData())
+		if first == 0 && numFree > 0 {
+			first = pgNumber
 		}
 	}
 }
@@ -52,7 +121,7 @@ func freePage(ctx *DbContext, pgNumber uint32) error {
 	if pgNumber == 0 {
 		panic("Cannot free header page")
 	}
-	freeMapPgNumber := pgNumber/uint32(pager.PGSIZE*8) + 1
+	freeMapPgNumber := freeMapPgNumberOf(pgNumber, wt.PageSize())
 	if pgNumber == freeMapPgNumber {
 		panic("Cannot free pagmap page")
 	}
@@ -62,5 +131,12 @@ func freePage(ctx *DbContext, pgNumber uint32) error {
 	}
 	fmp := freeMapPageFromPageData(freeMapPgNumber, data)
 	fmp.freePageMap.UnSet(pgNumber)
-	return wt.WritePage(freeMapPgNumber, fmp.toPageData())
+	freeCounts(ctx)[freeMapPgNumber] = fmp.freePageMap.NumFree()
+	if err1 := wt.WritePage(freeMapPgNumber, fmp.toPageData()); err1 != nil {
+		return err1
+	}
+	if freeMapPgNumber < firstFreeMapPgNumber(ctx) {
+		return setFirstFreeMapPgNumber(ctx, wt, freeMapPgNumber)
+	}
+	return nil
 }
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"fmt"
 	"testing"
 
 	pager "github.com/gjc13/gsdl/pager"
@@ -8,7 +9,7 @@ import (
 
 func TestAllocPage(t *testing.T) {
 	wt := &pager.WriteTransaction{}
-	wt.StartTransaction("/tmp/test.gsdl")
+	wt.StartTransaction(":memory:test.gsdl")
 	wt.WritePage(0, make([]byte, 4096))
 	wt.Sync()
 	ctx := &DbContext{
@@ -28,7 +29,7 @@ func TestAllocPage(t *testing.T) {
 		t.Error("Wrong allocte after free")
 	}
 	wt.EndTransaction()
-	wt.StartTransaction("/tmp/test.gsdl")
+	wt.StartTransaction(":memory:test.gsdl")
 	ctx = &DbContext{
 		transaction: wt,
 	}
@@ -46,3 +47,61 @@ func TestAllocPage(t *testing.T) {
 	freePage(ctx, 2)
 	wt.EndTransaction()
 }
+
+func TestFreeSpaceHint(t *testing.T) {
+	CreateDatabase(":memory:test_db_free_hint", &DatabaseOptions{PageSize: 1024})
+	ctx, err := StartUseDatabase(":memory:test_db_free_hint", nil)
+	if err != nil {
+		t.Fatalf("Cannot use database %v", err)
+	}
+	if _, err := allocPages(ctx, 8192); err != ERR_ALLOC {
+		t.Errorf("Run longer than a free map allocated, get %v", err)
+	}
+	//Fill the first free map page
+	if p, _ := allocPages(ctx, 8191); p != 2 {
+		t.Errorf("Wrong first page of run %d", p)
+	}
+	if p, _ := allocPage(ctx); p != 8194 || ctx.metaPage.FirstFreeMapPageNumber != 8193 {
+		t.Errorf("Wrong page %d allocated after full free map, hint %d", p, ctx.metaPage.FirstFreeMapPageNumber)
+	}
+	freePage(ctx, 100)
+	ctx.EndUseDatabase()
+	ctx, _ = StartUseDatabase(":memory:test_db_free_hint", nil)
+	defer ctx.EndUseDatabase()
+	if ctx.metaPage.FirstFreeMapPageNumber != 1 {
+		t.Errorf("Hint not moved back by free, %d", ctx.metaPage.FirstFreeMapPageNumber)
+	}
+	if p, _ := allocPage(ctx); p != 100 {
+		t.Errorf("Freed page not reused, get %d", p)
+	}
+}
+
+func TestDataPageExtents(t *testing.T) {
+	CreateDatabase(":memory:test_db_extents", nil)
+	ctx, err := StartUseDatabase(":memory:test_db_extents", nil)
+	if err != nil {
+		t.Fatalf("Cannot use database %v", err)
+	}
+	defer ctx.EndUseDatabase()
+	ctx.CreateTable("books", db_column_names1, db_test_meta1)
+	books, _ := ctx.CreateTableView("books")
+	for i := 0; i < 1000; i++ {
+		books.Insert([]interface{}{i, 20, fmt.Sprintf("book%d", i)})
+	}
+	//Rows inserted in key order fill the data pages at the end of the chain, which come from the extents in order
+	var pgNumbers []uint32
+	for pgNumber := books.metaPage.FirstDataPgNumber; pgNumber != 0; {
+		pgNumbers = append(pgNumbers, pgNumber)
+		page, _ := books.loadFixDataPage(pgNumber)
+		pgNumber = page.nextPgNumber
+	}
+	if len(pgNumbers) <= int(EXTENT_PAGES) {
+		t.Fatalf("Too few data pages %d", len(pgNumbers))
+	}
+	for i := 1; i < int(EXTENT_PAGES); i++ {
+		if pgNumbers[i] != pgNumbers[i-1]+1 {
+			t.Errorf("Data pages of an extent not in order %v", pgNumbers)
+			break
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package core
+
+import (
+	"strings"
+
+	pager "github.com/gjc13/gsdl/pager"
+)
+
+// Schema of the database a session is started with, its tables may also be named main.table
+const MAIN_SCHEMA string = "main"
+
+// Open another database in this session, its tables are named alias.table
+// The databases of a session are committed together by EndUseDatabase, so none of them may be in wal mode
+func (ctx *DbContext) AttachDatabase(filename string, alias string, key []byte) error {
+	if len(alias) == 0 || strings.Contains(alias, ".") || alias == MAIN_SCHEMA {
+		return ERR_SCHEMA
+	}
+	if ctx.findAttached(alias) != nil || filename+".gsdl" == ctx.filename {
+		return ERR_OVERLAPPED
+	}
+	for _, db := range ctx.attached {
+		if db.filename == filename+".gsdl" {
+			return ERR_OVERLAPPED
+		}
+	}
+	if pager.GetJournalMode(ctx.filename) == pager.JOURNAL_MODE_WAL {
+		return ERR_WAL_ATTACH
+	}
+	db, err := startUseDatabase(filename, key, ctx.owner)
+	if err != nil {
+		return err
+	}
+	if pager.GetJournalMode(db.filename) == pager.JOURNAL_MODE_WAL {
+		db.EndUseDatabase()
+		return ERR_WAL_ATTACH
+	}
+	db.schema = alias
+	for _, name := range ctx.savepoints {
+		db.transaction.(*pager.WriteTransaction).Savepoint(name)
+	}
+	ctx.attached = append(ctx.attached, db)
+	return nil
+}
+
+func (ctx *DbContext) findAttached(alias string) *DbContext {
+	for _, db := range ctx.attached {
+		if db.schema == alias {
+			return db
+		}
+	}
+	return nil
+}
+
+// The database holding a table named table or schema.table and the name of the table in it
+func (ctx *DbContext) resolveTable(name string) (*DbContext, string) {
+	i := strings.Index(name, ".")
+	if i < 0 {
+		return ctx, name
+	} else if name[:i] == MAIN_SCHEMA {
+		return ctx, name[i+1:]
+	} else if db := ctx.findAttached(name[:i]); db != nil {
+		return db, name[i+1:]
+	}
+	return ctx, name
+}
+
+// The database of the session and the databases attached to it
+func (ctx *DbContext) databases() []*DbContext {
+	return append([]*DbContext{ctx}, ctx.attached...)
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	pager "github.com/gjc13/gsdl/pager"
+)
+
+func TestAttachDatabase(t *testing.T) {
+	CreateDatabase(":memory:test_db_attach_main", nil)
+	CreateDatabase(":memory:test_db_attach_other", nil)
+	ctx, err := StartUseDatabase(":memory:test_db_attach_other", nil)
+	if err != nil {
+		t.Fatalf("Cannot use database %v", err)
+	}
+	ctx.CreateTable("books", db_column_names1, db_test_meta1)
+	books, _ := ctx.CreateTableView("books")
+	for i := 0; i < 10; i++ {
+		books.Insert([]interface{}{i, 20, fmt.Sprintf("book%d", i)})
+	}
+	ctx.EndUseDatabase()
+	ctx, _ = StartUseDatabase(":memory:test_db_attach_main", nil)
+	ctx.CreateTable("books", db_column_names1, db_test_meta1)
+	if err := ctx.AttachDatabase(":memory:test_db_attach_other", "o", nil); err != nil {
+		t.Fatalf("Cannot attach database %v", err)
+	}
+	if err := ctx.AttachDatabase(":memory:test_db_attach_other", "p", nil); err != ERR_OVERLAPPED {
+		t.Errorf("Database attached twice, get %v", err)
+	}
+	if err := ctx.AttachDatabase(":memory:test_db_attach_other", MAIN_SCHEMA, nil); err != ERR_SCHEMA {
+		t.Errorf("Database attached as main, get %v", err)
+	}
+	if names := ctx.GetTableNames(); len(names) != 2 || names[1] != "o.books" {
+		t.Errorf("Wrong tables %v", names)
+	}
+	other, err1 := ctx.CreateTableView("o.books")
+	if err1 != nil {
+		t.Fatalf("Cannot view attached table %v", err1)
+	}
+	if names := other.ColumnNames(); names[0] != "o.books.book_id" {
+		t.Errorf("Wrong column names %v", names)
+	}
+	//Copy the rows across the files
+	books, _ = ctx.CreateTableView("main.books")
+	for other.Reset(); ; {
+		row, err := other.Next()
+		if err != nil {
+			break
+		}
+		books.Insert(row)
+	}
+	ctx.Savepoint("more")
+	other.Insert([]interface{}{10, 20, "book10"})
+	books.Insert([]interface{}{10, 20, "book10"})
+	if err := ctx.RollbackTo("more"); err != nil {
+		t.Fatalf("Cannot rollback to savepoint %v", err)
+	}
+	if err := ctx.EndUseDatabase(); err != nil {
+		t.Fatalf("Cannot commit databases together %v", err)
+	}
+	for _, filename := range []string{":memory:test_db_attach_main", ":memory:test_db_attach_other"} {
+		ctx, _ = StartUseDatabase(filename, nil)
+		books, _ = ctx.CreateTableView("books")
+		for i := 0; i < 10; i++ {
+			if rows, err := books.Search(0, i); err != nil || len(rows) != 1 {
+				t.Errorf("Wrong rows of book %d in %s, %v %v", i, filename, rows, err)
+			}
+		}
+		if rows, _ := books.Search(0, 10); len(rows) != 0 {
+			t.Errorf("Row inserted after savepoint kept in %s", filename)
+		}
+		ctx.EndUseDatabase()
+	}
+}
+
+func TestAttachDeadlock(t *testing.T) {
+	filenames := []string{":memory:test_db_attach_a", ":memory:test_db_attach_b"}
+	sessions := make([]*DbContext, 2)
+	for i, filename := range filenames {
+		CreateDatabase(filename, nil)
+		sessions[i], _ = StartUseDatabase(filename, nil)
+	}
+	//Each session attaches the database the other one holds
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func(ctx *DbContext, other string) {
+			err := ctx.AttachDatabase(other, "other", nil)
+			if err != nil {
+				ctx.transaction.AbortTransaction()
+			}
+			ctx.EndUseDatabase()
+			errs <- err
+		}(sessions[i], filenames[1-i])
+	}
+	deadlocks := 0
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if _, ok := err.(*pager.DeadlockError); ok {
+				deadlocks++
+			} else if err != nil {
+				t.Errorf("Unexpected error %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Deadlock of sessions not detected")
+		}
+	}
+	if deadlocks != 1 {
+		t.Errorf("Expect one deadlock error, get %d", deadlocks)
+	}
+}
@@ -0,0 +1,369 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+
+	pager "github.com/gjc13/gsdl/pager"
+)
+
+// Walk of the pages of one database which goes on after a problem is found
+type integrityChecker struct {
+	ctx *DbContext
+	//Pages committed to the file, pages written by the transaction may be beyond
+	numPages uint32
+	pages    *livePages
+	//Pages of the extents reserved by the tables, by table name
+	reserved map[uint32]string
+	//False once a page could not be walked, then unreachable pages are not reported as leaked
+	complete bool
+	problems []error
+}
+
+func (c *integrityChecker) report(pgNumber uint32, format string, args ...interface{}) {
+	c.problems = append(c.problems, makeCorruptionError(c.ctx, pgNumber, fmt.Errorf(format, args...)))
+}
+
+// Read a page without aborting the transaction when it fails
+func (c *integrityChecker) readPage(pgNumber uint32) ([]byte, bool) {
+	data, err := c.ctx.transaction.(pager.TransactionReader).ReadPage(pgNumber)
+	if err != nil {
+		c.problems = append(c.problems, err)
+		c.complete = false
+		return nil, false
+	}
+	return data, true
+}
+
+// False if the page was reached before or cannot have the type
+func (c *integrityChecker) addPage(pgNumber uint32, pgType uint8, what string) bool {
+	isNew, err := c.pages.add(c.ctx, pgNumber, pgType)
+	if err != nil {
+		c.problems = append(c.problems, err)
+	} else if !isNew {
+		c.report(pgNumber, "%s reached twice", what)
+	}
+	if err != nil || !isNew {
+		c.complete = false
+		return false
+	}
+	return true
+}
+
+// Check the databases of the session, returns every problem found and nil for sound databases
+// A table which cannot be walked further is left, the other tables are still checked
+func CheckIntegrity(ctx *DbContext) []error {
+	var problems []error
+	for _, db := range ctx.databases() {
+		problems = append(problems, checkIntegrity(db)...)
+	}
+	return problems
+}
+
+func checkIntegrity(ctx *DbContext) []error {
+	wt, ok := ctx.transaction.(*pager.WriteTransaction)
+	if !ok {
+		panic("Not write transaction when checking")
+	}
+	numPages, err := wt.NumPages()
+	if err != nil {
+		return []error{err}
+	}
+	c := &integrityChecker{
+		ctx:      ctx,
+		numPages: numPages,
+		pages: &livePages{
+			types: map[uint32]uint8{},
+			metas: map[uint32]*RowMeta{},
+		},
+		reserved: map[uint32]string{},
+		complete: true,
+	}
+	for pgNumber := ctx.metaPage.FirstTableMetaPageNumber; pgNumber != 0; {
+		metaPage, _ := c.checkTable(pgNumber)
+		if metaPage == nil {
+			break
+		}
+		pgNumber = metaPage.NextTableMetaPgNumber
+	}
+	c.checkFreeMaps()
+	return c.problems
+}
+
+// Check a table with its secondary index tables, returns its meta page and rows or nil if they cannot be read
+func (c *integrityChecker) checkTable(pgNumber uint32) (*tableMetaPage, [][]interface{}) {
+	if !c.addPage(pgNumber, TABLE_META_PAGE, "table meta page") {
+		return nil, nil
+	}
+	data, ok := c.readPage(pgNumber)
+	if !ok {
+		return nil, nil
+	}
+	metaPage, err := tableMetaPageFromData(pgNumber, data)
+	if err != nil {
+		c.report(pgNumber, "%v", err)
+		c.complete = false
+		return nil, nil
+	}
+	return metaPage, c.checkTableData(metaPage)
+}
+
+// Broken pages may make the rows panic when parsed or compared, the panic is reported as a problem of the table
+func (c *integrityChecker) checkTableData(metaPage *tableMetaPage) (rows [][]interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.report(metaPage.PgNumber, "table %s: %v", metaPage.TableName, r)
+			c.complete = false
+			rows = nil
+		}
+	}()
+	clusterFieldId := int(metaPage.RowInfo.ClusterFieldId)
+	if clusterFieldId >= len(metaPage.FieldIndexPgNumbers) {
+		c.report(metaPage.PgNumber, "wrong cluster field %d of table %s", clusterFieldId, metaPage.TableName)
+		c.complete = false
+		return nil
+	}
+	for pgNumber := metaPage.ExtentNext; pgNumber < metaPage.ExtentEnd; pgNumber++ {
+		if other, ok := c.reserved[pgNumber]; ok {
+			c.report(pgNumber, "page reserved by tables %s and %s", other, metaPage.TableName)
+		}
+		c.reserved[pgNumber] = metaPage.TableName
+	}
+	rows, firstKeys := c.checkDataPages(metaPage)
+	if rootPgNumber := metaPage.FieldIndexPgNumbers[clusterFieldId]; rootPgNumber != 0 {
+		c.checkTree(metaPage, rootPgNumber, firstKeys)
+	}
+	for i, indexPgNumber := range metaPage.FieldIndexPgNumbers {
+		if i == clusterFieldId || indexPgNumber == 0 {
+			continue
+		}
+		indexPage, indexRows := c.checkTable(indexPgNumber)
+		if indexPage == nil {
+			continue
+		}
+		if name := fmt.Sprintf("%s:second%d", metaPage.TableName, i); indexPage.TableName != name {
+			c.report(indexPgNumber, "index of field %d of table %s is named %s", i, metaPage.TableName, indexPage.TableName)
+		} else if indexPage.NextTableMetaPgNumber != 0 {
+			c.report(indexPgNumber, "index table %s in the table meta chain", name)
+		}
+		if rows != nil && indexRows != nil {
+			c.checkSecondIndex(metaPage, i, rows, indexPage, indexRows)
+		}
+	}
+	return rows
+}
+
+// Walk the data page chain of a table, returns its rows in order and the first key of each data page
+// The rows are nil if the chain is broken
+func (c *integrityChecker) checkDataPages(metaPage *tableMetaPage) ([][]interface{}, map[uint32]interface{}) {
+	fmeta := metaPage.RowInfo.FieldMetas[metaPage.RowInfo.ClusterFieldId]
+	clusterFieldId := int(metaPage.RowInfo.ClusterFieldId)
+	rows := make([][]interface{}, 0)
+	firstKeys := map[uint32]interface{}{}
+	var prevPgNumber uint32
+	for pgNumber := metaPage.FirstDataPgNumber; pgNumber != 0; {
+		if !c.addPage(pgNumber, dataPageType(metaPage.RowInfo), fmt.Sprintf("data page of table %s", metaPage.TableName)) {
+			return nil, firstKeys
+		}
+		data, ok := c.readPage(pgNumber)
+		if !ok {
+			return nil, firstKeys
+		}
+		page, err := fixDataPageFromData(pgNumber, metaPage.RowInfo, data)
+		if err != nil {
+			c.report(pgNumber, "%v", err)
+			c.complete = false
+			return nil, firstKeys
+		}
+		if page.prevPgNumber != prevPgNumber {
+			c.report(pgNumber, "previous data page %d of table %s, not %d", page.prevPgNumber, metaPage.TableName, prevPgNumber)
+		}
+		for i := 0; i < int(page.numRows); i++ {
+			row := page.getRowAt(i)
+			if len(rows) > 0 && fmeta.cmpField(row[clusterFieldId], rows[len(rows)-1][clusterFieldId]) {
+				c.report(pgNumber, "row %d of table %s out of order", i, metaPage.TableName)
+			}
+			rows = append(rows, row)
+		}
+		firstKeys[pgNumber] = page.firstNonNullKeyField()
+		prevPgNumber, pgNumber = pgNumber, page.nextPgNumber
+	}
+	return rows, firstKeys
+}
+
+// Walk of a B+tree, the leaves are reached in key order
+type treeWalk struct {
+	metaPage  *tableMetaPage
+	firstKeys map[uint32]interface{}
+	leafDepth int
+	leaves    []*indexPage
+	complete  bool
+}
+
+// Check the keys are ordered, the leaves are at the same depth and linked in order
+// and each entry of a leaf is the first key of its data page
+func (c *integrityChecker) checkTree(metaPage *tableMetaPage, rootPgNumber uint32, firstKeys map[uint32]interface{}) {
+	walk := &treeWalk{
+		metaPage:  metaPage,
+		firstKeys: firstKeys,
+		leafDepth: -1,
+		complete:  true,
+	}
+	c.checkIndexPage(walk, rootPgNumber, 0, nil, nil)
+	if !walk.complete {
+		return
+	}
+	for i, leaf := range walk.leaves {
+		var prevPgNumber, nextPgNumber uint32
+		if i > 0 {
+			prevPgNumber = walk.leaves[i-1].PgNumber
+		}
+		if i+1 < len(walk.leaves) {
+			nextPgNumber = walk.leaves[i+1].PgNumber
+		}
+		if leaf.PrevPgNumber != prevPgNumber || leaf.NextPgNumber != nextPgNumber {
+			c.report(leaf.PgNumber, "leaf of table %s linked to %d and %d, not %d and %d", metaPage.TableName,
+				leaf.PrevPgNumber, leaf.NextPgNumber, prevPgNumber, nextPgNumber)
+		}
+	}
+}
+
+// Keys of the page must be at least lower and less than upper, nil for no bound
+func (c *integrityChecker) checkIndexPage(walk *treeWalk, pgNumber uint32, depth int, lower *Key, upper *Key) {
+	name := walk.metaPage.TableName
+	if !c.addPage(pgNumber, CLUSTER_INDEX_PAGE, fmt.Sprintf("index page of table %s", name)) {
+		walk.complete = false
+		return
+	}
+	data, ok := c.readPage(pgNumber)
+	if !ok {
+		walk.complete = false
+		return
+	}
+	page, err := indexPageFromData(pgNumber, data)
+	if err != nil {
+		c.report(pgNumber, "%v", err)
+		c.complete, walk.complete = false, false
+		return
+	}
+	if len(page.Children) == 0 && (depth > 0 || page.isInternal()) {
+		c.report(pgNumber, "empty index page of table %s", name)
+	}
+	for i, elem := range page.Children {
+		if i > 0 && elem.Key <= page.Children[i-1].Key {
+			c.report(pgNumber, "key %d of table %s out of order", elem.Key, name)
+		}
+		if (lower != nil && elem.Key < *lower) || (upper != nil && elem.Key >= *upper) {
+			c.report(pgNumber, "key %d of table %s out of the range of its parent", elem.Key, name)
+		}
+	}
+	if !page.isInternal() {
+		if walk.leafDepth == -1 {
+			walk.leafDepth = depth
+		} else if walk.leafDepth != depth {
+			c.report(pgNumber, "leaf of table %s at depth %d, not %d", name, depth, walk.leafDepth)
+		}
+		walk.leaves = append(walk.leaves, page)
+		c.checkLeafEntries(walk, page)
+		return
+	}
+	for i := range page.Children {
+		childLower, childUpper := lower, upper
+		if i > 0 {
+			childLower = &page.Children[i].Key
+		}
+		if i+1 < len(page.Children) {
+			childUpper = &page.Children[i+1].Key
+		}
+		c.checkIndexPage(walk, page.Children[i].PgNumber, depth+1, childLower, childUpper)
+	}
+}
+
+func (c *integrityChecker) checkLeafEntries(walk *treeWalk, page *indexPage) {
+	fmeta := walk.metaPage.RowInfo.FieldMetas[walk.metaPage.RowInfo.ClusterFieldId]
+	for _, elem := range page.Children {
+		firstKey, ok := walk.firstKeys[elem.PgNumber]
+		if !ok {
+			//The data pages after a broken one are not known
+			if c.complete {
+				c.report(page.PgNumber, "key %d of table %s points to page %d, not a data page of the table",
+					elem.Key, walk.metaPage.TableName, elem.PgNumber)
+			}
+		} else if firstKey == nil || Key(fmeta.hash(firstKey)) != elem.Key {
+			c.report(page.PgNumber, "key %d of table %s is not the first key %v of data page %d",
+				elem.Key, walk.metaPage.TableName, firstKey, elem.PgNumber)
+		}
+	}
+}
+
+// Each row of the table has the field and its cluster key in the index table, which has no other rows
+func (c *integrityChecker) checkSecondIndex(metaPage *tableMetaPage, fieldId int, rows [][]interface{},
+	indexPage *tableMetaPage, indexRows [][]interface{}) {
+	clusterFieldId := int(metaPage.RowInfo.ClusterFieldId)
+	entryOf := func(field interface{}, key interface{}) string {
+		return fmt.Sprintf("(%v, %v)", field, key)
+	}
+	counts := map[string]int{}
+	for _, row := range rows {
+		counts[entryOf(row[fieldId], row[clusterFieldId])]++
+	}
+	for _, row := range indexRows {
+		counts[entryOf(row[0], row[1])]--
+	}
+	entries := make([]string, 0)
+	for entry, n := range counts {
+		if n != 0 {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Strings(entries)
+	for _, entry := range entries {
+		if n := counts[entry]; n > 0 {
+			c.report(indexPage.PgNumber, "%d rows %s of table %s missing in index %s", n, entry, metaPage.TableName, indexPage.TableName)
+		} else {
+			c.report(indexPage.PgNumber, "%d rows %s of index %s not in table %s", -n, entry, indexPage.TableName, metaPage.TableName)
+		}
+	}
+}
+
+// The free maps must mark the reachable pages and the reserved extents used and the other pages free
+func (c *integrityChecker) checkFreeMaps() {
+	pgSize := c.ctx.pageSize()
+	mapSize := pgSize * 8
+	hint := firstFreeMapPgNumber(c.ctx)
+	if !isFreeMapPage(hint, pgSize) {
+		c.report(0, "free space hint %d is not a free map page", hint)
+	}
+	numPages := c.numPages
+	for pgNumber := range c.pages.types {
+		if pgNumber >= numPages {
+			numPages = pgNumber + 1
+		}
+	}
+	for mapPgNumber := uint32(1); mapPgNumber < numPages; mapPgNumber += mapSize {
+		data, ok := c.readPage(mapPgNumber)
+		if !ok {
+			continue
+		}
+		fmp := freeMapPageFromPageData(mapPgNumber, data)
+		if !fmp.freePageMap.Get(mapPgNumber) {
+			c.report(mapPgNumber, "free map page marked free")
+		}
+		if mapPgNumber < hint && fmp.freePageMap.NumFree() > 0 {
+			c.report(mapPgNumber, "free pages before the free space hint %d", hint)
+		}
+		for pgNumber := mapPgNumber + 1; pgNumber < mapPgNumber+mapSize && pgNumber < numPages; pgNumber++ {
+			_, live := c.pages.types[pgNumber]
+			_, reserved := c.reserved[pgNumber]
+			used := fmp.freePageMap.Get(pgNumber)
+			if live && reserved {
+				c.report(pgNumber, "page reserved by table %s in use", c.reserved[pgNumber])
+			}
+			if (live || reserved) && !used {
+				c.report(pgNumber, "page in use marked free")
+			} else if !live && !reserved && used && c.complete {
+				c.report(pgNumber, "page marked used but not reachable")
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+
+	pager "github.com/gjc13/gsdl/pager"
+)
+
+func TestCheckIntegrity(t *testing.T) {
+	CreateDatabase(":memory:test_db_check", nil)
+	ctx, err := StartUseDatabase(":memory:test_db_check", nil)
+	if err != nil {
+		t.Fatalf("Cannot use database %v", err)
+	}
+	ctx.CreateTable("books", db_column_names1, db_test_meta1)
+	ctx.CreateTable("orders", db_column_names2, db_test_meta2)
+	books, _ := ctx.CreateTableView("books")
+	orders, _ := ctx.CreateTableView("orders")
+	for i := 0; i < 2000; i++ {
+		if err := books.Insert([]interface{}{i, i % 7, fmt.Sprintf("book%d", i)}); err != nil {
+			t.Fatalf("Cannot insert book %d %v", i, err)
+		}
+		if err := orders.Insert([]interface{}{i, i % 100, i * 2}); err != nil {
+			t.Fatalf("Cannot insert order %d %v", i, err)
+		}
+	}
+	for i := 0; i < 2000; i += 3 {
+		if err := books.Delete(i, nil); err != nil {
+			t.Fatalf("Cannot delete book %d %v", i, err)
+		}
+	}
+	if problems := CheckIntegrity(ctx); len(problems) != 0 {
+		t.Fatalf("Problems found in sound database %v", problems)
+	}
+	//Break a link of the data pages, the free map and the index of a field at once
+	wt := ctx.transaction.(*pager.WriteTransaction)
+	page, _ := books.loadFixDataPage(books.metaPage.FirstDataPgNumber)
+	next, _ := books.loadFixDataPage(page.nextPgNumber)
+	next.prevPgNumber = 0
+	books.saveFixDataPage(next)
+	freePage(ctx, orders.metaPage.FirstDataPgNumber)
+	index := books.secondIndexTableViews[1]
+	index.Delete(1, nil)
+	problems := CheckIntegrity(ctx)
+	found := map[string]bool{}
+	for _, problem := range problems {
+		err, ok := problem.(*pager.CorruptionError)
+		if !ok {
+			t.Errorf("Not a corruption %v", problem)
+			continue
+		}
+		switch err.PgNumber {
+		case next.pgNumber:
+			found["link"] = true
+		case orders.metaPage.FirstDataPgNumber:
+			found["free"] = true
+		case index.metaPage.PgNumber:
+			found["index"] = true
+		}
+	}
+	if len(found) != 3 {
+		t.Errorf("Not every problem reported, found %v in %v", found, problems)
+	}
+	wt.AbortTransaction()
+	ctx.EndUseDatabase()
+}
@@ -31,20 +31,29 @@ func (m nullMap) getNullMap(i int) bool {
 	return (m[i/8] & (1 << (uint(i) % 8))) > 0
 }
 
+// Bytes a field takes in the row, a varchar takes its 2 byte length and the string
+func fieldDataSize(fmeta *FieldMeta, data []byte) int {
+	if fmeta.DataType == VAR_CHAR_TYPE {
+		return 2 + int(binary.LittleEndian.Uint16(data))
+	}
+	return int(fmeta.FieldWidth)
+}
+
 func parseRow(meta *RowMeta, data []byte) []interface{} {
 	row := []interface{}(nil)
 	nm := nullMap(data[0:meta.nullMapSize()])
 	offset := meta.nullMapSize()
 	for i := 0; i < len(meta.FieldMetas); i++ {
+		size := fieldDataSize(&meta.FieldMetas[i], data[offset:])
 		if nm.getNullMap(i) {
 			row = append(row, nil)
 		} else {
 			row = append(row, parseField(
 				meta.FieldMetas[i].DataType,
 				meta.FieldMetas[i].FieldWidth,
-				data[offset:offset+int(meta.FieldMetas[i].FieldWidth)]))
+				data[offset:offset+size]))
 		}
-		offset += int(meta.FieldMetas[i].FieldWidth)
+		offset += size
 	}
 	return row
 }
@@ -58,10 +67,10 @@ func parseRowField(meta *RowMeta, fieldId int, data []byte) interface{} {
 		}
 	}
 	for i := 0; i < fieldId; i++ {
-		offset += int(meta.FieldMetas[i].FieldWidth)
+		offset += fieldDataSize(&meta.FieldMetas[i], data[offset:])
 	}
 	return parseField(meta.FieldMetas[fieldId].DataType, meta.FieldMetas[fieldId].FieldWidth,
-		data[offset:offset+int(meta.FieldMetas[fieldId].FieldWidth)])
+		data[offset:offset+fieldDataSize(&meta.FieldMetas[fieldId], data[offset:])])
 }
 
 func parseField(fieldType uint8, width uint16, data []byte) interface{} {
@@ -73,7 +82,7 @@ func parseField(fieldType uint8, width uint16, data []byte) interface{} {
 	case FIX_CHAR_TYPE:
 		return parseFixChar(width, data)
 	case VAR_CHAR_TYPE:
-		panic("Does not support varchar for now")
+		return parseVarChar(data)
 	default:
 		panic("Unknown field type")
 	}
@@ -119,6 +128,10 @@ func parseFixChar(width uint16, data []byte) interface{} {
 	return string(data)
 }
 
+func parseVarChar(data []byte) interface{} {
+	return string(data[2:])
+}
+
 func dumpRow(meta *RowMeta, row []interface{}) []byte {
 	data := []byte(nil)
 	for i := 0; i < len(row); i++ {
@@ -132,7 +145,9 @@ func dumpRow(meta *RowMeta, row []interface{}) []byte {
 }
 
 func dumpField(fieldType uint8, width uint16, field interface{}) []byte {
-	if field == nil {
+	if field == nil && fieldType == VAR_CHAR_TYPE {
+		return make([]byte, 2)
+	} else if field == nil {
 		return make([]byte, width)
 	}
 	switch fieldType {
@@ -143,7 +158,7 @@ func dumpField(fieldType uint8, width uint16, field interface{}) []byte {
 	case FIX_CHAR_TYPE:
 		return dumpFixChar(width, field)
 	case VAR_CHAR_TYPE:
-		panic("Does not support varchar for now")
+		return dumpVarChar(width, field)
 	default:
 		panic("Unknown field type")
 	}
@@ -194,3 +209,14 @@ func dumpFixChar(width uint16, field interface{}) []byte {
 	copy(data, str)
 	return data
 }
+
+// Strings longer than the width are cut like fixed chars
+func dumpVarChar(width uint16, field interface{}) []byte {
+	str := field.(string)
+	if len(str) > int(width) {
+		str = str[:width]
+	}
+	data := make([]byte, 2, 2+len(str))
+	binary.LittleEndian.PutUint16(data, uint16(len(str)))
+	return append(data, str...)
+}
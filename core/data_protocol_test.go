@@ -4,10 +4,10 @@ import "testing"
 
 var dp_test_meta *RowMeta = &RowMeta{
 	FieldMetas: []FieldMeta{
-		{INT_TYPE, 4, 1},
-		{FLOAT_TYPE, 4, 1},
-		{INT_TYPE, 8, 1},
-		{FIX_CHAR_TYPE, 200, 1},
+		{INT_TYPE, 4, 1, 0},
+		{FLOAT_TYPE, 4, 1, 0},
+		{INT_TYPE, 8, 1, 0},
+		{FIX_CHAR_TYPE, 200, 1, 0},
 	},
 	ClusterFieldId: 0,
 }
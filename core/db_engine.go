@@ -1,43 +1,330 @@
 package core
 
-import pager "github.com/gjc13/gsdl/pager"
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
 
-func CreateDatabase(filename string) error {
+	pager "github.com/gjc13/gsdl/pager"
+)
+
+type DatabaseOptions struct {
+	//A power of two from 1K to 64K, 0 for pager.PGSIZE
+	PageSize uint32
+	//Number of pages cached, 0 for the pager default
+	CacheSize uint32
+	//Keep the pages compressed on disk, only used when the database file is new
+	Compress bool
+	//AES key of 16, 24 or 32 bytes to encrypt the pages with, nil for plain pages
+	Key []byte
+	//A pager.SYNCHRONOUS_ level used by sessions which do not set their own
+	Synchronous uint8
+}
+
+// Set how long opening a database waits for other processes using it, 0 fails at once
+func SetBusyTimeout(timeout time.Duration) {
+	pager.SetBusyTimeout(timeout)
+}
+
+// Set how long a session waits for other sessions of this process, 0 waits for ever, pager.DEFAULT_LOCK_TIMEOUT by default
+// Sessions which would wait for each other for ever fail with pager.DeadlockError instead
+func SetLockTimeout(timeout time.Duration) {
+	pager.SetLockTimeout(timeout)
+}
+
+// Options may be nil for the defaults, the sizes are kept in the header for later use
+// An existing database with the same name is replaced
+func CreateDatabase(filename string, options *DatabaseOptions) error {
+	if options == nil {
+		options = &DatabaseOptions{}
+	}
+	//Pages of an older database with the same name must not show through the new one
+	if err := pager.RemoveDatabase(filename + ".gsdl"); err != nil {
+		return err
+	}
+	page := newDbMetaPage(options.PageSize)
+	page.CacheSize = options.CacheSize
+	page.Synchronous = uint32(options.Synchronous)
+	if page.PageSize == 0 {
+		page.PageSize = pager.PGSIZE
+	}
+	if options.Compress {
+		page.Features |= FEATURE_COMPRESSED
+	}
+	if len(options.Key) > 0 {
+		page.Features |= FEATURE_ENCRYPTED
+	}
+	if err := applyDatabaseOptions(filename+".gsdl", page); err != nil {
+		return err
+	}
+	if err := pager.SetCompression(filename+".gsdl", options.Compress); err != nil {
+		return err
+	}
+	if err := pager.SetKey(filename+".gsdl", options.Key); err != nil {
+		return err
+	}
 	wt := &pager.WriteTransaction{}
-	wt.StartTransaction(filename + ".gsdl")
-	page := &dbMetaPage{
-		PageNumber:               0,
-		FirstTableMetaPageNumber: 0,
+	if err := wt.StartTransaction(filename + ".gsdl"); err != nil {
+		return err
 	}
-	if err := wt.WritePage(0, page.toPageData()); err != nil {
+	if err := wt.WritePage(0, page.toPageData(page.PageSize)); err != nil {
 		return err
 	}
 	if err := wt.EndTransaction(); err != nil {
 		return err
 	}
+	//The header is read from the database file before the log is opened
+	return pager.Checkpoint(filename + ".gsdl")
+}
+
+func applyDatabaseOptions(filename string, page *dbMetaPage) error {
+	pgSize := page.PageSize
+	if pgSize == 0 {
+		pgSize = pager.PGSIZE
+	}
+	if err := pager.SetPageSize(filename, pgSize); err != nil {
+		return err
+	}
+	//Databases of version 0 may have been written before pages had a trailer
+	trailers := true
+	if page.FormatVersion == 0 {
+		var err error
+		if trailers, err = pager.HasPageTrailers(filename); err != nil {
+			return err
+		}
+	}
+	if err := pager.SetPageTrailers(filename, trailers); err != nil {
+		return err
+	}
+	if err := pager.SetSynchronous(filename, uint8(page.Synchronous)); err != nil {
+		return err
+	}
+	if page.CacheSize != 0 {
+		return pager.SetCacheSize(filename, int(page.CacheSize))
+	}
 	return nil
 }
 
-func StartUseDatabase(filename string) (*DbContext, error) {
+// The pager needs the page size before it can read any page, so the header is read raw
+func loadDatabaseOptions(filename string) error {
+	data, err := pager.ReadHeader(filename, binary.Size(dbMetaPage{}))
+	if os.IsNotExist(err) || err == io.EOF {
+		//Missing databases are reported when page 0 is read
+		return nil
+	} else if err != nil {
+		return err
+	}
+	page, err1 := dbMetaPageFromPageData(0, data)
+	if err1 != nil {
+		return &FormatError{filename, err1.Error()}
+	}
+	//The sizes of newer versions may not be where this code looks for them
+	if page.FormatVersion > FORMAT_VERSION {
+		return newerFormatError(filename, page)
+	}
+	return applyDatabaseOptions(filename, page)
+}
+
+// The key must be the one the database was created with, nil for plain databases
+func StartUseDatabase(filename string, key []byte) (*DbContext, error) {
+	return startUseDatabase(filename, key, pager.NewLockOwner())
+}
+
+func startUseDatabase(filename string, key []byte, owner int64) (*DbContext, error) {
+	lockCtx := pager.WithLockOwner(context.Background(), owner)
+	if err := pager.SetKey(filename+".gsdl", key); err != nil {
+		return nil, err
+	}
+	if err := loadDatabaseOptions(filename + ".gsdl"); err != nil {
+		return nil, err
+	}
+	if err := pager.RecoverContext(lockCtx, filename+".gsdl"); err != nil {
+		return nil, err
+	}
+	wt := &pager.WriteTransaction{}
 	ctx := &DbContext{
-		transaction: &pager.WriteTransaction{},
+		filename:    filename + ".gsdl",
+		transaction: wt,
+		owner:       owner,
+	}
+	if err := wt.StartTransactionContext(lockCtx, ctx.filename); err != nil {
+		return nil, err
 	}
-	ctx.transaction.StartTransaction(filename + ".gsdl")
 	rt := ctx.transaction.(pager.TransactionReader)
 	data, err := rt.ReadPage(0)
 	if err != nil {
-		rt.AbortTransaction()
+		ctx.transaction.EndTransaction()
+		return nil, err
+	}
+	if err := checkDatabase(ctx, data); err != nil {
+		ctx.transaction.EndTransaction()
 		return nil, err
 	}
-	ctx.metaPage = dbMetaPageFromPageData(0, data)
 	return ctx, nil
 }
 
+// Encrypt a database not in use with a new key, the old key must be the one it is encrypted with
+func RekeyDatabase(filename string, oldKey []byte, newKey []byte) error {
+	if err := pager.SetKey(filename+".gsdl", oldKey); err != nil {
+		return err
+	}
+	if err := loadDatabaseOptions(filename + ".gsdl"); err != nil {
+		return err
+	}
+	if err := pager.Recover(filename + ".gsdl"); err != nil {
+		return err
+	}
+	return pager.Rekey(filename+".gsdl", newKey)
+}
+
+// Copy a consistent image of the database src to the database dst, which is replaced
+// Sessions of src go on while the copy is made, only the work they have committed is copied
+// An encrypted src must have its key set by a session or RekeyDatabase, the copy keeps the key
+func Backup(src string, dst string) error {
+	if err := loadDatabaseOptions(src + ".gsdl"); err != nil {
+		return err
+	}
+	return pager.Backup(src+".gsdl", dst+".gsdl")
+}
+
+// Track the changes of a database not in use, so later backups of it can be incremental
+func EnableChangeTracking(filename string) error {
+	if err := loadDatabaseOptions(filename + ".gsdl"); err != nil {
+		return err
+	}
+	return pager.EnableChangeTracking(filename + ".gsdl")
+}
+
+// Track the changes of the database of the session from its next commit on, without committing its work
+func (ctx *DbContext) EnableChangeTracking() error {
+	return ctx.transaction.(*pager.WriteTransaction).EnableChangeTracking()
+}
+
+// Id of a backup, or of the last commit of a database with change tracking on
+func BackupId(filename string) (uint64, error) {
+	if err := loadDatabaseOptions(filename + ".gsdl"); err != nil {
+		return 0, err
+	}
+	return pager.BackupId(filename + ".gsdl")
+}
+
+// Write the pages of the database src changed after the backup since to the delta file dst, returns the id of the new backup
+func IncrementalBackup(src string, dst string, since uint64) (uint64, error) {
+	if err := loadDatabaseOptions(src + ".gsdl"); err != nil {
+		return 0, err
+	}
+	return pager.IncrementalBackup(src+".gsdl", dst, since)
+}
+
+// Make the database dst from a full backup and the delta files made after it, in the order they were made
+// The key must be the one the backed up database is encrypted with, nil for plain databases
+func RestoreBackup(dst string, full string, deltas []string, key []byte) error {
+	if err := pager.SetKey(full+".gsdl", key); err != nil {
+		return err
+	}
+	if err := Backup(full, dst); err != nil {
+		return err
+	}
+	for _, delta := range deltas {
+		if err := pager.ApplyIncrementalBackup(dst+".gsdl", delta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit the work of the session, the attached databases are committed together with the database of the session
 func (ctx *DbContext) EndUseDatabase() error {
-	return ctx.transaction.EndTransaction()
+	if len(ctx.attached) == 0 {
+		return ctx.transaction.EndTransaction()
+	}
+	transactions := make([]*pager.WriteTransaction, 0, len(ctx.attached)+1)
+	for _, db := range ctx.databases() {
+		transactions = append(transactions, db.transaction.(*pager.WriteTransaction))
+	}
+	ctx.attached = nil
+	return pager.EndTransactions(transactions)
 }
 
+// Set the synchronous level of this session
+func (ctx *DbContext) SetSynchronous(level uint8) error {
+	for _, db := range ctx.databases() {
+		if err := db.transaction.(*pager.WriteTransaction).SetSynchronous(level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set the synchronous level kept in the header, used by sessions started later
+func (ctx *DbContext) SetDatabaseSynchronous(level uint8) error {
+	if err := pager.SetSynchronous(ctx.filename, level); err != nil {
+		return err
+	}
+	ctx.metaPage.Synchronous = uint32(level)
+	return ctx.transaction.(*pager.WriteTransaction).WritePage(0, ctx.metaPage.toPageData(ctx.pageSize()))
+}
+
+func (ctx *DbContext) Savepoint(name string) {
+	for _, db := range ctx.databases() {
+		db.transaction.(*pager.WriteTransaction).Savepoint(name)
+	}
+	ctx.savepoints = append(ctx.savepoints, name)
+}
+
+// Undo the changes made since the savepoint, views created before it must not be used again
+func (ctx *DbContext) RollbackTo(name string) error {
+	for _, db := range ctx.databases() {
+		if err := db.rollbackTo(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ctx *DbContext) rollbackTo(name string) error {
+	wt := ctx.transaction.(*pager.WriteTransaction)
+	if err := wt.RollbackTo(name); err != nil {
+		return err
+	}
+	//Tables created since the savepoint may have changed the header
+	data, err1 := wt.ReadPage(0)
+	if err1 != nil {
+		return err1
+	}
+	metaPage, err2 := dbMetaPageFromPageData(0, data)
+	if err2 != nil {
+		return makeCorruptionError(ctx, 0, err2)
+	}
+	ctx.metaPage = metaPage
+	ctx.freeCounts = nil
+	return nil
+}
+
+func (ctx *DbContext) Release(name string) error {
+	for _, db := range ctx.databases() {
+		if err := db.transaction.(*pager.WriteTransaction).Release(name); err != nil {
+			return err
+		}
+	}
+	for i := len(ctx.savepoints) - 1; i >= 0; i-- {
+		if ctx.savepoints[i] == name {
+			ctx.savepoints = ctx.savepoints[:i]
+			break
+		}
+	}
+	return nil
+}
+
+func (ctx *DbContext) Stats() pager.PagerStats {
+	return ctx.transaction.(*pager.WriteTransaction).Stats()
+}
+
+// Tables of attached databases are named schema.table
 func (ctx *DbContext) CreateTable(name string, columnNames []string, meta *RowMeta) error {
+	ctx, name = ctx.resolveTable(name)
 	wt, ok := ctx.transaction.(*pager.WriteTransaction)
 	if !ok {
 		panic("Cannot write when creating table")
@@ -46,17 +333,31 @@ func (ctx *DbContext) CreateTable(name string, columnNames []string, meta *RowMe
 	if err1 != ERR_NOT_FOUND {
 		return ERR_OVERLAPPED
 	}
+	if meta.maxSize() > maxRowSizeOf(ctx.pageSize()) {
+		return ERR_ROW_SIZE
+	}
 	newPageNumber, err2 := createTable(ctx, name, columnNames, meta)
 	if err2 != nil {
 		return err2
 	}
+	//Older versions cannot read the slotted pages of varchar rows, the flag is written with the table
+	writeMeta := meta.varLen() && ctx.metaPage.Features&FEATURE_VARCHAR == 0
+	if writeMeta {
+		ctx.metaPage.Features |= FEATURE_VARCHAR
+	}
 	if ctx.metaPage.FirstTableMetaPageNumber == 0 {
 		ctx.metaPage.FirstTableMetaPageNumber = newPageNumber
-		return wt.WritePage(0, ctx.metaPage.toPageData())
+		writeMeta = true
 	} else {
 		oldPage.NextTableMetaPgNumber = newPageNumber
-		return saveTableMetaPage(ctx, oldPage)
+		if err3 := saveTableMetaPage(ctx, oldPage); err3 != nil {
+			return err3
+		}
+	}
+	if writeMeta {
+		return wt.WritePage(0, ctx.metaPage.toPageData(ctx.pageSize()))
 	}
+	return nil
 }
 
 func (ctx *DbContext) GetTableNames() []string {
@@ -74,6 +375,11 @@ func (ctx *DbContext) GetTableNames() []string {
 		}
 		nowPgNumber = metaPage.NextTableMetaPgNumber
 	}
+	for _, db := range ctx.attached {
+		for _, name := range db.GetTableNames() {
+			result = append(result, db.schema+"."+name)
+		}
+	}
 	return result
 }
 
@@ -92,19 +398,49 @@ func (ctx *DbContext) GetTableMetas() []*RowMeta {
 		}
 		nowPgNumber = metaPage.NextTableMetaPgNumber
 	}
+	for _, db := range ctx.attached {
+		result = append(result, db.GetTableMetas()...)
+	}
 	return result
 }
 
+// Unlink the table from the table meta chain and free all its pages, views of the table must not be used again
 func (ctx *DbContext) DropTable(name string) error {
-	oldPage, _ := ctx.findTableMetaWithName(name)
-	if oldPage == nil {
-		return ERR_NOT_FOUND
+	ctx, name = ctx.resolveTable(name)
+	wt, ok := ctx.transaction.(*pager.WriteTransaction)
+	if !ok {
+		panic("Cannot write when dropping table")
+	}
+	oldPage, err := ctx.findTableMetaWithName(name)
+	if err != nil {
+		return err
+	}
+	if ctx.metaPage.FirstTableMetaPageNumber == oldPage.PgNumber {
+		ctx.metaPage.FirstTableMetaPageNumber = oldPage.NextTableMetaPgNumber
+		if err1 := wt.WritePage(0, ctx.metaPage.toPageData(ctx.pageSize())); err1 != nil {
+			return err1
+		}
+		return freeTablePages(ctx, oldPage)
+	}
+	for pgNumber := ctx.metaPage.FirstTableMetaPageNumber; pgNumber != 0; {
+		prevPage, err2 := loadTableMetaPage(ctx, pgNumber)
+		if err2 != nil {
+			return err2
+		}
+		if prevPage.NextTableMetaPgNumber == oldPage.PgNumber {
+			prevPage.NextTableMetaPgNumber = oldPage.NextTableMetaPgNumber
+			if err3 := saveTableMetaPage(ctx, prevPage); err3 != nil {
+				return err3
+			}
+			return freeTablePages(ctx, oldPage)
+		}
+		pgNumber = prevPage.NextTableMetaPgNumber
 	}
-	oldPage.Dropped = 1
-	return saveTableMetaPage(ctx, oldPage)
+	return ERR_NOT_FOUND
 }
 
 func (ctx *DbContext) CreateTableView(name string) (*TableView, error) {
+	ctx, name = ctx.resolveTable(name)
 	tMetaPage, _ := ctx.findTableMetaWithName(name)
 	if tMetaPage == nil {
 		return nil, ERR_NOT_FOUND
@@ -1,15 +1,23 @@
 package core
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"os"
 	"testing"
+
+	pager "github.com/gjc13/gsdl/pager"
+	utils "github.com/gjc13/gsdl/utils"
 )
 
 var db_test_meta1 *RowMeta = &RowMeta{
 	FieldMetas: []FieldMeta{
-		{INT_TYPE, 4, 0},
-		{INT_TYPE, 8, 1},
-		{FIX_CHAR_TYPE, 64, 1},
+		{INT_TYPE, 4, 0, 0},
+		{INT_TYPE, 8, 1, 0},
+		{FIX_CHAR_TYPE, 64, 1, 0},
 	},
 	ClusterFieldId: 0,
 }
@@ -20,9 +28,9 @@ var db_column_names1 []string = []string{
 
 var db_test_meta2 *RowMeta = &RowMeta{
 	FieldMetas: []FieldMeta{
-		{INT_TYPE, 4, 0},
-		{INT_TYPE, 4, 1},
-		{INT_TYPE, 8, 1},
+		{INT_TYPE, 4, 0, 0},
+		{INT_TYPE, 4, 1, 0},
+		{INT_TYPE, 8, 1, 0},
 	},
 	ClusterFieldId: 0,
 }
@@ -32,10 +40,10 @@ var db_column_names2 []string = []string{
 }
 
 func TestTableInsertDelete(t *testing.T) {
-	if err := CreateDatabase("test_db1"); err != nil {
+	if err := CreateDatabase(":memory:test_db1", nil); err != nil {
 		t.Errorf("%v", err)
 	}
-	ctx, err1 := StartUseDatabase("test_db1")
+	ctx, err1 := StartUseDatabase(":memory:test_db1", nil)
 	if err1 != nil {
 		t.Error("Cannot Use database")
 	}
@@ -55,7 +63,8 @@ func TestTableInsertDelete(t *testing.T) {
 }
 
 func TestTableView(t *testing.T) {
-	ctx, _ := StartUseDatabase("test_db1")
+	ctx, _ := StartUseDatabase(":memory:test_db1", nil)
+	defer ctx.EndUseDatabase()
 	view, err1 := ctx.CreateTableView("books")
 	if err1 != nil {
 		t.Error("Cannot create view")
@@ -81,3 +90,439 @@ func TestTableView(t *testing.T) {
 		})
 	}
 }
+
+func TestStartUseCorruptedDatabase(t *testing.T) {
+	if err := CreateDatabase(":memory:test_db_corrupted", nil); err != nil {
+		t.Errorf("%v", err)
+	}
+	page := newDbMetaPage(pager.PGSIZE)
+	page.FirstTableMetaPageNumber = 100
+	wt := &pager.WriteTransaction{}
+	wt.StartTransaction(":memory:test_db_corrupted.gsdl")
+	wt.WritePage(0, page.toPageData(pager.PGSIZE))
+	wt.EndTransaction()
+	ctx, err := StartUseDatabase(":memory:test_db_corrupted", nil)
+	if _, ok := err.(*pager.RecoveryError); !ok || ctx != nil {
+		t.Errorf("Corrupted database not reported, get %v", err)
+	}
+	//The failed open must not keep the database locked
+	if err := CreateDatabase(":memory:test_db_corrupted", nil); err != nil {
+		t.Errorf("%v", err)
+	}
+	if ctx, err = StartUseDatabase(":memory:test_db_corrupted", nil); err != nil {
+		t.Errorf("Cannot use recreated database %v", err)
+	} else {
+		ctx.EndUseDatabase()
+	}
+}
+
+func TestDatabaseOptions(t *testing.T) {
+	if err := CreateDatabase(":memory:test_db_options", &DatabaseOptions{PageSize: 3000}); err == nil {
+		t.Error("Wrong page size accepted")
+	}
+	if err := CreateDatabase(":memory:test_db_options", &DatabaseOptions{PageSize: 1024, CacheSize: 16}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer pager.SetPageSize(":memory:test_db_options.gsdl", pager.PGSIZE)
+	ctx, err := StartUseDatabase(":memory:test_db_options", nil)
+	if err != nil {
+		t.Fatalf("Cannot use database %v", err)
+	}
+	if err := ctx.CreateTable("books", db_column_names1, db_test_meta1); err != nil {
+		t.Fatalf("Cannot create table %v", err)
+	}
+	view, _ := ctx.CreateTableView("books")
+	for i := 0; i < 500; i++ {
+		if err := view.Insert([]interface{}{i, 20, fmt.Sprintf("book%d", i)}); err != nil {
+			t.Fatalf("Cannot insert row %d %v", i, err)
+		}
+	}
+	ctx.EndUseDatabase()
+	//Forget the page size, it must come back from the header
+	pager.SetPageSize(":memory:test_db_options.gsdl", pager.PGSIZE)
+	if ctx, err = StartUseDatabase(":memory:test_db_options", nil); err != nil {
+		t.Fatalf("Cannot reopen database %v", err)
+	}
+	defer ctx.EndUseDatabase()
+	if ctx.pageSize() != 1024 {
+		t.Errorf("Wrong page size after reopen %d", ctx.pageSize())
+	}
+	view, _ = ctx.CreateTableView("books")
+	for _, i := range []int{0, 250, 499} {
+		if res, _ := view.Search(0, i); len(res) != 1 {
+			t.Errorf("Cannot find row %d", i)
+		}
+	}
+}
+
+func TestCompressedDatabase(t *testing.T) {
+	if err := CreateDatabase(":memory:test_db_compressed", &DatabaseOptions{Compress: true}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	ctx, err := StartUseDatabase(":memory:test_db_compressed", nil)
+	if err != nil {
+		t.Fatalf("Cannot use database %v", err)
+	}
+	if err := ctx.CreateTable("books", db_column_names1, db_test_meta1); err != nil {
+		t.Fatalf("Cannot create table %v", err)
+	}
+	view, _ := ctx.CreateTableView("books")
+	for i := 0; i < 500; i++ {
+		if err := view.Insert([]interface{}{i, 20, fmt.Sprintf("book%d", i)}); err != nil {
+			t.Fatalf("Cannot insert row %d %v", i, err)
+		}
+	}
+	ctx.EndUseDatabase()
+	if ctx, err = StartUseDatabase(":memory:test_db_compressed", nil); err != nil {
+		t.Fatalf("Cannot reopen database %v", err)
+	}
+	defer ctx.EndUseDatabase()
+	view, _ = ctx.CreateTableView("books")
+	for _, i := range []int{0, 250, 499} {
+		if res, _ := view.Search(0, i); len(res) != 1 {
+			t.Errorf("Cannot find row %d", i)
+		}
+	}
+}
+
+func TestEncryptedDatabase(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	newKey := []byte("fedcba9876543210")
+	defer pager.SetKey(":memory:test_db_encrypted.gsdl", nil)
+	if err := CreateDatabase(":memory:test_db_encrypted", &DatabaseOptions{PageSize: 1024, Key: key}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	ctx, err := StartUseDatabase(":memory:test_db_encrypted", key)
+	if err != nil {
+		t.Fatalf("Cannot use database %v", err)
+	}
+	if err := ctx.CreateTable("books", db_column_names1, db_test_meta1); err != nil {
+		t.Fatalf("Cannot create table %v", err)
+	}
+	ctx.EndUseDatabase()
+	if _, err := StartUseDatabase(":memory:test_db_encrypted", newKey); err == nil {
+		t.Fatal("Database opened with wrong key")
+	}
+	if err := RekeyDatabase(":memory:test_db_encrypted", key, newKey); err != nil {
+		t.Fatalf("Cannot rekey %v", err)
+	}
+	if ctx, err = StartUseDatabase(":memory:test_db_encrypted", newKey); err != nil {
+		t.Fatalf("Cannot use database with new key %v", err)
+	}
+	defer ctx.EndUseDatabase()
+	if ctx.pageSize() != 1024 {
+		t.Errorf("Wrong page size %d", ctx.pageSize())
+	}
+	if names := ctx.GetTableNames(); len(names) != 1 || names[0] != "books" {
+		t.Errorf("Wrong tables %v", names)
+	}
+}
+
+func TestSavepointRollback(t *testing.T) {
+	if err := CreateDatabase(":memory:test_db_savepoint", nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	ctx, err := StartUseDatabase(":memory:test_db_savepoint", nil)
+	if err != nil {
+		t.Fatalf("Cannot use database %v", err)
+	}
+	defer ctx.EndUseDatabase()
+	ctx.CreateTable("books", db_column_names1, db_test_meta1)
+	ctx.Savepoint("batch")
+	view, _ := ctx.CreateTableView("books")
+	for i := 0; i < 100; i++ {
+		view.Insert([]interface{}{i, 20, fmt.Sprintf("book%d", i)})
+	}
+	ctx.CreateTable("orders", db_column_names2, db_test_meta2)
+	if err := ctx.RollbackTo("batch"); err != nil {
+		t.Fatalf("Cannot rollback to savepoint %v", err)
+	}
+	if names := ctx.GetTableNames(); len(names) != 1 {
+		t.Errorf("Table created after savepoint kept %v", names)
+	}
+	view, _ = ctx.CreateTableView("books")
+	if hasNext, _ := view.HasNext(); hasNext {
+		t.Error("Rows inserted after savepoint kept")
+	}
+	if err := ctx.Release("batch"); err != nil {
+		t.Errorf("Cannot release savepoint %v", err)
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	if err := CreateDatabase(":memory:test_db_vacuum", nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+	ctx, err := StartUseDatabase(":memory:test_db_vacuum", nil)
+	if err != nil {
+		t.Fatalf("Cannot use database %v", err)
+	}
+	ctx.CreateTable("books", db_column_names1, db_test_meta1)
+	ctx.CreateTable("orders", db_column_names2, db_test_meta2)
+	books, _ := ctx.CreateTableView("books")
+	orders, _ := ctx.CreateTableView("orders")
+	for i := 0; i < 1000; i++ {
+		books.Insert([]interface{}{i, i + 10000, fmt.Sprintf("book%d", i)})
+		if i%10 == 0 {
+			orders.Insert([]interface{}{i, i, i * 2})
+		}
+	}
+	for i := 0; i < 950; i++ {
+		books.Delete(i, nil)
+	}
+	ctx.EndUseDatabase()
+	ctx, _ = StartUseDatabase(":memory:test_db_vacuum", nil)
+	wt := ctx.transaction.(*pager.WriteTransaction)
+	numPages, _ := wt.NumPages()
+	if err := ctx.Vacuum(); err != nil {
+		t.Fatalf("Cannot vacuum %v", err)
+	}
+	ctx.EndUseDatabase()
+	if ctx, err = StartUseDatabase(":memory:test_db_vacuum", nil); err != nil {
+		t.Fatalf("Cannot use vacuumed database %v", err)
+	}
+	defer ctx.EndUseDatabase()
+	wt = ctx.transaction.(*pager.WriteTransaction)
+	if newNumPages, _ := wt.NumPages(); newNumPages >= numPages {
+		t.Errorf("Database not shrunk, %d pages before and %d after", numPages, newNumPages)
+	}
+	books, _ = ctx.CreateTableView("books")
+	orders, _ = ctx.CreateTableView("orders")
+	for i := 950; i < 1000; i++ {
+		if rows, err := books.Search(0, i); err != nil || len(rows) != 1 {
+			t.Errorf("Wrong rows of book %d, %v %v", i, rows, err)
+		}
+		if rows, err := books.Search(1, i+10000); err != nil || len(rows) != 1 || rows[0][0].(int32) != int32(i) {
+			t.Errorf("Wrong rows of price %d, %v %v", i+10000, rows, err)
+		}
+	}
+	if rows, err := orders.Search(2, 200); err != nil || len(rows) != 1 {
+		t.Errorf("Wrong rows of order, %v %v", rows, err)
+	}
+	//Pages are allocated again after the new end
+	books.Insert([]interface{}{2000, 20, "book2000"})
+	if rows, err := books.Search(0, 2000); err != nil || len(rows) != 1 {
+		t.Errorf("Wrong rows of new book, %v %v", rows, err)
+	}
+}
+
+func TestDropTable(t *testing.T) {
+	CreateDatabase(":memory:test_db_drop", nil)
+	ctx, err := StartUseDatabase(":memory:test_db_drop", nil)
+	if err != nil {
+		t.Fatalf("Cannot use database %v", err)
+	}
+	ctx.CreateTable("books", db_column_names1, db_test_meta1)
+	ctx.CreateTable("orders", db_column_names2, db_test_meta2)
+	ctx.CreateTable("customers", db_column_names2, db_test_meta2)
+	books, _ := ctx.CreateTableView("books")
+	orders, _ := ctx.CreateTableView("orders")
+	for i := 0; i < 1000; i++ {
+		books.Insert([]interface{}{i, i + 10000, fmt.Sprintf("book%d", i)})
+		orders.Insert([]interface{}{i, i, i * 2})
+	}
+	if err := ctx.DropTable("stores"); err != ERR_NOT_FOUND {
+		t.Errorf("Table not there dropped, get %v", err)
+	}
+	if err := ctx.DropTable("orders"); err != nil {
+		t.Fatalf("Cannot drop table in the middle %v", err)
+	}
+	if err := ctx.DropTable("books"); err != nil {
+		t.Fatalf("Cannot drop first table %v", err)
+	}
+	if names := ctx.GetTableNames(); len(names) != 1 || names[0] != "customers" {
+		t.Errorf("Wrong tables after drop %v", names)
+	}
+	//Every page of the tables is free again
+	if problems := CheckIntegrity(ctx); len(problems) != 0 {
+		t.Errorf("Problems found after drop %v", problems)
+	}
+	ctx.EndUseDatabase()
+	ctx, _ = StartUseDatabase(":memory:test_db_drop", nil)
+	numPages, _ := ctx.transaction.(*pager.WriteTransaction).NumPages()
+	ctx.CreateTable("books", db_column_names1, db_test_meta1)
+	books, _ = ctx.CreateTableView("books")
+	for i := 0; i < 1000; i++ {
+		books.Insert([]interface{}{i, i + 10000, fmt.Sprintf("book%d", i)})
+	}
+	ctx.EndUseDatabase()
+	ctx, _ = StartUseDatabase(":memory:test_db_drop", nil)
+	defer ctx.EndUseDatabase()
+	if newNumPages, _ := ctx.transaction.(*pager.WriteTransaction).NumPages(); newNumPages > numPages {
+		t.Errorf("Pages of dropped tables not used again, %d pages before and %d after", numPages, newNumPages)
+	}
+}
+
+func TestBackupDatabase(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	defer pager.SetKey(":memory:test_db_backup.gsdl", nil)
+	defer pager.SetKey(":memory:test_db_backup_copy.gsdl", nil)
+	if err := CreateDatabase(":memory:test_db_backup", &DatabaseOptions{PageSize: 2048, Compress: true, Key: key}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	ctx, err := StartUseDatabase(":memory:test_db_backup", key)
+	if err != nil {
+		t.Fatalf("Cannot use database %v", err)
+	}
+	ctx.CreateTable("books", db_column_names1, db_test_meta1)
+	books, _ := ctx.CreateTableView("books")
+	for i := 0; i < 200; i++ {
+		books.Insert([]interface{}{i, i + 10000, fmt.Sprintf("book%d", i)})
+	}
+	ctx.EndUseDatabase()
+	ctx, _ = StartUseDatabase(":memory:test_db_backup", key)
+	books, _ = ctx.CreateTableView("books")
+	books.Insert([]interface{}{200, 10200, "book200"})
+	//The session goes on, its work not committed is left out
+	if err := ctx.EnableChangeTracking(); err != nil {
+		t.Fatalf("Cannot track changes in session %v", err)
+	}
+	if err := Backup(":memory:test_db_backup", ":memory:test_db_backup_copy"); err != nil {
+		t.Fatalf("Cannot back up %v", err)
+	}
+	ctx.EndUseDatabase()
+	//The commit after the backup is tracked
+	id, _ := BackupId(":memory:test_db_backup_copy")
+	if lsn, err := IncrementalBackup(":memory:test_db_backup", ":memory:test_db_backup_delta", id); err != nil || lsn <= id {
+		t.Errorf("Commit after backup %d not tracked, get %d %v", id, lsn, err)
+	}
+	if ctx, err = StartUseDatabase(":memory:test_db_backup_copy", key); err != nil {
+		t.Fatalf("Cannot use backup %v", err)
+	}
+	defer ctx.EndUseDatabase()
+	if ctx.pageSize() != 2048 {
+		t.Errorf("Wrong page size %d", ctx.pageSize())
+	}
+	books, _ = ctx.CreateTableView("books")
+	for i := 0; i < 200; i++ {
+		if rows, err := books.Search(0, i); err != nil || len(rows) != 1 {
+			t.Errorf("Wrong rows of book %d, %v %v", i, rows, err)
+		}
+	}
+	if rows, _ := books.Search(0, 200); len(rows) != 0 {
+		t.Error("Work not committed in backup")
+	}
+}
+
+// Remove the files a test database leaves behind
+func removeTestDatabase(filename string) {
+	for _, suffix := range []string{"", pager.JOURNAL_SUFFIX, pager.WAL_SUFFIX, pager.CHANGES_SUFFIX, pager.LOCK_SUFFIX} {
+		os.Remove(filename + ".gsdl" + suffix)
+	}
+}
+
+// Database written by the code before pages had a trailer and the header had a version
+// A table books of 20 rows, book i has price i+10000 and name booki
+func copyBaselineDatabase(t *testing.T, filename string) {
+	file, err := os.Open("testdata/baseline_books.gsdl.gz")
+	if err != nil {
+		t.Fatalf("Cannot open baseline database %v", err)
+	}
+	defer file.Close()
+	reader, err1 := gzip.NewReader(file)
+	if err1 != nil {
+		t.Fatalf("Cannot read baseline database %v", err1)
+	}
+	data, err2 := io.ReadAll(reader)
+	if err2 != nil {
+		t.Fatalf("Cannot read baseline database %v", err2)
+	}
+	os.Remove(filename + ".gsdl-journal")
+	if err3 := os.WriteFile(filename+".gsdl", data, 0660); err3 != nil {
+		t.Fatalf("Cannot copy baseline database %v", err3)
+	}
+}
+
+func TestStartUseBaselineDatabase(t *testing.T) {
+	copyBaselineDatabase(t, "/tmp/test_db_baseline")
+	defer removeTestDatabase("/tmp/test_db_baseline")
+	//The pages are read without a trailer, the old header then asks for an upgrade
+	if _, err := StartUseDatabase("/tmp/test_db_baseline", nil); err == nil {
+		t.Fatal("Database of the baseline format used")
+	} else if _, ok := err.(*FormatError); !ok {
+		t.Errorf("Wrong error for baseline database %v", err)
+	}
+}
+
+func TestUpgradeDatabase(t *testing.T) {
+	copyBaselineDatabase(t, "/tmp/test_db_upgrade_baseline")
+	defer removeTestDatabase("/tmp/test_db_upgrade_baseline")
+	info, _ := os.Stat("/tmp/test_db_upgrade_baseline.gsdl")
+	numPages := info.Size() / int64(pager.PGSIZE)
+	if err := UpgradeDatabase("/tmp/test_db_upgrade_baseline", nil); err != nil {
+		t.Fatalf("Cannot upgrade baseline database %v", err)
+	}
+	if info, _ := os.Stat("/tmp/test_db_upgrade_baseline.gsdl"); info.Size() != numPages*int64(pager.PGSIZE+pager.PAGE_TRAILER_SIZE) {
+		t.Errorf("Pages not given a trailer, size %d", info.Size())
+	}
+	ctx, err := StartUseDatabase("/tmp/test_db_upgrade_baseline", nil)
+	if err != nil {
+		t.Fatalf("Cannot use upgraded database %v", err)
+	}
+	if ctx.metaPage.FormatVersion != FORMAT_VERSION || ctx.metaPage.Features != 0 {
+		t.Errorf("Wrong header version %d features %d", ctx.metaPage.FormatVersion, ctx.metaPage.Features)
+	}
+	books, _ := ctx.CreateTableView("books")
+	for i := 0; i < 20; i++ {
+		if rows, err := books.Search(0, i); err != nil || len(rows) != 1 || rows[0][2] != fmt.Sprintf("book%d", i) {
+			t.Errorf("Wrong rows of book %d, %v %v", i, rows, err)
+		}
+	}
+	if problems := CheckIntegrity(ctx); len(problems) != 0 {
+		t.Errorf("Problems found in upgraded database %v", problems)
+	}
+	ctx.EndUseDatabase()
+	//Databases of version 0 with trailers, which may be compressed, only get a new header
+	if err := CreateDatabase(":memory:test_db_upgrade", &DatabaseOptions{Compress: true}); err != nil {
+		t.Fatalf("%v", err)
+	}
+	ctx, _ = StartUseDatabase(":memory:test_db_upgrade", nil)
+	ctx.CreateTable("books", db_column_names1, db_test_meta1)
+	books, _ = ctx.CreateTableView("books")
+	for i := 0; i < 20; i++ {
+		books.Insert([]interface{}{i, i + 10000, fmt.Sprintf("book%d", i)})
+	}
+	ctx.EndUseDatabase()
+	wt := &pager.WriteTransaction{}
+	wt.StartTransaction(":memory:test_db_upgrade.gsdl")
+	data, _ := wt.ReadPage(0)
+	page, _ := dbMetaPageFromPageData(0, data)
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &legacyDbMetaPage{FirstTableMetaPageNumber: page.FirstTableMetaPageNumber})
+	wt.WritePage(0, utils.PadToPage(buf.Bytes(), pager.PGSIZE))
+	wt.EndTransaction()
+	if _, err := StartUseDatabase(":memory:test_db_upgrade", nil); err == nil {
+		t.Fatal("Database of an old version used")
+	} else if _, ok := err.(*FormatError); !ok {
+		t.Errorf("Wrong error for old version %v", err)
+	}
+	if err := UpgradeDatabase(":memory:test_db_upgrade", nil); err != nil {
+		t.Fatalf("Cannot upgrade %v", err)
+	}
+	ctx, err = StartUseDatabase(":memory:test_db_upgrade", nil)
+	if err != nil {
+		t.Fatalf("Cannot use upgraded database %v", err)
+	}
+	if ctx.metaPage.FormatVersion != FORMAT_VERSION || ctx.metaPage.Features != FEATURE_COMPRESSED {
+		t.Errorf("Wrong header version %d features %d", ctx.metaPage.FormatVersion, ctx.metaPage.Features)
+	}
+	books, _ = ctx.CreateTableView("books")
+	for i := 0; i < 20; i++ {
+		if rows, err := books.Search(0, i); err != nil || len(rows) != 1 {
+			t.Errorf("Wrong rows of book %d, %v %v", i, rows, err)
+		}
+	}
+	ctx.EndUseDatabase()
+	//Versions newer than this code are refused
+	page = newDbMetaPage(pager.PGSIZE)
+	page.FormatVersion = FORMAT_VERSION + 1
+	wt.StartTransaction(":memory:test_db_upgrade.gsdl")
+	wt.WritePage(0, page.toPageData(pager.PGSIZE))
+	wt.EndTransaction()
+	if _, err := StartUseDatabase(":memory:test_db_upgrade", nil); err == nil {
+		t.Error("Database of a newer version used")
+	}
+	if err := UpgradeDatabase(":memory:test_db_upgrade", nil); err == nil {
+		t.Error("Database of a newer version upgraded")
+	}
+}
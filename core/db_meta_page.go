@@ -3,32 +3,91 @@ package core
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 
 	utils "github.com/gjc13/gsdl/utils"
 )
 
+// Version of the file format, databases of older versions are migrated by UpgradeDatabase
+const FORMAT_VERSION uint32 = 1
+
+// Version of this code, kept in the header of the databases it creates
+const TOOL_VERSION uint32 = 1
+
+// Features a database may use, a database with a feature not known here cannot be used
+const (
+	FEATURE_COMPRESSED uint32 = 1 << iota
+	FEATURE_ENCRYPTED
+	FEATURE_VARCHAR
+)
+
+const knownFeatures uint32 = FEATURE_COMPRESSED | FEATURE_ENCRYPTED | FEATURE_VARCHAR
+
+var dbMagic = [16]byte{'g', 's', 'd', 'l', ' ', 'd', 'a', 't', 'a', 'b', 'a', 's', 'e'}
+
 type dbMetaPage struct {
+	Magic         [16]byte
+	FormatVersion uint32
+	//Version of the tool which created the database, zero for databases created before it was kept
+	ToolVersion uint32
+	Features    uint32
+	PageNumber  uint32
+	//Zero if there is no table
+	FirstTableMetaPageNumber uint32
+	PageSize                 uint32
+	CacheSize                uint32
+	//A pager.SYNCHRONOUS_ level, zero is full
+	Synchronous uint32
+	//No free map page before it has a free page, zero for the first free map page
+	FirstFreeMapPageNumber uint32
+}
+
+// Header of databases made before the format had a version, read as version 0
+// Its page number, always zero, is where the magic is now
+type legacyDbMetaPage struct {
 	PageNumber               uint32
 	FirstTableMetaPageNumber uint32
 }
 
-func (page *dbMetaPage) toPageData() []byte {
+func newDbMetaPage(pgSize uint32) *dbMetaPage {
+	return &dbMetaPage{
+		Magic:         dbMagic,
+		FormatVersion: FORMAT_VERSION,
+		ToolVersion:   TOOL_VERSION,
+		PageSize:      pgSize,
+	}
+}
+
+func (page *dbMetaPage) toPageData(pgSize uint32) []byte {
 	buf := new(bytes.Buffer)
 	if err := binary.Write(buf, binary.LittleEndian, page); err != nil {
 		panic("Failed to serialize Db meta page")
 	}
 	data := buf.Bytes()
-	return utils.PadToPage(data)
+	return utils.PadToPage(data, pgSize)
 }
 
-func dbMetaPageFromPageData(pgNumber uint32, data []byte) *dbMetaPage {
+// Headers without the magic are read as the legacy header, the version is left to the caller to check
+func dbMetaPageFromPageData(pgNumber uint32, data []byte) (*dbMetaPage, error) {
 	if pgNumber != 0 {
-		panic("Wrong db meta page number")
+		return nil, errors.New("Wrong db meta page number")
 	}
-	buf := bytes.NewBuffer(data)
 	var page dbMetaPage
-	if err := binary.Read(buf, binary.LittleEndian, &page); err != nil {
-		panic("Failed to deserialize Db meta page")
+	if err := binary.Read(bytes.NewBuffer(data), binary.LittleEndian, &page); err != nil {
+		return nil, errors.New("Failed to deserialize Db meta page")
+	}
+	if page.Magic == dbMagic {
+		return &page, nil
+	}
+	var legacy legacyDbMetaPage
+	if err := binary.Read(bytes.NewBuffer(data), binary.LittleEndian, &legacy); err != nil {
+		return nil, errors.New("Failed to deserialize Db meta page")
+	}
+	if legacy.PageNumber != 0 {
+		return nil, errors.New("Not a gsdl database")
 	}
-	return &page
+	return &dbMetaPage{
+		PageNumber:               legacy.PageNumber,
+		FirstTableMetaPageNumber: legacy.FirstTableMetaPageNumber,
+	}, nil
 }
@@ -1,23 +1,44 @@
 package core
 
 import (
+	"bytes"
+	"encoding/binary"
 	"testing"
 
 	pager "github.com/gjc13/gsdl/pager"
+	utils "github.com/gjc13/gsdl/utils"
 )
 
 func TestDbMetaToPageData(t *testing.T) {
-	page := &dbMetaPage{
-		FirstTableMetaPageNumber: 2,
-	}
-	data := page.toPageData()
+	page := newDbMetaPage(pager.PGSIZE)
+	page.FirstTableMetaPageNumber = 2
+	data := page.toPageData(pager.PGSIZE)
 	if len(data) != int(pager.PGSIZE) {
 		t.Error("Wrong page size")
 	}
 	cp_data := append([]byte(nil), data...)
-	cp_page := dbMetaPageFromPageData(0, cp_data)
+	cp_page, err := dbMetaPageFromPageData(0, cp_data)
+	if err != nil {
+		t.Errorf("Cannot recover page %v", err)
+	}
 	if cp_page.FirstTableMetaPageNumber != page.FirstTableMetaPageNumber {
 		t.Error("Wrong recovered page, origin %d, now %d",
 			page.FirstTableMetaPageNumber, cp_page.FirstTableMetaPageNumber)
 	}
 }
+
+func TestLegacyDbMetaPage(t *testing.T) {
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &legacyDbMetaPage{FirstTableMetaPageNumber: 2})
+	page, err := dbMetaPageFromPageData(0, utils.PadToPage(buf.Bytes(), pager.PGSIZE))
+	if err != nil {
+		t.Fatalf("Cannot read legacy page %v", err)
+	}
+	if page.FormatVersion != 0 || page.FirstTableMetaPageNumber != 2 {
+		t.Errorf("Wrong legacy page, version %d first table %d", page.FormatVersion, page.FirstTableMetaPageNumber)
+	}
+	binary.LittleEndian.PutUint32(buf.Bytes()[0:4], 7)
+	if _, err := dbMetaPageFromPageData(0, utils.PadToPage(buf.Bytes(), pager.PGSIZE)); err == nil {
+		t.Error("Page of another file read as legacy page")
+	}
+}
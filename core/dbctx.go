@@ -5,6 +5,21 @@ import (
 )
 
 type DbContext struct {
+	filename    string
 	transaction pager.Transactioner
 	metaPage    *dbMetaPage
+	//Alias of an attached database, its tables are named schema.table
+	schema string
+	//Databases attached to the session, committed together with this one
+	attached []*DbContext
+	//Savepoints of the session, newest last, set again in databases attached later
+	savepoints []string
+	//Free pages of the free map pages read by the allocator, dropped when the free maps are rolled back or rebuilt
+	freeCounts map[uint32]int
+	//Lock owner of the session, shared by the databases attached to it so their waits for each other are seen
+	owner int64
+}
+
+func (ctx *DbContext) pageSize() uint32 {
+	return ctx.transaction.(pager.TransactionReader).PageSize()
 }
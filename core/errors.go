@@ -1,6 +1,11 @@
 package core
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+
+	pager "github.com/gjc13/gsdl/pager"
+)
 
 var (
 	// errors
@@ -12,4 +17,21 @@ var (
 	ERR_SEARCH_UNDERFLOWED = errors.New("search underflowed")
 	ERR_END_ITER           = errors.New("End of iter")
 	ERR_NIL                = errors.New("Filed cannot be nil")
+	ERR_SCHEMA             = errors.New("bad database alias")
+	ERR_WAL_ATTACH         = errors.New("cannot attach databases in wal mode")
+	ERR_ROW_SIZE           = errors.New("rows too long for a page")
 )
+
+// The file is not a database or has a format this code cannot use
+type FormatError struct {
+	filename string
+	msg      string
+}
+
+func (err *FormatError) Error() string {
+	return fmt.Sprintf("%s: %s", err.filename, err.msg)
+}
+
+func makeCorruptionError(ctx *DbContext, pgNumber uint32, err error) error {
+	return pager.MakeCorruptionError(ctx.filename, pgNumber, err.Error())
+}
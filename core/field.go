@@ -50,10 +50,8 @@ func (meta *FieldMeta) cmpField(lhs interface{}, rhs interface{}) bool {
 	case FLOAT_TYPE:
 		l, r := toFloat64(lhs), toFloat64(rhs)
 		return l < r
-	case FIX_CHAR_TYPE:
+	case FIX_CHAR_TYPE, VAR_CHAR_TYPE:
 		return cmpFixChar(meta.FieldWidth, lhs, rhs)
-	case VAR_CHAR_TYPE:
-		panic("Varchar not supported now")
 	default:
 		panic("Unkown field type")
 	}
@@ -71,7 +69,7 @@ func (meta *FieldMeta) hash(v interface{}) int64 {
 	switch meta.DataType {
 	case INT_TYPE:
 		return toInt64(v)
-	case FIX_CHAR_TYPE:
+	case FIX_CHAR_TYPE, VAR_CHAR_TYPE:
 		return utils.HashString(v.(string))
 	default:
 		panic("Field cannot be hashed")
@@ -5,17 +5,51 @@ import (
 	"encoding/binary"
 	"errors"
 
-	pager "github.com/gjc13/gsdl/pager"
 	utils "github.com/gjc13/gsdl/utils"
 )
 
+// Data page of a table, the rows are in the order of the cluster key
+// Rows of tables without varchar fields have one size and follow the header
+// Other tables have slotted pages, see var_data_page.go
 type fixDataPage struct {
 	pgNumber     uint32
 	nextPgNumber uint32
 	prevPgNumber uint32
 	numRows      uint32
+	pgSize       uint32
 	meta         *RowMeta
-	data         []byte
+	//The rows of fixed size, the whole page for slotted pages
+	data  []byte
+	slots []varSlot
+}
+
+const dataPageHeaderSize int = 12
+
+// Each page takes at least two rows, so a full page is split into two pages with rows
+func maxRowSizeOf(pgSize uint32) int {
+	return (int(pgSize)-dataPageHeaderSize)/2 - varSlotSize
+}
+
+// An empty data page, rows are given to it by insertRow
+func makeDataPage(pgNumber uint32, pgSize uint32, meta *RowMeta) *fixDataPage {
+	page := &fixDataPage{
+		pgNumber: pgNumber,
+		pgSize:   pgSize,
+		meta:     meta,
+		data:     make([]byte, 0),
+	}
+	if meta.varLen() {
+		page.data = make([]byte, pgSize)
+		page.slots = make([]varSlot, 0)
+	}
+	return page
+}
+
+func dataPageType(meta *RowMeta) uint8 {
+	if meta.varLen() {
+		return VARLEN_DATA_PAGE
+	}
+	return FIX_DATA_PAGE
 }
 
 func (page *fixDataPage) firstNonNullKeyField() interface{} {
@@ -44,6 +78,9 @@ func (page *fixDataPage) isEmpty() bool {
 }
 
 func (page *fixDataPage) toPageData() []byte {
+	if page.meta.varLen() {
+		return page.toVarPageData()
+	}
 	buf := new(bytes.Buffer)
 	if err1 := binary.Write(buf, binary.LittleEndian, page.nextPgNumber); err1 != nil {
 		panic("Failed to serialize fix data page")
@@ -54,7 +91,7 @@ func (page *fixDataPage) toPageData() []byte {
 	if err3 := binary.Write(buf, binary.LittleEndian, page.numRows); err3 != nil {
 		panic("Failed to serialize fix data page")
 	}
-	return utils.PadToPage(append(buf.Bytes(), page.data...))
+	return utils.PadToPage(append(buf.Bytes(), page.data...), page.pgSize)
 }
 
 func (page *fixDataPage) searchKey(key interface{}) int {
@@ -89,29 +126,52 @@ func (page *fixDataPage) getRows(key interface{}) [][]interface{} {
 	return rows
 }
 
-func (page *fixDataPage) canInsert() bool {
+func (page *fixDataPage) canInsert(row []interface{}) bool {
+	if page.meta.varLen() {
+		return page.canInsertVar(len(dumpRow(page.meta, row)))
+	}
 	rowSize := page.meta.size()
 	headerSize := binary.Size(page.nextPgNumber) + binary.Size(page.prevPgNumber) + binary.Size(page.numRows)
-	return headerSize+rowSize*(int(page.numRows)+1) <= int(pager.PGSIZE)
+	return headerSize+rowSize*(int(page.numRows)+1) <= int(page.pgSize)
 }
 
 func (page *fixDataPage) insertRow(row []interface{}) error {
-	if !page.canInsert() {
+	if !page.canInsert(row) {
 		return errors.New("Cannot insert since page size limit")
 	}
 	fieldId := int(page.meta.ClusterFieldId)
+	page.insertRowData(page.searchKey(row[fieldId]), dumpRow(page.meta, row))
+	return nil
+}
+
+// Put the dumped row at i, there must be room for it
+func (page *fixDataPage) insertRowData(i int, rowData []byte) {
+	if page.meta.varLen() {
+		page.insertVarRowData(i, rowData)
+		return
+	}
 	rowSize := page.meta.size()
-	i := page.searchKey(row[fieldId])
 	page.data = append(page.data[0:i*rowSize],
-		append(dumpRow(page.meta, row),
-			page.data[i*rowSize:]...)...)
+		append(rowData, page.data[i*rowSize:]...)...)
 	page.numRows++
-	return nil
+}
+
+// Remove the rows from i up to j
+func (page *fixDataPage) removeRows(i int, j int) {
+	if i == j {
+		return
+	}
+	if page.meta.varLen() {
+		page.slots = append(page.slots[:i], page.slots[j:]...)
+	} else {
+		rowSize := page.meta.size()
+		page.data = append(page.data[:i*rowSize], page.data[j*rowSize:]...)
+	}
+	page.numRows -= uint32(j - i)
 }
 
 func (page *fixDataPage) deleteRow(key interface{}) {
 	fieldId := int(page.meta.ClusterFieldId)
-	rowSize := page.meta.size()
 	fmeta := page.meta.FieldMetas[fieldId]
 	i0 := page.searchKey(key)
 	i := i0
@@ -121,39 +181,33 @@ func (page *fixDataPage) deleteRow(key interface{}) {
 			break
 		}
 	}
-	if i == int(page.numRows) {
-		page.data = page.data[:i0*rowSize]
-		page.numRows = uint32(i0)
-	} else if i != i0 {
-		page.data = append(page.data[:i0*rowSize], page.data[i*rowSize:]...)
-		page.numRows -= uint32((i - i0))
-	}
+	page.removeRows(i0, i)
 }
 
 func (page *fixDataPage) deleteWithFields(key interface{}, values []FieldValue) {
 	fieldId := int(page.meta.ClusterFieldId)
-	rowSize := page.meta.size()
-	i0 := page.searchKey(key)
-	i := i0
-	newData := page.data[:i0*rowSize]
 	fmeta := page.meta.FieldMetas[fieldId]
-	nDelete := 0
-	for ; i < int(page.numRows); i++ {
-		rowData := page.getRowDataAt(i)
-		row := parseRow(page.meta, rowData)
+	i := page.searchKey(key)
+	for i < int(page.numRows) {
+		row := parseRow(page.meta, page.getRowDataAt(i))
 		rowKey := row[fieldId]
 		if fmeta.cmpField(rowKey, key) || fmeta.cmpField(key, rowKey) {
-			newData = append(newData, page.data[i*rowSize:]...)
 			break
 		}
-		if !page.meta.checkRowSame(row, values) {
-			newData = append(newData, rowData...)
+		if page.meta.checkRowSame(row, values) {
+			page.removeRows(i, i+1)
 		} else {
-			nDelete++
+			i++
 		}
 	}
-	page.numRows -= uint32(nDelete)
-	page.data = newData
+}
+
+// Move the rows from i on to the end of another page with room for them
+func (page *fixDataPage) moveRowsTo(i int, other *fixDataPage) {
+	for j := i; j < int(page.numRows); j++ {
+		other.insertRowData(int(other.numRows), page.getRowDataAt(j))
+	}
+	page.removeRows(i, int(page.numRows))
 }
 
 func (page *fixDataPage) getRowAt(i int) []interface{} {
@@ -167,32 +221,44 @@ func (page *fixDataPage) getRowDataAt(i int) []byte {
 	if i >= int(page.numRows) {
 		return nil
 	}
+	if page.meta.varLen() {
+		slot := page.slots[i]
+		return page.data[slot.offset : int(slot.offset)+int(slot.length)]
+	}
 	rowSize := page.meta.size()
 	return page.data[rowSize*i : rowSize*(i+1)]
 }
 
-func fixDataPageFromData(pgNumber uint32, meta *RowMeta, data []byte) *fixDataPage {
+func fixDataPageFromData(pgNumber uint32, meta *RowMeta, data []byte) (*fixDataPage, error) {
 	buf := bytes.NewBuffer(data)
 	var nextPgNumber uint32
 	var prevPgNumber uint32
 	var numRows uint32
 	if err1 := binary.Read(buf, binary.LittleEndian, &nextPgNumber); err1 != nil {
-		panic("Failed to deserialize fix data page")
+		return nil, errors.New("Failed to deserialize fix data page")
 	}
 	if err2 := binary.Read(buf, binary.LittleEndian, &prevPgNumber); err2 != nil {
-		panic("Failed to deserialize fix data page")
+		return nil, errors.New("Failed to deserialize fix data page")
 	}
 	if err3 := binary.Read(buf, binary.LittleEndian, &numRows); err3 != nil {
-		panic("Failed to deserialize fix data page")
+		return nil, errors.New("Failed to deserialize fix data page")
 	}
 	page := &fixDataPage{
 		pgNumber:     pgNumber,
 		nextPgNumber: nextPgNumber,
 		prevPgNumber: prevPgNumber,
 		numRows:      numRows,
+		pgSize:       uint32(len(data)),
 		meta:         meta,
 		data:         data[binary.Size(nextPgNumber)+binary.Size(prevPgNumber)+binary.Size(numRows):],
 	}
+	if meta.varLen() {
+		page.data = data
+		return page, page.readSlots()
+	}
+	if uint64(page.meta.size())*uint64(page.numRows) > uint64(len(page.data)) {
+		return nil, errors.New("Wrong number of rows in fix data page")
+	}
 	page.data = page.data[:page.meta.size()*int(page.numRows)]
-	return page
+	return page, nil
 }
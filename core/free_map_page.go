@@ -1,7 +1,6 @@
 package core
 
 import (
-	pager "github.com/gjc13/gsdl/pager"
 	page_map "github.com/gjc13/gsdl/utils/page_map"
 )
 
@@ -17,6 +16,6 @@ func (page *freeMapPage) toPageData() []byte {
 func freeMapPageFromPageData(pgNumber uint32, data []byte) *freeMapPage {
 	return &freeMapPage{
 		pgNumber,
-		page_map.Deserialize(pgNumber, int(pager.PGSIZE)*8, data),
+		page_map.Deserialize(pgNumber, len(data)*8, data),
 	}
 }
@@ -6,7 +6,10 @@ import (
 	"github.com/gjc13/gsdl/pager"
 )
 
-const maxDegree = 320
+// Entries of an index page take 12 bytes, keep room for the page header and the entry added before a split
+func maxDegreeOf(pgSize uint32) int {
+	return int(pgSize / 64 * 5)
+}
 
 type Bptree struct {
 	ctx          *DbContext
@@ -24,7 +27,12 @@ func (tree *Bptree) loadIndexPage(pgNumber uint32) (*indexPage, error) {
 		rt.AbortTransaction()
 		return nil, err
 	}
-	return indexPageFromData(pgNumber, data), nil
+	page, err1 := indexPageFromData(pgNumber, data)
+	if err1 != nil {
+		rt.AbortTransaction()
+		return nil, makeCorruptionError(tree.ctx, pgNumber, err1)
+	}
+	return page, nil
 }
 
 func (tree *Bptree) saveIndexPage(page *indexPage) error {
@@ -32,7 +40,11 @@ func (tree *Bptree) saveIndexPage(page *indexPage) error {
 	if !ok {
 		panic("not write transaction when saving")
 	}
-	return wt.WritePage(page.PgNumber, page.toPageData())
+	return wt.WritePage(page.PgNumber, page.toPageData(tree.ctx.pageSize()))
+}
+
+func (tree *Bptree) maxDegree() int {
+	return maxDegreeOf(tree.ctx.pageSize())
 }
 
 func createTree(ctx *DbContext) (*Bptree, error) {
@@ -57,6 +69,29 @@ func createTree(ctx *DbContext) (*Bptree, error) {
 	return tree, nil
 }
 
+// Free all the pages of the tree, the tree must not be used again
+func (tree *Bptree) freePages() error {
+	stack := []uint32{tree.rootPgNumber}
+	for len(stack) > 0 {
+		pgNumber := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		page, err := tree.loadIndexPage(pgNumber)
+		if err != nil {
+			return err
+		}
+		if page.isInternal() {
+			for _, elem := range page.Children {
+				stack = append(stack, elem.PgNumber)
+			}
+		}
+		if err1 := freePage(tree.ctx, pgNumber); err1 != nil {
+			return err1
+		}
+	}
+	tree.rootPgNumber = 0
+	return nil
+}
+
 func (tree *Bptree) Insert(elem Elem) error {
 	// create root node if it is not exist
 	if tree.rootPgNumber == 0 {
@@ -85,7 +120,7 @@ func (tree *Bptree) Insert(elem Elem) error {
 	// insert element into last index node
 	lastPath := paths[len(paths)-1]
 
-	err = lastPath.insertElem(elem, maxDegree, false)
+	err = lastPath.insertElem(elem, tree.maxDegree(), false)
 	if err != nil {
 		return err
 	}
@@ -106,7 +141,7 @@ func (tree *Bptree) Insert(elem Elem) error {
 	for i := len(paths) - 1; i >= 0; i-- {
 		path := paths[i]
 
-		if len(path.Children) > maxDegree {
+		if len(path.Children) > tree.maxDegree() {
 			err = tree.balance(paths[:i+1])
 			if err != nil {
 				return err
@@ -129,11 +164,11 @@ func (tree *Bptree) Remove(key Key) error {
 	// if only root
 	if lenPaths == 1 {
 		root := paths[0]
-		root.deleteElem(key, maxDegree)
+		root.deleteElem(key, tree.maxDegree())
 		return tree.saveIndexPage(root)
 	}
 
-	allowedDegree := maxDegree / 2
+	allowedDegree := tree.maxDegree() / 2
 	var curr *indexPage
 
 	// do balancing if index node has children less than tree.maxDegree / 2
@@ -165,7 +200,7 @@ func (tree *Bptree) Remove(key Key) error {
 
 		if i == lenPaths-1 { // at first loop (last node in paths)
 			// delete the element at belong node
-			curr.deleteElem(key, maxDegree)
+			curr.deleteElem(key, tree.maxDegree())
 			err = tree.saveIndexPage(curr)
 			if err != nil {
 				return nil
@@ -320,7 +355,7 @@ func (tree *Bptree) balance(paths []*indexPage) error {
 			NextPgNumber: 0,
 		}
 		rootPage.Internal = 1
-		rootPage.Children = make([]Elem, 0, maxDegree+1)
+		rootPage.Children = make([]Elem, 0, tree.maxDegree()+1)
 		rootPage.insertElem(Elem{newPage.Key(), newPage.PgNumber}, 0, false)
 
 		parent, curr = rootPage, newPage
@@ -339,7 +374,7 @@ func (tree *Bptree) balance(paths []*indexPage) error {
 	}
 	next = &indexPage{
 		PgNumber:     nextPgNumber,
-		Children:     make([]Elem, len(currChildren)-mid, maxDegree+1),
+		Children:     make([]Elem, len(currChildren)-mid, tree.maxDegree()+1),
 		Internal:     curr.Internal,
 		NextPgNumber: curr.NextPgNumber,
 		PrevPgNumber: curr.PgNumber,
@@ -361,7 +396,7 @@ func (tree *Bptree) balance(paths []*indexPage) error {
 		}
 	}
 
-	err := parent.insertElem(Elem{next.Key(), next.PgNumber}, maxDegree, false)
+	err := parent.insertElem(Elem{next.Key(), next.PgNumber}, tree.maxDegree(), false)
 	if err != nil {
 		return err
 	}
@@ -437,7 +472,7 @@ func (tree *Bptree) redistribution(paths []*indexPage, allowedDegree int) (bool,
 		borrow := lNode.Children[lsChildrenLen-1]
 		lNode.Children = lNode.Children[:lsChildrenLen-1]
 
-		newChildren := make([]Elem, len(curr.Children)+1, maxDegree+1)
+		newChildren := make([]Elem, len(curr.Children)+1, tree.maxDegree()+1)
 		newChildren[0] = borrow
 		copy(newChildren[1:], curr.Children)
 
@@ -528,7 +563,7 @@ func (tree *Bptree) merge(paths []*indexPage) error {
 
 	if withLeft {
 		// merging with left sibling
-		if len(curr.Children)+len(lNode.Children) > maxDegree {
+		if len(curr.Children)+len(lNode.Children) > tree.maxDegree() {
 			panic("number of children must be after merging")
 		}
 
@@ -554,14 +589,14 @@ func (tree *Bptree) merge(paths []*indexPage) error {
 		if errl != nil {
 			return errl
 		}
-		parent.deleteElem(curr.Key(), maxDegree)
+		parent.deleteElem(curr.Key(), tree.maxDegree())
 		errl = tree.saveIndexPage(parent)
 		if errl != nil {
 			return errl
 		}
 	} else {
 		// merging with right sibling
-		if len(rNode.Children)+len(curr.Children) > maxDegree {
+		if len(rNode.Children)+len(curr.Children) > tree.maxDegree() {
 			panic("number of children must be after merging")
 		}
 
@@ -588,7 +623,7 @@ func (tree *Bptree) merge(paths []*indexPage) error {
 		if errr != nil {
 			return errr
 		}
-		parent.deleteElem(rNode.Key(), maxDegree)
+		parent.deleteElem(rNode.Key(), tree.maxDegree())
 		errr = tree.saveIndexPage(parent)
 		if errr != nil {
 			return errr
@@ -3,6 +3,7 @@ package core
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	utils "github.com/gjc13/gsdl/utils"
@@ -16,7 +17,7 @@ type indexPage struct {
 	Internal     uint8
 }
 
-func (page *indexPage) toPageData() []byte {
+func (page *indexPage) toPageData(pgSize uint32) []byte {
 	buf := new(bytes.Buffer)
 	var err error
 	var numChildren int32 = int32(len(page.Children))
@@ -40,7 +41,7 @@ func (page *indexPage) toPageData() []byte {
 	if err = binary.Write(buf, binary.LittleEndian, page.Internal); err != nil {
 		panic("Failed to serialize")
 	}
-	return utils.PadToPage(buf.Bytes())
+	return utils.PadToPage(buf.Bytes(), pgSize)
 }
 
 func (page *indexPage) isInternal() bool {
@@ -73,36 +74,39 @@ func (page *indexPage) deleteElem(key Key, maxDegree int) bool {
 	return true
 }
 
-func indexPageFromData(pgNumber uint32, data []byte) *indexPage {
+func indexPageFromData(pgNumber uint32, data []byte) (*indexPage, error) {
 	buf := bytes.NewBuffer(data)
 	var page indexPage
 	var numChildren int32
 	var err error
 	if err = binary.Read(buf, binary.LittleEndian, &numChildren); err != nil {
-		panic("Failed to deserialize index page")
+		return nil, errors.New("Failed to deserialize index page")
+	}
+	if numChildren < 0 || int(numChildren) > maxDegreeOf(uint32(len(data)))+1 {
+		return nil, errors.New("Wrong number of children in index page")
 	}
 	page.Children = make([]Elem, 0, numChildren)
 	for i := 0; i < int(numChildren); i++ {
 		var elem Elem
 		if err = binary.Read(buf, binary.LittleEndian, &elem.Key); err != nil {
-			panic("Failed to deserialize index page")
+			return nil, errors.New("Failed to deserialize index page")
 		}
 		if err = binary.Read(buf, binary.LittleEndian, &elem.PgNumber); err != nil {
-			panic("Failed to deserialize index page")
+			return nil, errors.New("Failed to deserialize index page")
 		}
 		page.Children = append(page.Children, elem)
 	}
 	if err = binary.Read(buf, binary.LittleEndian, &page.PrevPgNumber); err != nil {
-		panic("Failed to deserialize index page")
+		return nil, errors.New("Failed to deserialize index page")
 	}
 	if err = binary.Read(buf, binary.LittleEndian, &page.NextPgNumber); err != nil {
-		panic("Failed to deserialize index page")
+		return nil, errors.New("Failed to deserialize index page")
 	}
 	if err = binary.Read(buf, binary.LittleEndian, &page.Internal); err != nil {
-		panic("Failed to deserialize index page")
+		return nil, errors.New("Failed to deserialize index page")
 	}
 	page.PgNumber = pgNumber
-	return &page
+	return &page, nil
 }
 
 func (page *indexPage) String() string {
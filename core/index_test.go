@@ -13,7 +13,8 @@ var index_test_ctx *DbContext = &DbContext{
 }
 
 func TestNewTree(t *testing.T) {
-	index_test_wt.StartTransaction("/tmp/index_test_1.gsdl")
+	pager.RemoveDatabase(":memory:index_test_1.gsdl")
+	index_test_wt.StartTransaction(":memory:index_test_1.gsdl")
 	index_test_wt.WritePage(0, make([]byte, 4096))
 	index_test_wt.Sync()
 	tree, _ := createTree(index_test_ctx)
@@ -25,7 +26,7 @@ func TestNewTree(t *testing.T) {
 }
 
 func TestTreeInsertFind(t *testing.T) {
-	index_test_wt.StartTransaction("/tmp/index_test_2.gsdl")
+	index_test_wt.StartTransaction(":memory:index_test_2.gsdl")
 	index_test_wt.WritePage(0, make([]byte, 4096))
 	index_test_wt.Sync()
 	tree, _ := createTree(index_test_ctx)
@@ -43,7 +44,7 @@ func TestTreeInsertFind(t *testing.T) {
 }
 
 func TestTreeInsertDeleteFind(t *testing.T) {
-	index_test_wt.StartTransaction("/tmp/index_test_3.gsdl")
+	index_test_wt.StartTransaction(":memory:index_test_3.gsdl")
 	index_test_wt.WritePage(0, make([]byte, 4096))
 	index_test_wt.Sync()
 	tree, _ := createTree(index_test_ctx)
@@ -81,14 +82,24 @@ func TestTreeInsertDeleteFind(t *testing.T) {
 }
 
 func TestTreeBalance(t *testing.T) {
-	index_test_wt.StartTransaction("/tmp/index_test_4.gsdl")
+	testTreeBalance(t, ":memory:index_test_4.gsdl")
+}
+
+func TestTreeBalanceOnFile(t *testing.T) {
+	removeTestDatabase("/tmp/index_test_4")
+	defer removeTestDatabase("/tmp/index_test_4")
+	testTreeBalance(t, "/tmp/index_test_4.gsdl")
+}
+
+func testTreeBalance(t *testing.T, filename string) {
+	index_test_wt.StartTransaction(filename)
 	index_test_wt.WritePage(0, make([]byte, 4096))
 	index_test_wt.Sync()
 	tree, _ := createTree(index_test_ctx)
-	for i := 0; i < maxDegree+2; i++ {
+	for i := 0; i < maxDegreeOf(pager.PGSIZE)+2; i++ {
 		tree.Insert(Elem{Key(i * 10), uint32(i + 2)})
 	}
-	for i := 0; i < maxDegree+2; i++ {
+	for i := 0; i < maxDegreeOf(pager.PGSIZE)+2; i++ {
 		expectFound(tree, Key(i*10), uint32(i+2), t)
 		expectFound(tree, Key(i*10+1), uint32(i+2), t)
 	}
@@ -96,17 +107,17 @@ func TestTreeBalance(t *testing.T) {
 }
 
 func TestTreeLMerge(t *testing.T) {
-	index_test_wt.StartTransaction("/tmp/index_test_5.gsdl")
+	index_test_wt.StartTransaction(":memory:index_test_5.gsdl")
 	index_test_wt.WritePage(0, make([]byte, 4096))
 	index_test_wt.Sync()
 	tree, _ := createTree(index_test_ctx)
-	for i := 0; i < maxDegree+3; i++ {
+	for i := 0; i < maxDegreeOf(pager.PGSIZE)+3; i++ {
 		tree.Insert(Elem{Key(i * 10), uint32(i + 2)})
 	}
 	for i := 0; i < 10; i++ {
 		tree.Remove(Key(i * 10))
 	}
-	for i := 10; i < maxDegree+3; i++ {
+	for i := 10; i < maxDegreeOf(pager.PGSIZE)+3; i++ {
 		expectFound(tree, Key(i*10), uint32(i+2), t)
 		expectFound(tree, Key(i*10+1), uint32(i+2), t)
 	}
@@ -114,15 +125,15 @@ func TestTreeLMerge(t *testing.T) {
 }
 
 func TestTreeRMerge(t *testing.T) {
-	index_test_wt.StartTransaction("/tmp/index_test_7.gsdl")
+	index_test_wt.StartTransaction(":memory:index_test_7.gsdl")
 	index_test_wt.WritePage(0, make([]byte, 4096))
 	index_test_wt.Sync()
 	tree, _ := createTree(index_test_ctx)
-	for i := maxDegree + 2; i >= 0; i-- {
+	for i := maxDegreeOf(pager.PGSIZE) + 2; i >= 0; i-- {
 		tree.Insert(Elem{Key(i * 10), uint32(i + 2)})
 	}
 	for i := 0; i < 10; i++ {
-		tree.Remove(Key((maxDegree + 2 - i) * 10))
+		tree.Remove(Key((maxDegreeOf(pager.PGSIZE) + 2 - i) * 10))
 	}
 	for i := 0; i < 1; i++ {
 		expectFound(tree, Key(i*10), uint32(i+2), t)
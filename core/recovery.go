@@ -0,0 +1,73 @@
+package core
+
+import (
+	"fmt"
+
+	pager "github.com/gjc13/gsdl/pager"
+)
+
+func isFreeMapPage(pgNumber uint32, pgSize uint32) bool {
+	return pgNumber != 0 && freeMapPgNumberOf(pgNumber, pgSize) == pgNumber
+}
+
+// Check the header and the table meta chain of a database which may have been left by a crash
+// Broken pages are reported as a recovery error or a corruption error instead of failing in later use
+func checkDatabase(ctx *DbContext, data []byte) error {
+	if len(data) != int(ctx.pageSize()) {
+		return pager.MakeRecoveryError(ctx.filename, "wrong header page size")
+	}
+	metaPage, err := dbMetaPageFromPageData(0, data)
+	if err != nil {
+		return &FormatError{ctx.filename, err.Error()}
+	}
+	if err := checkFormat(ctx.filename, metaPage); err != nil {
+		return err
+	}
+	ctx.metaPage = metaPage
+	if ctx.metaPage.PageNumber != 0 {
+		return pager.MakeRecoveryError(ctx.filename, fmt.Sprintf("wrong header page number %d", ctx.metaPage.PageNumber))
+	}
+	if ctx.metaPage.PageSize != 0 && ctx.metaPage.PageSize != ctx.pageSize() {
+		return pager.MakeRecoveryError(ctx.filename, fmt.Sprintf("wrong page size %d in header", ctx.metaPage.PageSize))
+	}
+	numPages, err1 := ctx.transaction.(*pager.WriteTransaction).NumPages()
+	if err1 != nil {
+		return err1
+	}
+	isPgNumberLegal := func(pgNumber uint32) bool {
+		return pgNumber != 0 && pgNumber < numPages && !isFreeMapPage(pgNumber, ctx.pageSize())
+	}
+	visited := map[uint32]bool{}
+	for pgNumber := ctx.metaPage.FirstTableMetaPageNumber; pgNumber != 0; {
+		if !isPgNumberLegal(pgNumber) || visited[pgNumber] {
+			return pager.MakeRecoveryError(ctx.filename, fmt.Sprintf("wrong table meta page %d", pgNumber))
+		}
+		visited[pgNumber] = true
+		metaPage, err2 := loadTableMetaPage(ctx, pgNumber)
+		if err2 != nil {
+			return err2
+		}
+		if int(metaPage.RowInfo.ClusterFieldId) >= len(metaPage.FieldIndexPgNumbers) {
+			return pager.MakeRecoveryError(ctx.filename, fmt.Sprintf("wrong cluster field of table %s", metaPage.TableName))
+		}
+		if metaPage.FirstDataPgNumber != 0 && !isPgNumberLegal(metaPage.FirstDataPgNumber) {
+			return pager.MakeRecoveryError(ctx.filename,
+				fmt.Sprintf("wrong first data page %d of table %s", metaPage.FirstDataPgNumber, metaPage.TableName))
+		}
+		for _, indexPgNumber := range metaPage.FieldIndexPgNumbers {
+			if indexPgNumber != 0 && !isPgNumberLegal(indexPgNumber) {
+				return pager.MakeRecoveryError(ctx.filename,
+					fmt.Sprintf("wrong index page %d of table %s", indexPgNumber, metaPage.TableName))
+			}
+		}
+		tree := &Bptree{
+			ctx:          ctx,
+			rootPgNumber: metaPage.FieldIndexPgNumbers[metaPage.RowInfo.ClusterFieldId],
+		}
+		if _, err3 := tree.loadIndexPage(tree.rootPgNumber); err3 != nil {
+			return err3
+		}
+		pgNumber = metaPage.NextTableMetaPgNumber
+	}
+	return nil
+}
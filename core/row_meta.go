@@ -13,6 +13,8 @@ func (meta *RowMeta) checkRowSame(row []interface{}, values []FieldValue) bool {
 	}
 	return true
 }
+
+// Size of the rows of a table without varchar fields
 func (meta *RowMeta) size() int {
 	size := meta.nullMapSize()
 	for _, v := range meta.FieldMetas {
@@ -24,3 +26,24 @@ func (meta *RowMeta) size() int {
 func (meta *RowMeta) nullMapSize() int {
 	return (len(meta.FieldMetas) + 7) / 8
 }
+
+// Rows with varchar fields have variable size and are kept in slotted pages
+func (meta *RowMeta) varLen() bool {
+	for _, v := range meta.FieldMetas {
+		if v.DataType == VAR_CHAR_TYPE {
+			return true
+		}
+	}
+	return false
+}
+
+// Size of the longest row, varchar fields take their length too
+func (meta *RowMeta) maxSize() int {
+	size := meta.size()
+	for _, v := range meta.FieldMetas {
+		if v.DataType == VAR_CHAR_TYPE {
+			size += 2
+		}
+	}
+	return size
+}
@@ -11,7 +11,7 @@ func saveTableMetaPage(ctx *DbContext, page *tableMetaPage) error {
 	if !ok {
 		panic("Cannot write when saving fix data page")
 	}
-	return wt.WritePage(page.PgNumber, page.toPageData())
+	return wt.WritePage(page.PgNumber, page.toPageData(ctx.pageSize()))
 }
 
 func loadTableMetaPage(ctx *DbContext, pgNumber uint32) (*tableMetaPage, error) {
@@ -21,7 +21,12 @@ func loadTableMetaPage(ctx *DbContext, pgNumber uint32) (*tableMetaPage, error)
 		rt.AbortTransaction()
 		return nil, err
 	}
-	return tableMetaPageFromData(pgNumber, data), nil
+	page, err1 := tableMetaPageFromData(pgNumber, data)
+	if err1 != nil {
+		rt.AbortTransaction()
+		return nil, makeCorruptionError(ctx, pgNumber, err1)
+	}
+	return page, nil
 }
 
 func createTable(ctx *DbContext, name string, columnNames []string, meta *RowMeta) (uint32, error) {
@@ -49,6 +54,47 @@ func createTable(ctx *DbContext, name string, columnNames []string, meta *RowMet
 	return page.PgNumber, nil
 }
 
+// Free the pages of a table and its secondary index tables, the meta page must be unlinked before
+func freeTablePages(ctx *DbContext, page *tableMetaPage) error {
+	view := &TableView{ctx: ctx, metaPage: page}
+	for pgNumber := page.FirstDataPgNumber; pgNumber != 0; {
+		dataPage, err1 := view.loadFixDataPage(pgNumber)
+		if err1 != nil {
+			return err1
+		}
+		if err2 := freePage(ctx, pgNumber); err2 != nil {
+			return err2
+		}
+		pgNumber = dataPage.nextPgNumber
+	}
+	//Pages of the extent not taken by data pages yet
+	for pgNumber := page.ExtentNext; pgNumber < page.ExtentEnd; pgNumber++ {
+		if err3 := freePage(ctx, pgNumber); err3 != nil {
+			return err3
+		}
+	}
+	for i, indexPgNumber := range page.FieldIndexPgNumbers {
+		if indexPgNumber == 0 {
+			continue
+		}
+		if i == int(page.RowInfo.ClusterFieldId) {
+			tree := &Bptree{ctx: ctx, rootPgNumber: indexPgNumber}
+			if err4 := tree.freePages(); err4 != nil {
+				return err4
+			}
+			continue
+		}
+		indexPage, err5 := loadTableMetaPage(ctx, indexPgNumber)
+		if err5 != nil {
+			return err5
+		}
+		if err6 := freeTablePages(ctx, indexPage); err6 != nil {
+			return err6
+		}
+	}
+	return freePage(ctx, page.PgNumber)
+}
+
 func createTableWithoutSecondIndex(ctx *DbContext, name string, columnNames []string, meta *RowMeta) (*tableMetaPage, error) {
 	pgNumber, err1 := allocPage(ctx)
 	if err1 != nil {
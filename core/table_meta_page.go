@@ -3,6 +3,7 @@ package core
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 
 	utils "github.com/gjc13/gsdl/utils"
 )
@@ -16,13 +17,17 @@ type tableMetaPage struct {
 	FieldIndexPgNumbers   []uint32
 	NextTableMetaPgNumber uint32
 	Dropped               uint8
+	//Pages of the extent reserved for data pages not used yet, from ExtentNext up to ExtentEnd
+	//Zero in tables created before extents
+	ExtentNext uint32
+	ExtentEnd  uint32
 }
 
 func (page *tableMetaPage) dropped() bool {
 	return page.Dropped > 0
 }
 
-func (page *tableMetaPage) toPageData() []byte {
+func (page *tableMetaPage) toPageData(pgSize uint32) []byte {
 	buf := new(bytes.Buffer)
 	var err error
 	if err = binary.Write(buf, binary.LittleEndian, int32(len(page.FieldIndexPgNumbers))); err != nil {
@@ -58,16 +63,22 @@ func (page *tableMetaPage) toPageData() []byte {
 	if err = binary.Write(buf, binary.LittleEndian, page.Dropped); err != nil {
 		panic("Failed to serialize")
 	}
+	if err = binary.Write(buf, binary.LittleEndian, []uint32{page.ExtentNext, page.ExtentEnd}); err != nil {
+		panic("Failed to serialize")
+	}
 	data := buf.Bytes()
-	return utils.PadToPage(data)
+	return utils.PadToPage(data, pgSize)
 }
 
-func tableMetaPageFromData(pgNumber uint32, data []byte) *tableMetaPage {
+func tableMetaPageFromData(pgNumber uint32, data []byte) (*tableMetaPage, error) {
 	buf := bytes.NewBuffer(data)
 	var numRows int32
 	var err error
 	if err = binary.Read(buf, binary.LittleEndian, &numRows); err != nil {
-		panic("Failed to deserialize table meta page")
+		return nil, errors.New("Failed to deserialize table meta page")
+	}
+	if numRows < 0 || int(numRows) > len(data) {
+		return nil, errors.New("Wrong number of fields in table meta page")
 	}
 	page := tableMetaPage{
 		PgNumber: pgNumber,
@@ -78,41 +89,53 @@ func tableMetaPageFromData(pgNumber uint32, data []byte) *tableMetaPage {
 		FieldIndexPgNumbers: make([]uint32, 0, numRows),
 	}
 	if page.TableName, err = buf.ReadString(0); err != nil {
-		panic("Failed to deserialize table meta page")
+		return nil, errors.New("Failed to deserialize table meta page")
 	}
 	page.TableName = utils.ShrinkString(page.TableName)
 	for i := 0; i < int(numRows); i++ {
 		var name string
 		if name, err = buf.ReadString(0); err != nil {
-			panic("Failed to deserialize table meta page")
+			return nil, errors.New("Failed to deserialize table meta page")
 		}
 		page.ColumnNames = append(page.ColumnNames, utils.ShrinkString(name))
 	}
 	if err = binary.Read(buf, binary.LittleEndian, &page.RowInfo.ClusterFieldId); err != nil {
-		panic("Failed to deserialize table meta page")
+		return nil, errors.New("Failed to deserialize table meta page")
+	}
+	if page.RowInfo.ClusterFieldId >= uint32(numRows) {
+		return nil, errors.New("Wrong cluster field in table meta page")
 	}
 	for i := 0; i < int(numRows); i++ {
 		var m FieldMeta
 		if err = binary.Read(buf, binary.LittleEndian, &m); err != nil {
-			panic("Failed to deserialize table meta page")
+			return nil, errors.New("Failed to deserialize table meta page")
 		}
 		page.RowInfo.FieldMetas = append(page.RowInfo.FieldMetas, m)
 	}
 	if err = binary.Read(buf, binary.LittleEndian, &page.FirstDataPgNumber); err != nil {
-		panic("Failed to deserialize table meta page")
+		return nil, errors.New("Failed to deserialize table meta page")
 	}
 	for i := 0; i < int(numRows); i++ {
 		var n uint32
 		if err = binary.Read(buf, binary.LittleEndian, &n); err != nil {
-			panic("Failed to deserialize table meta page")
+			return nil, errors.New("Failed to deserialize table meta page")
 		}
 		page.FieldIndexPgNumbers = append(page.FieldIndexPgNumbers, n)
 	}
 	if err = binary.Read(buf, binary.LittleEndian, &page.NextTableMetaPgNumber); err != nil {
-		panic("Failed to deserialize table meta page")
+		return nil, errors.New("Failed to deserialize table meta page")
 	}
 	if err = binary.Read(buf, binary.LittleEndian, &page.Dropped); err != nil {
-		panic("Failed to deserialize table meta page")
+		return nil, errors.New("Failed to deserialize table meta page")
+	}
+	if err = binary.Read(buf, binary.LittleEndian, &page.ExtentNext); err != nil {
+		return nil, errors.New("Failed to deserialize table meta page")
+	}
+	if err = binary.Read(buf, binary.LittleEndian, &page.ExtentEnd); err != nil {
+		return nil, errors.New("Failed to deserialize table meta page")
+	}
+	if page.ExtentNext > page.ExtentEnd {
+		return nil, errors.New("Wrong extent in table meta page")
 	}
-	return &page
+	return &page, nil
 }
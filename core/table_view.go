@@ -59,7 +59,11 @@ func (view *TableView) ClusterFieldId() int {
 func (view *TableView) ColumnNames() []string {
 	names := make([]string, 0, len(view.metaPage.ColumnNames))
 	for _, name := range view.metaPage.ColumnNames {
-		names = append(names, strings.Join([]string{view.metaPage.TableName, name}, "."))
+		if view.ctx.schema != "" {
+			names = append(names, strings.Join([]string{view.ctx.schema, view.metaPage.TableName, name}, "."))
+		} else {
+			names = append(names, strings.Join([]string{view.metaPage.TableName, name}, "."))
+		}
 	}
 	return names
 }
@@ -132,18 +136,11 @@ func (view *TableView) Insert(row []interface{}) error {
 
 func (view *TableView) insert(row []interface{}) error {
 	if view.metaPage.FirstDataPgNumber == 0 {
-		firstPgNumber, err1 := allocPage(view.ctx)
+		firstPgNumber, err1 := view.allocDataPage()
 		if err1 != nil {
 			return err1
 		}
-		err2 := view.saveFixDataPage(&fixDataPage{
-			pgNumber:     firstPgNumber,
-			nextPgNumber: 0,
-			prevPgNumber: 0,
-			numRows:      0,
-			meta:         view.metaPage.RowInfo,
-			data:         make([]byte, 0),
-		})
+		err2 := view.saveFixDataPage(makeDataPage(firstPgNumber, view.ctx.pageSize(), view.metaPage.RowInfo))
 		if err2 != nil {
 			return err2
 		}
@@ -168,7 +165,12 @@ func (view *TableView) insert(row []interface{}) error {
 	if err = view.moveToInsert(view.clusterFieldId, row[view.clusterFieldId]); err != nil {
 		return err
 	}
-	if view.nowPage.canInsert() {
+	//The page is kept in the cache until the rows are moved and saved
+	if view.nowPage, err = view.fetchFixDataPage(view.nowPageNumber); err != nil {
+		return err
+	}
+	defer view.unpinFixDataPage(view.nowPage)
+	if view.nowPage.canInsert(row) {
 		fmeta := view.metaPage.RowInfo.FieldMetas[view.clusterFieldId]
 		if view.nowPage.numRows == 0 ||
 			fmeta.cmpField(row[view.clusterFieldId], view.nowPage.firstNonNullKeyField()) {
@@ -184,7 +186,7 @@ func (view *TableView) insert(row []interface{}) error {
 		}
 		view.saveFixDataPage(view.nowPage)
 	} else {
-		newPgNumber, err1 := allocPage(view.ctx)
+		newPgNumber, err1 := view.allocDataPage()
 		if err1 != nil {
 			return err1
 		}
@@ -194,19 +196,10 @@ func (view *TableView) insert(row []interface{}) error {
 				return err
 			}
 		}
-		newPage := &fixDataPage{
-			pgNumber:     newPgNumber,
-			nextPgNumber: view.nowPage.nextPgNumber,
-			prevPgNumber: view.nowPage.pgNumber,
-			meta:         view.nowPage.meta,
-		}
-		rowSize := uint32(newPage.meta.size())
-		n := view.nowPage.numRows / 2
-		newPage.numRows = view.nowPage.numRows - n
-		newPage.data = make([]byte, rowSize*newPage.numRows)
-		copy(newPage.data, view.nowPage.data[rowSize*n:])
-		view.nowPage.numRows = n
-		view.nowPage.data = view.nowPage.data[:rowSize*n]
+		newPage := makeDataPage(newPgNumber, view.nowPage.pgSize, view.nowPage.meta)
+		newPage.nextPgNumber = view.nowPage.nextPgNumber
+		newPage.prevPgNumber = view.nowPage.pgNumber
+		view.nowPage.moveRowsTo(int(view.nowPage.numRows/2), newPage)
 		view.nowPage.nextPgNumber = newPage.pgNumber
 		if nextPage != nil {
 			nextPage.prevPgNumber = newPage.pgNumber
@@ -494,13 +487,68 @@ func (view *TableView) moveToInsert(fieldId int, key interface{}) error {
 }
 
 func (view *TableView) loadFixDataPage(pgNumber uint32) (*fixDataPage, error) {
+	if pgNumber == 0 {
+		//Tables without rows have no data page, page 0 is the database header
+		return makeDataPage(0, view.ctx.pageSize(), view.metaPage.RowInfo), nil
+	}
 	rt := view.ctx.transaction.(pager.TransactionReader)
 	data, err := rt.ReadPage(pgNumber)
 	if err != nil {
 		rt.AbortTransaction()
 		return nil, err
 	}
-	return fixDataPageFromData(pgNumber, view.metaPage.RowInfo, data), nil
+	page, err1 := fixDataPageFromData(pgNumber, view.metaPage.RowInfo, data)
+	if err1 != nil {
+		rt.AbortTransaction()
+		return nil, makeCorruptionError(view.ctx, pgNumber, err1)
+	}
+	return page, nil
+}
+
+// Load a data page pinned in the cache, its rows are the cached data until unpinFixDataPage
+func (view *TableView) fetchFixDataPage(pgNumber uint32) (*fixDataPage, error) {
+	wt, ok := view.ctx.transaction.(*pager.WriteTransaction)
+	if !ok {
+		panic("Cannot write when fetching fix data page")
+	}
+	data, err := wt.FetchPage(pgNumber)
+	if err != nil {
+		wt.AbortTransaction()
+		return nil, err
+	}
+	page, err1 := fixDataPageFromData(pgNumber, view.metaPage.RowInfo, data)
+	if err1 != nil {
+		wt.UnpinPage(pgNumber, false)
+		wt.AbortTransaction()
+		return nil, makeCorruptionError(view.ctx, pgNumber, err1)
+	}
+	return page, nil
+}
+
+// Data pages are taken from the extent of the table in order, a new extent is reserved when it is used up
+func (view *TableView) allocDataPage() (uint32, error) {
+	page := view.metaPage
+	//Other views of the table may have taken pages of the extent
+	saved, err1 := loadTableMetaPage(view.ctx, page.PgNumber)
+	if err1 != nil {
+		return 0, err1
+	}
+	page.ExtentNext, page.ExtentEnd = saved.ExtentNext, saved.ExtentEnd
+	if page.ExtentNext == page.ExtentEnd {
+		start, err := allocPages(view.ctx, EXTENT_PAGES)
+		if err != nil {
+			return 0, err
+		}
+		page.ExtentNext, page.ExtentEnd = start, start+EXTENT_PAGES
+	}
+	pgNumber := page.ExtentNext
+	page.ExtentNext++
+	return pgNumber, saveTableMetaPage(view.ctx, page)
+}
+
+// The page is saved by saveFixDataPage, so it is not marked dirty here
+func (view *TableView) unpinFixDataPage(page *fixDataPage) error {
+	return view.ctx.transaction.(*pager.WriteTransaction).UnpinPage(page.pgNumber, false)
 }
 
 func (view *TableView) saveFixDataPage(page *fixDataPage) error {
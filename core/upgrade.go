@@ -0,0 +1,100 @@
+package core
+
+import (
+	"fmt"
+
+	pager "github.com/gjc13/gsdl/pager"
+)
+
+// Steps migrating a database to the next format version, indexed by the version they start from
+// Each step changes the header and the pages it needs to in the write transaction, the header is written after the last step
+var formatUpgrades = []func(filename string, wt *pager.WriteTransaction, page *dbMetaPage, key []byte) error{
+	upgradeLegacyHeader,
+}
+
+func newerFormatError(filename string, page *dbMetaPage) error {
+	return &FormatError{filename, fmt.Sprintf("format version %d is newer than %d, use a newer gsdl", page.FormatVersion, FORMAT_VERSION)}
+}
+
+// Only databases of this version with known features can be used, older ones must be upgraded first
+func checkFormat(filename string, page *dbMetaPage) error {
+	if page.FormatVersion > FORMAT_VERSION {
+		return newerFormatError(filename, page)
+	} else if page.FormatVersion < FORMAT_VERSION {
+		return &FormatError{filename, fmt.Sprintf("format version %d is older than %d, upgrade the database first", page.FormatVersion, FORMAT_VERSION)}
+	}
+	if unknown := page.Features &^ knownFeatures; unknown != 0 {
+		return &FormatError{filename, fmt.Sprintf("unknown features %#x", unknown)}
+	}
+	return nil
+}
+
+// Version 0 had no magic, version, features or sizes in the header, its pages are always of the default size
+func upgradeLegacyHeader(filename string, wt *pager.WriteTransaction, page *dbMetaPage, key []byte) error {
+	compressed, err := pager.IsCompressed(filename)
+	if err != nil {
+		return err
+	}
+	page.Magic = dbMagic
+	page.PageSize = wt.PageSize()
+	if compressed {
+		page.Features |= FEATURE_COMPRESSED
+	}
+	if len(key) > 0 {
+		page.Features |= FEATURE_ENCRYPTED
+	}
+	return nil
+}
+
+// Migrate a database not in use from an older format version in place, the key is the one it is encrypted with
+// The migration is one transaction, so a crash leaves the database in the old version
+func UpgradeDatabase(filename string, key []byte) error {
+	if err := pager.SetKey(filename+".gsdl", key); err != nil {
+		return err
+	}
+	if err := loadDatabaseOptions(filename + ".gsdl"); err != nil {
+		return err
+	}
+	if err := pager.Recover(filename + ".gsdl"); err != nil {
+		return err
+	}
+	//Version 0 databases may have been written before pages had a trailer, the pages get one before the header is changed
+	if err := pager.AddPageTrailers(filename + ".gsdl"); err != nil {
+		return err
+	}
+	wt := &pager.WriteTransaction{}
+	if err := wt.StartTransaction(filename + ".gsdl"); err != nil {
+		return err
+	}
+	data, err1 := wt.ReadPage(0)
+	if err1 != nil {
+		wt.EndTransaction()
+		return err1
+	}
+	page, err2 := dbMetaPageFromPageData(0, data)
+	if err2 != nil {
+		wt.EndTransaction()
+		return &FormatError{filename + ".gsdl", err2.Error()}
+	}
+	if page.FormatVersion > FORMAT_VERSION {
+		wt.EndTransaction()
+		return newerFormatError(filename+".gsdl", page)
+	}
+	if page.FormatVersion == FORMAT_VERSION {
+		return wt.EndTransaction()
+	}
+	for page.FormatVersion < FORMAT_VERSION {
+		if err3 := formatUpgrades[page.FormatVersion](filename+".gsdl", wt, page, key); err3 != nil {
+			wt.AbortTransaction()
+			wt.EndTransaction()
+			return err3
+		}
+		page.FormatVersion++
+	}
+	if err4 := wt.WritePage(0, page.toPageData(wt.PageSize())); err4 != nil {
+		wt.AbortTransaction()
+		wt.EndTransaction()
+		return err4
+	}
+	return wt.EndTransaction()
+}
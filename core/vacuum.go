@@ -0,0 +1,234 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+
+	pager "github.com/gjc13/gsdl/pager"
+	page_map "github.com/gjc13/gsdl/utils/page_map"
+)
+
+// Live pages of the database by page type, data pages also keep the row meta of their table
+type livePages struct {
+	types map[uint32]uint8
+	metas map[uint32]*RowMeta
+}
+
+func (pages *livePages) add(ctx *DbContext, pgNumber uint32, pgType uint8) (bool, error) {
+	if oldType, ok := pages.types[pgNumber]; ok {
+		if oldType != pgType {
+			return false, makeCorruptionError(ctx, pgNumber, fmt.Errorf("page used as type %d and %d", oldType, pgType))
+		}
+		return false, nil
+	}
+	if pgNumber == 0 || isFreeMapPage(pgNumber, ctx.pageSize()) {
+		return false, makeCorruptionError(ctx, pgNumber, fmt.Errorf("page of type %d at a reserved page", pgType))
+	}
+	pages.types[pgNumber] = pgType
+	return true, nil
+}
+
+// Collect the pages reachable from the table meta chain, dropped tables are kept
+func collectLivePages(ctx *DbContext) (*livePages, error) {
+	pages := &livePages{
+		types: map[uint32]uint8{},
+		metas: map[uint32]*RowMeta{},
+	}
+	for pgNumber := ctx.metaPage.FirstTableMetaPageNumber; pgNumber != 0; {
+		metaPage, err := pages.addTable(ctx, pgNumber)
+		if err != nil {
+			return nil, err
+		}
+		pgNumber = metaPage.NextTableMetaPgNumber
+	}
+	return pages, nil
+}
+
+// Add a table with its secondary index tables, the B+tree and the data page chain
+func (pages *livePages) addTable(ctx *DbContext, pgNumber uint32) (*tableMetaPage, error) {
+	isNew, err1 := pages.add(ctx, pgNumber, TABLE_META_PAGE)
+	if err1 != nil {
+		return nil, err1
+	} else if !isNew {
+		return nil, makeCorruptionError(ctx, pgNumber, fmt.Errorf("table meta page used twice"))
+	}
+	metaPage, err2 := loadTableMetaPage(ctx, pgNumber)
+	if err2 != nil {
+		return nil, err2
+	}
+	for i, indexPgNumber := range metaPage.FieldIndexPgNumbers {
+		if indexPgNumber == 0 {
+			continue
+		}
+		var err3 error
+		if i == int(metaPage.RowInfo.ClusterFieldId) {
+			err3 = pages.addTree(ctx, indexPgNumber)
+		} else {
+			_, err3 = pages.addTable(ctx, indexPgNumber)
+		}
+		if err3 != nil {
+			return nil, err3
+		}
+	}
+	view := &TableView{ctx: ctx, metaPage: metaPage}
+	for dataPgNumber := metaPage.FirstDataPgNumber; dataPgNumber != 0; {
+		if isNew, err4 := pages.add(ctx, dataPgNumber, dataPageType(metaPage.RowInfo)); err4 != nil {
+			return nil, err4
+		} else if !isNew {
+			return nil, makeCorruptionError(ctx, dataPgNumber, fmt.Errorf("loop in data pages of table %s", metaPage.TableName))
+		}
+		pages.metas[dataPgNumber] = metaPage.RowInfo
+		page, err5 := view.loadFixDataPage(dataPgNumber)
+		if err5 != nil {
+			return nil, err5
+		}
+		dataPgNumber = page.nextPgNumber
+	}
+	return metaPage, nil
+}
+
+func (pages *livePages) addTree(ctx *DbContext, rootPgNumber uint32) error {
+	tree := &Bptree{ctx: ctx, rootPgNumber: rootPgNumber}
+	stack := []uint32{rootPgNumber}
+	for len(stack) > 0 {
+		pgNumber := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if isNew, err1 := pages.add(ctx, pgNumber, CLUSTER_INDEX_PAGE); err1 != nil {
+			return err1
+		} else if !isNew {
+			return makeCorruptionError(ctx, pgNumber, fmt.Errorf("index page used twice"))
+		}
+		page, err2 := tree.loadIndexPage(pgNumber)
+		if err2 != nil {
+			return err2
+		}
+		if page.isInternal() {
+			for _, elem := range page.Children {
+				stack = append(stack, elem.PgNumber)
+			}
+		}
+	}
+	return nil
+}
+
+// Number the live pages from the front of the file in their old order, free map pages keep their places
+// Since no page gets a bigger number, the pages can be moved in order without overwriting a page not moved yet
+func compactPageNumbers(pgNumbers []uint32, pgSize uint32) (map[uint32]uint32, uint32) {
+	newPgNumbers := make(map[uint32]uint32, len(pgNumbers))
+	var next uint32 = 1
+	for _, pgNumber := range pgNumbers {
+		for isFreeMapPage(next, pgSize) {
+			next++
+		}
+		newPgNumbers[pgNumber] = next
+		next++
+	}
+	return newPgNumbers, next
+}
+
+// Read a live page and change the page numbers it holds to the new ones
+func relocatePage(ctx *DbContext, pages *livePages, pgNumber uint32, newPgNumbers map[uint32]uint32) ([]byte, error) {
+	var err error
+	renumber := func(oldPgNumber uint32) uint32 {
+		if oldPgNumber == 0 {
+			return 0
+		}
+		newPgNumber, ok := newPgNumbers[oldPgNumber]
+		if !ok && err == nil {
+			err = makeCorruptionError(ctx, pgNumber, fmt.Errorf("reference to page %d not in use", oldPgNumber))
+		}
+		return newPgNumber
+	}
+	var data []byte
+	switch pages.types[pgNumber] {
+	case TABLE_META_PAGE:
+		page, err1 := loadTableMetaPage(ctx, pgNumber)
+		if err1 != nil {
+			return nil, err1
+		}
+		page.PgNumber = renumber(page.PgNumber)
+		page.FirstDataPgNumber = renumber(page.FirstDataPgNumber)
+		for i := range page.FieldIndexPgNumbers {
+			page.FieldIndexPgNumbers[i] = renumber(page.FieldIndexPgNumbers[i])
+		}
+		page.NextTableMetaPgNumber = renumber(page.NextTableMetaPgNumber)
+		//Pages reserved for data pages are freed with the free maps rebuilt
+		page.ExtentNext, page.ExtentEnd = 0, 0
+		data = page.toPageData(ctx.pageSize())
+	case CLUSTER_INDEX_PAGE:
+		tree := &Bptree{ctx: ctx}
+		page, err2 := tree.loadIndexPage(pgNumber)
+		if err2 != nil {
+			return nil, err2
+		}
+		page.PgNumber = renumber(page.PgNumber)
+		for i := range page.Children {
+			page.Children[i].PgNumber = renumber(page.Children[i].PgNumber)
+		}
+		page.PrevPgNumber = renumber(page.PrevPgNumber)
+		page.NextPgNumber = renumber(page.NextPgNumber)
+		data = page.toPageData(ctx.pageSize())
+	case FIX_DATA_PAGE, VARLEN_DATA_PAGE:
+		view := &TableView{ctx: ctx, metaPage: &tableMetaPage{RowInfo: pages.metas[pgNumber]}}
+		page, err3 := view.loadFixDataPage(pgNumber)
+		if err3 != nil {
+			return nil, err3
+		}
+		page.pgNumber = renumber(page.pgNumber)
+		page.nextPgNumber = renumber(page.nextPgNumber)
+		page.prevPgNumber = renumber(page.prevPgNumber)
+		data = page.toPageData()
+	}
+	return data, err
+}
+
+// Move the live pages to the front of the file, rebuild the free maps and cut the free pages off the end
+// Table views created before must not be used again
+func (ctx *DbContext) Vacuum() error {
+	wt, ok := ctx.transaction.(*pager.WriteTransaction)
+	if !ok {
+		panic("Cannot write when vacuuming")
+	}
+	pgSize := ctx.pageSize()
+	pages, err1 := collectLivePages(ctx)
+	if err1 != nil {
+		return err1
+	}
+	pgNumbers := make([]uint32, 0, len(pages.types))
+	for pgNumber := range pages.types {
+		pgNumbers = append(pgNumbers, pgNumber)
+	}
+	sort.Slice(pgNumbers, func(i, j int) bool { return pgNumbers[i] < pgNumbers[j] })
+	newPgNumbers, numPages := compactPageNumbers(pgNumbers, pgSize)
+	for _, pgNumber := range pgNumbers {
+		data, err2 := relocatePage(ctx, pages, pgNumber, newPgNumbers)
+		if err2 != nil {
+			return err2
+		}
+		if err3 := wt.WritePage(newPgNumbers[pgNumber], data); err3 != nil {
+			return err3
+		}
+	}
+	if ctx.metaPage.FirstTableMetaPageNumber != 0 {
+		ctx.metaPage.FirstTableMetaPageNumber = newPgNumbers[ctx.metaPage.FirstTableMetaPageNumber]
+	}
+	ctx.metaPage.FirstFreeMapPageNumber = 0
+	ctx.freeCounts = nil
+	if err4 := wt.WritePage(0, ctx.metaPage.toPageData(pgSize)); err4 != nil {
+		return err4
+	}
+	//Every page before the new end is in use now
+	for mapPgNumber := uint32(1); mapPgNumber < numPages; mapPgNumber += pgSize * 8 {
+		fmp := &freeMapPage{
+			pgNumber:    mapPgNumber,
+			freePageMap: page_map.MakeFreePageMap(mapPgNumber, int(pgSize)*8),
+		}
+		for pgNumber := mapPgNumber; pgNumber < numPages && pgNumber < mapPgNumber+pgSize*8; pgNumber++ {
+			fmp.freePageMap.Set(pgNumber)
+		}
+		if err5 := wt.WritePage(mapPgNumber, fmp.toPageData()); err5 != nil {
+			return err5
+		}
+	}
+	return wt.Truncate(numPages)
+}
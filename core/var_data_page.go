@@ -0,0 +1,96 @@
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Slotted pages keep rows of variable size
+// The header is followed by a slot for each row in key order, the rows are put from the end of the page down
+// Removed rows leave holes, which are compacted when a row does not fit in the space between the slots and the rows
+type varSlot struct {
+	offset uint16
+	length uint16
+}
+
+const varSlotSize int = 4
+
+func (page *fixDataPage) slotsEnd(numRows int) int {
+	return dataPageHeaderSize + varSlotSize*numRows
+}
+
+// Start of the rows, the free space is between the slots and it
+func (page *fixDataPage) rowsStart() int {
+	start := int(page.pgSize)
+	for _, slot := range page.slots {
+		if int(slot.offset) < start {
+			start = int(slot.offset)
+		}
+	}
+	return start
+}
+
+func (page *fixDataPage) canInsertVar(rowSize int) bool {
+	used := page.slotsEnd(int(page.numRows) + 1)
+	for _, slot := range page.slots {
+		used += int(slot.length)
+	}
+	return used+rowSize <= int(page.pgSize)
+}
+
+func (page *fixDataPage) insertVarRowData(i int, rowData []byte) {
+	if page.rowsStart()-len(rowData) < page.slotsEnd(int(page.numRows)+1) {
+		page.compact()
+	}
+	offset := page.rowsStart() - len(rowData)
+	copy(page.data[offset:], rowData)
+	slot := varSlot{uint16(offset), uint16(len(rowData))}
+	page.slots = append(page.slots[:i], append([]varSlot{slot}, page.slots[i:]...)...)
+	page.numRows++
+}
+
+// Move the rows to the end of the page in key order, so the free space is in one piece
+func (page *fixDataPage) compact() {
+	data := make([]byte, page.pgSize)
+	end := int(page.pgSize)
+	for i, slot := range page.slots {
+		end -= int(slot.length)
+		copy(data[end:], page.data[slot.offset:int(slot.offset)+int(slot.length)])
+		page.slots[i].offset = uint16(end)
+	}
+	page.data = data
+}
+
+func (page *fixDataPage) toVarPageData() []byte {
+	data := make([]byte, page.pgSize)
+	copy(data, page.data)
+	binary.LittleEndian.PutUint32(data[0:4], page.nextPgNumber)
+	binary.LittleEndian.PutUint32(data[4:8], page.prevPgNumber)
+	binary.LittleEndian.PutUint32(data[8:12], page.numRows)
+	for i, slot := range page.slots {
+		offset := page.slotsEnd(i)
+		binary.LittleEndian.PutUint16(data[offset:offset+2], slot.offset)
+		binary.LittleEndian.PutUint16(data[offset+2:offset+4], slot.length)
+	}
+	return data
+}
+
+func (page *fixDataPage) readSlots() error {
+	if uint64(page.slotsEnd(0))+uint64(varSlotSize)*uint64(page.numRows) > uint64(page.pgSize) {
+		return errors.New("Wrong number of rows in var data page")
+	}
+	end := page.slotsEnd(int(page.numRows))
+	page.slots = make([]varSlot, 0, page.numRows)
+	for i := 0; i < int(page.numRows); i++ {
+		offset := page.slotsEnd(i)
+		slot := varSlot{
+			offset: binary.LittleEndian.Uint16(page.data[offset : offset+2]),
+			length: binary.LittleEndian.Uint16(page.data[offset+2 : offset+4]),
+		}
+		if int(slot.offset) < end || int(slot.offset)+int(slot.length) > int(page.pgSize) {
+			return errors.New("Wrong slot in var data page")
+		}
+		page.slots = append(page.slots, slot)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var vp_test_meta *RowMeta = &RowMeta{
+	FieldMetas: []FieldMeta{
+		{INT_TYPE, 4, 0, 1},
+		{VAR_CHAR_TYPE, 200, 1, 0},
+	},
+	ClusterFieldId: 0,
+}
+
+func TestVarDataPage(t *testing.T) {
+	page := makeDataPage(1, 1024, vp_test_meta)
+	n := 0
+	for ; page.canInsert([]interface{}{n, "note"}); n++ {
+		page.insertRow([]interface{}{n, "note"})
+	}
+	//A fixed row would take the whole width of the varchar
+	if fixRows := (1024 - dataPageHeaderSize) / vp_test_meta.size(); n <= fixRows {
+		t.Errorf("Only %d short rows in slotted page", n)
+	}
+	for i := 0; i < n; i += 2 {
+		page.deleteRow(int32(i))
+	}
+	//The long row only fits after the holes of the removed rows are compacted
+	long := strings.Repeat("x", 200)
+	if err := page.insertRow([]interface{}{-1, long}); err != nil {
+		t.Fatalf("Cannot insert into compacted page %v", err)
+	}
+	page.insertRow([]interface{}{-2, nil})
+	loaded, err := fixDataPageFromData(1, vp_test_meta, page.toPageData())
+	if err != nil {
+		t.Fatalf("Cannot load slotted page %v", err)
+	}
+	if int(loaded.numRows) != n-n/2-n%2+2 {
+		t.Errorf("Wrong number of rows %d", loaded.numRows)
+	}
+	if row := loaded.getRowAt(0); row[0].(int32) != -2 || row[1] != nil {
+		t.Errorf("Wrong null row %v", row)
+	}
+	if row := loaded.getRowAt(1); row[1].(string) != long {
+		t.Errorf("Wrong long row %v", row)
+	}
+	if rows := loaded.getRows(int32(3)); len(rows) != 1 || rows[0][1].(string) != "note" {
+		t.Errorf("Wrong rows of key 3 %v", rows)
+	}
+}
+
+func TestVarCharTable(t *testing.T) {
+	CreateDatabase(":memory:test_db_varchar", nil)
+	ctx, err := StartUseDatabase(":memory:test_db_varchar", nil)
+	if err != nil {
+		t.Fatalf("Cannot use database %v", err)
+	}
+	tooLong := &RowMeta{FieldMetas: []FieldMeta{{INT_TYPE, 4, 0, 1}, {VAR_CHAR_TYPE, 4000, 1, 0}}}
+	if err := ctx.CreateTable("long_notes", []string{"note_id", "text"}, tooLong); err != ERR_ROW_SIZE {
+		t.Errorf("Table of rows longer than half a page created, get %v", err)
+	}
+	if ctx.metaPage.Features&FEATURE_VARCHAR != 0 {
+		t.Error("Varchar feature set without a varchar table")
+	}
+	//The feature is written with the table, which is not the first one
+	ids := &RowMeta{FieldMetas: []FieldMeta{{INT_TYPE, 4, 0, 1}}}
+	if err := ctx.CreateTable("ids", []string{"id"}, ids); err != nil {
+		t.Fatalf("Cannot create table %v", err)
+	}
+	if err := ctx.CreateTable("notes", []string{"note_id", "text"}, vp_test_meta); err != nil {
+		t.Fatalf("Cannot create table %v", err)
+	}
+	notes, _ := ctx.CreateTableView("notes")
+	textOf := func(i int) interface{} {
+		if i%13 == 0 {
+			return nil
+		}
+		return fmt.Sprintf("note%d%s", i, strings.Repeat("-", i%150))
+	}
+	for i := 0; i < 2000; i++ {
+		if err := notes.Insert([]interface{}{i, textOf(i)}); err != nil {
+			t.Fatalf("Cannot insert note %d %v", i, err)
+		}
+	}
+	for i := 0; i < 2000; i += 4 {
+		notes.Delete(i, nil)
+	}
+	for i := 1; i < 2000; i += 4 {
+		notes.Update(i, nil, []FieldValue{{1, fmt.Sprintf("changed%d", i)}})
+	}
+	if problems := CheckIntegrity(ctx); len(problems) != 0 {
+		t.Errorf("Problems found in varchar table %v", problems)
+	}
+	ctx.EndUseDatabase()
+	ctx, _ = StartUseDatabase(":memory:test_db_varchar", nil)
+	defer ctx.EndUseDatabase()
+	if ctx.metaPage.Features&FEATURE_VARCHAR == 0 {
+		t.Error("Varchar feature not kept in header")
+	}
+	notes, _ = ctx.CreateTableView("notes")
+	for i := 0; i < 2000; i++ {
+		rows, err := notes.Search(0, i)
+		switch {
+		case err != nil:
+			t.Fatalf("Cannot search note %d %v", i, err)
+		case i%4 == 0:
+			if len(rows) != 0 {
+				t.Errorf("Deleted note %d found", i)
+			}
+		case i%4 == 1:
+			if len(rows) != 1 || rows[0][1] != fmt.Sprintf("changed%d", i) {
+				t.Errorf("Wrong updated note %d %v", i, rows)
+			}
+		default:
+			if len(rows) != 1 || rows[0][1] != textOf(i) {
+				t.Errorf("Wrong note %d %v", i, rows)
+			}
+		}
+	}
+	if rows, err := notes.Search(1, textOf(7)); err != nil || len(rows) != 1 || rows[0][0].(int32) != 7 {
+		t.Errorf("Wrong rows of text, %v %v", rows, err)
+	}
+}
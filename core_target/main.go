@@ -29,16 +29,16 @@ var db_column_names2 []string = []string{
 }
 
 func main() {
-	ctx, _ := core.StartUseDatabase("orderDB")
+	ctx, _ := core.StartUseDatabase("orderDB", nil)
 	view, _ := ctx.CreateTableView("publisher")
 	view.Print()
 	//rows, _ := view.Search(0, 104946)
 	//fmt.Println(len(rows))
 	ctx.EndUseDatabase()
-	//if err := core.CreateDatabase("test_db2"); err != nil {
+	//if err := core.CreateDatabase("test_db2", nil); err != nil {
 	//	fmt.Printf("%v\n", err)
 	//}
-	//ctx, err1 := core.StartUseDatabase("test_db2")
+	//ctx, err1 := core.StartUseDatabase("test_db2", nil)
 	//if err1 != nil {
 	//	fmt.Println("Cannot Use database")
 	//}
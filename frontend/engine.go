@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	core "github.com/gjc13/gsdl/core"
+	pager "github.com/gjc13/gsdl/pager"
 	view "github.com/gjc13/gsdl/view"
 	"github.com/xwb1989/sqlparser"
 )
@@ -15,6 +16,14 @@ import (
 type Engine struct {
 	nowDbName string
 	ctx       *core.DbContext
+	key       []byte
+	//Databases attached to the session, attached again when the session is started again
+	attached []attachment
+}
+
+type attachment struct {
+	dbname string
+	alias  string
 }
 
 func MakeEngine() *Engine {
@@ -24,6 +33,11 @@ func MakeEngine() *Engine {
 	}
 }
 
+// Databases created and used by the engine are encrypted with the key, nil for plain databases
+func (e *Engine) SetKey(key []byte) {
+	e.key = key
+}
+
 func (e *Engine) TableCommandHandler(rawStatement string, statement sqlparser.Statement) error {
 	switch stmt := statement.(type) {
 	case *sqlparser.CreateTable:
@@ -64,6 +78,38 @@ func (e *Engine) MetaCommandHandler(statement string) error {
 		err = e.ShowTablesHandler()
 	case stmt == "show databases":
 		err = e.ShowDatabasesHandler()
+	case stmt == "show status":
+		err = e.ShowStatusHandler()
+	case strings.HasPrefix(stmt, "set "):
+		err = e.SetHandler(stmt[4:])
+	case strings.HasPrefix(stmt, "savepoint "):
+		err = e.SavepointHandler(strings.Trim(statement[10:], " "))
+	case strings.HasPrefix(stmt, "rollback to "):
+		name := strings.Trim(statement[12:], " ")
+		if strings.HasPrefix(strings.ToLower(name), "savepoint ") {
+			name = strings.Trim(name[10:], " ")
+		}
+		err = e.RollbackToHandler(name)
+	case strings.HasPrefix(stmt, "release "):
+		name := strings.Trim(statement[8:], " ")
+		if strings.HasPrefix(strings.ToLower(name), "savepoint ") {
+			name = strings.Trim(name[10:], " ")
+		}
+		err = e.ReleaseHandler(name)
+	case stmt == "vacuum":
+		err = e.VacuumHandler()
+	case stmt == "check database":
+		err = e.CheckDbHandler()
+	case strings.HasPrefix(stmt, "attach "):
+		err = e.AttachHandler(statement[7:])
+	case strings.HasPrefix(stmt, "detach "):
+		err = e.DetachHandler(strings.Trim(statement[7:], " "))
+	case strings.HasPrefix(stmt, "upgrade database "):
+		err = e.UpgradeDbHandler(strings.Trim(statement[17:], " "))
+	case strings.HasPrefix(stmt, "backup to "):
+		err = e.BackupHandler(statement[10:])
+	case stmt == "track changes":
+		err = e.TrackChangesHandler()
 	case stmt == "debug_print":
 		v, err := e.ctx.CreateTableView("publisher")
 		if err != nil {
@@ -78,6 +124,170 @@ func (e *Engine) MetaCommandHandler(statement string) error {
 
 }
 
+var synchronousLevels map[string]uint8 = map[string]uint8{
+	"off":    pager.SYNCHRONOUS_OFF,
+	"normal": pager.SYNCHRONOUS_NORMAL,
+	"full":   pager.SYNCHRONOUS_FULL,
+}
+
+// Handle set [global | session] synchronous = off | normal | full, global keeps the level in the database
+func (e *Engine) SetHandler(stmt string) error {
+	if e.ctx == nil {
+		return ERR_STATEMENT
+	}
+	global := false
+	if strings.HasPrefix(stmt, "global ") {
+		global = true
+		stmt = stmt[7:]
+	} else if strings.HasPrefix(stmt, "session ") {
+		stmt = stmt[8:]
+	}
+	parts := strings.Split(stmt, "=")
+	if len(parts) != 2 || strings.Trim(parts[0], " ") != "synchronous" {
+		return ERR_STATEMENT
+	}
+	level, ok := synchronousLevels[strings.Trim(parts[1], " ")]
+	if !ok {
+		return ERR_STATEMENT
+	}
+	if global {
+		return e.ctx.SetDatabaseSynchronous(level)
+	}
+	return e.ctx.SetSynchronous(level)
+}
+
+func (e *Engine) SavepointHandler(name string) error {
+	if e.ctx == nil || len(name) == 0 {
+		return ERR_STATEMENT
+	}
+	e.ctx.Savepoint(name)
+	return nil
+}
+
+func (e *Engine) RollbackToHandler(name string) error {
+	if e.ctx == nil || len(name) == 0 {
+		return ERR_STATEMENT
+	}
+	return e.ctx.RollbackTo(name)
+}
+
+func (e *Engine) ReleaseHandler(name string) error {
+	if e.ctx == nil || len(name) == 0 {
+		return ERR_STATEMENT
+	}
+	return e.ctx.Release(name)
+}
+
+func (e *Engine) VacuumHandler() error {
+	if e.ctx == nil {
+		return ERR_STATEMENT
+	}
+	return e.ctx.Vacuum()
+}
+
+// Print the problems found in the pages of the databases in use
+func (e *Engine) CheckDbHandler() error {
+	if e.ctx == nil {
+		return ERR_STATEMENT
+	}
+	problems := core.CheckIntegrity(e.ctx)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) == 0 {
+		fmt.Println("ok")
+	} else {
+		fmt.Printf("%d problems found\n", len(problems))
+	}
+	return nil
+}
+
+// Handle track changes, later backups of the database get an id and can be incremental
+func (e *Engine) TrackChangesHandler() error {
+	if e.ctx == nil {
+		return ERR_STATEMENT
+	}
+	return e.ctx.EnableChangeTracking()
+}
+
+// Handle backup to 'path' [since id], the copy holds the work committed before it, the session goes on
+// A full backup of a database tracking its changes prints an id, a backup since the id of an older one
+// only writes the pages changed after it to the delta file path
+func (e *Engine) BackupHandler(args string) error {
+	path, since, incremental := args, "", false
+	if i := strings.Index(strings.ToLower(args), " since "); i >= 0 {
+		path, since, incremental = args[:i], strings.Trim(args[i+7:], " "), true
+	}
+	path = strings.Trim(path, " '\"")
+	if e.ctx == nil || len(path) == 0 {
+		return ERR_STATEMENT
+	}
+	sinceId, err := strconv.ParseUint(since, 10, 64)
+	if incremental && err != nil {
+		return ERR_STATEMENT
+	}
+	//The copies are made from read snapshots beside the writer of the session
+	if incremental {
+		id, err1 := core.IncrementalBackup(e.nowDbName, path, sinceId)
+		if err1 == nil {
+			fmt.Printf("backup id %d\n", id)
+		}
+		return err1
+	}
+	dst := strings.TrimSuffix(path, ".gsdl")
+	if err2 := core.Backup(e.nowDbName, dst); err2 != nil {
+		return err2
+	}
+	//Databases not tracking their changes give no id, see track changes
+	if id, err3 := core.BackupId(dst); err3 == nil {
+		fmt.Printf("backup id %d\n", id)
+	}
+	return nil
+}
+
+// Handle attach [database] 'path' as alias, the tables of the database are then named alias.table
+func (e *Engine) AttachHandler(args string) error {
+	if strings.HasPrefix(strings.ToLower(args), "database ") {
+		args = args[9:]
+	}
+	i := strings.Index(strings.ToLower(args), " as ")
+	if e.ctx == nil || i < 0 {
+		return ERR_STATEMENT
+	}
+	dbname := strings.TrimSuffix(strings.Trim(args[:i], " '\""), ".gsdl")
+	alias := strings.Trim(args[i+4:], " ")
+	if len(dbname) == 0 {
+		return ERR_NODB
+	}
+	if err := e.ctx.AttachDatabase(dbname, alias, e.key); err != nil {
+		return err
+	}
+	e.attached = append(e.attached, attachment{dbname, alias})
+	return nil
+}
+
+// Handle detach [database] alias, the work of the session is committed first
+func (e *Engine) DetachHandler(alias string) error {
+	if strings.HasPrefix(strings.ToLower(alias), "database ") {
+		alias = strings.Trim(alias[9:], " ")
+	}
+	found := -1
+	for i, a := range e.attached {
+		if a.alias == alias {
+			found = i
+		}
+	}
+	if e.ctx == nil || found < 0 {
+		return ERR_STATEMENT
+	}
+	e.attached = append(e.attached[:found], e.attached[found+1:]...)
+	if err := e.ctx.EndUseDatabase(); err != nil {
+		e.ctx = nil
+		return err
+	}
+	return e.startSession(e.nowDbName)
+}
+
 func (e *Engine) DropDbHandler(dbname string) error {
 	if e.ctx != nil {
 		e.ctx.EndUseDatabase()
@@ -97,20 +307,44 @@ func (e *Engine) UseDbHandler(dbname string) error {
 	if len(dbname) == 0 {
 		return ERR_NODB
 	}
-	ctx, err := core.StartUseDatabase(dbname)
-	if err == nil {
-		e.ctx = ctx
-	} else {
+	e.attached = nil
+	return e.startSession(dbname)
+}
+
+// Start using the database with the databases attached to the session before
+func (e *Engine) startSession(dbname string) error {
+	ctx, err := core.StartUseDatabase(dbname, e.key)
+	if err != nil {
 		e.ctx = nil
+		return err
 	}
-	return err
+	for _, a := range e.attached {
+		if err := ctx.AttachDatabase(a.dbname, a.alias, e.key); err != nil {
+			ctx.EndUseDatabase()
+			e.ctx = nil
+			return err
+		}
+	}
+	e.ctx = ctx
+	e.nowDbName = dbname
+	return nil
 }
 
 func (e *Engine) CreateDbHandler(dbname string) error {
 	if len(dbname) == 0 {
 		return ERR_NODB
 	}
-	return core.CreateDatabase(dbname)
+	return core.CreateDatabase(dbname, &core.DatabaseOptions{Key: e.key})
+}
+
+// Databases of older format versions must be upgraded before they are used, the one in use cannot be
+func (e *Engine) UpgradeDbHandler(dbname string) error {
+	if len(dbname) == 0 {
+		return ERR_NODB
+	} else if e.ctx != nil && dbname == e.nowDbName {
+		return ERR_STATEMENT
+	}
+	return core.UpgradeDatabase(dbname, e.key)
 }
 
 func (e *Engine) ShowTablesHandler() error {
@@ -130,6 +364,24 @@ func (e *Engine) ShowDatabasesHandler() error {
 	return nil
 }
 
+func (e *Engine) ShowStatusHandler() error {
+	if e.ctx == nil {
+		return ERR_STATEMENT
+	}
+	stats := e.ctx.Stats()
+	fmt.Printf("cache size     %d\n", stats.CacheSize)
+	fmt.Printf("cached pages   %d\n", stats.CachedPages)
+	fmt.Printf("pinned pages   %d\n", stats.PinnedPages)
+	fmt.Printf("hits           %d\n", stats.Hits)
+	fmt.Printf("misses         %d\n", stats.Misses)
+	fmt.Printf("evictions      %d\n", stats.Evictions)
+	fmt.Printf("writebacks     %d\n", stats.Writebacks)
+	fmt.Printf("bytes read     %d\n", stats.BytesRead)
+	fmt.Printf("bytes written  %d\n", stats.BytesWritten)
+	fmt.Printf("syncs          %d\n", stats.Syncs)
+	return nil
+}
+
 func (e *Engine) CreateTableHandler(stmt *sqlparser.CreateTable) error {
 	if e.ctx == nil {
 		return ERR_STATEMENT
@@ -153,10 +405,11 @@ func (e *Engine) CreateTableHandler(stmt *sqlparser.CreateTable) error {
 			fmeta.DataType = core.INT_TYPE
 			fmeta.FieldWidth = 8
 		case "char":
-			fallthrough
-		case "varchar":
 			fmeta.DataType = core.FIX_CHAR_TYPE
 			fmeta.FieldWidth = uint16(width)
+		case "varchar":
+			fmeta.DataType = core.VAR_CHAR_TYPE
+			fmeta.FieldWidth = uint16(width)
 		default:
 			fmt.Println("Data type not known", colDef.ColName, colDef.ColType)
 			return ERR_STATEMENT
@@ -183,11 +436,14 @@ func (e *Engine) InsertHandler(stmt *sqlparser.Insert) error {
 	if e.ctx == nil {
 		return ERR_STATEMENT
 	}
-	tableName := string(stmt.Table.Name)
+	tableName := tableNameString(stmt.Table)
 	tableView, err := e.ctx.CreateTableView(tableName)
 	if err != nil {
 		return err
 	}
+	if sel, ok := stmt.Rows.(*sqlparser.Select); ok {
+		return e.insertSelectHandler(tableView, sel)
+	}
 	fieldNames := tableView.ColumnNames()
 	values, ok := stmt.Rows.(sqlparser.Values)
 	if !ok {
@@ -226,11 +482,62 @@ func (e *Engine) InsertHandler(stmt *sqlparser.Insert) error {
 	return nil
 }
 
+// Handle insert into table select ..., the selected columns are taken in the order of the columns of the table
+// The rows are all selected before the first is inserted, so a table may be copied into itself
+func (e *Engine) insertSelectHandler(tableView *core.TableView, stmt *sqlparser.Select) error {
+	if len(stmt.GroupBy) != 0 {
+		return ERR_STATEMENT
+	}
+	v, err := e.fromWhereToView(stmt)
+	if err != nil {
+		return err
+	}
+	colIdxs := make([]int, 0, len(stmt.SelectExprs))
+	for _, expr := range stmt.SelectExprs {
+		switch expr := expr.(type) {
+		case *sqlparser.StarExpr:
+			for i := range v.ColumnNames() {
+				colIdxs = append(colIdxs, i)
+			}
+		case *sqlparser.NonStarExpr:
+			name := sqlparser.String(expr)
+			if strings.Contains(name, "(") || !e.isColumnNameLegal(name, v) {
+				return ERR_STATEMENT
+			}
+			colIdxs = append(colIdxs, view.ColumnName2Id(name, v.ColumnNames()))
+		}
+	}
+	metas := tableView.ColumnMetas()
+	if len(colIdxs) != len(metas) {
+		return ERR_STATEMENT
+	}
+	for i, idx := range colIdxs {
+		if v.ColumnMetas()[idx].DataType != metas[i].DataType {
+			return ERR_FIELD
+		}
+	}
+	rows := make([][]interface{}, 0)
+	c := make(chan []interface{})
+	go v.Iter(c)
+	for row := range c {
+		insertRow := make([]interface{}, 0, len(colIdxs))
+		for _, idx := range colIdxs {
+			insertRow = append(insertRow, row[idx])
+		}
+		rows = append(rows, insertRow)
+	}
+	for _, row := range rows {
+		if err := tableView.Insert(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (e *Engine) SelectHandler(stmt *sqlparser.Select) error {
 	if e.ctx == nil {
 		return ERR_STATEMENT
 	}
-	tableNames := make([]string, 0)
 	colNames := make([]string, 0)
 	isStar := false
 	isReduce := false
@@ -259,28 +566,7 @@ func (e *Engine) SelectHandler(stmt *sqlparser.Select) error {
 			}
 		}
 	}
-	for _, tableName := range stmt.From {
-		tableNames = append(tableNames, sqlparser.String(tableName))
-	}
-	var err error
-	var v view.Viewer
-	if stmt.Where != nil {
-		clause := e.boolExprToClause(stmt.Where.Expr)
-		if clause == nil {
-			return ERR_STATEMENT
-		}
-		v, err = e.orOfAndClausesToView(tableNames, clause.toOrOfAnds())
-	} else {
-		if len(tableNames) == 1 {
-			rawView, err1 := e.ctx.CreateTableView(tableNames[0])
-			if err1 != nil {
-				return err1
-			}
-			v = view.MakeRawTableView(rawView)
-		} else {
-			return ERR_STATEMENT
-		}
-	}
+	v, err := e.fromWhereToView(stmt)
 	if err != nil {
 		return err
 	}
@@ -294,6 +580,29 @@ func (e *Engine) SelectHandler(stmt *sqlparser.Select) error {
 	return ERR_STATEMENT
 }
 
+// The rows of the tables of a select which match its where clause
+func (e *Engine) fromWhereToView(stmt *sqlparser.Select) (view.Viewer, error) {
+	tableNames := make([]string, 0)
+	for _, tableName := range stmt.From {
+		tableNames = append(tableNames, sqlparser.String(tableName))
+	}
+	if stmt.Where != nil {
+		clause := e.boolExprToClause(stmt.Where.Expr)
+		if clause == nil {
+			return nil, ERR_STATEMENT
+		}
+		return e.orOfAndClausesToView(tableNames, clause.toOrOfAnds())
+	}
+	if len(tableNames) != 1 {
+		return nil, ERR_STATEMENT
+	}
+	rawView, err := e.ctx.CreateTableView(tableNames[0])
+	if err != nil {
+		return nil, err
+	}
+	return view.MakeRawTableView(rawView), nil
+}
+
 func (e *Engine) printView(v view.Viewer, isStar bool, colNames []string) error {
 	if !isStar {
 		colIdxs := make([]int, 0, len(colNames))
@@ -384,7 +693,7 @@ func (e *Engine) DeleteHandler(stmt *sqlparser.Delete) error {
 	if e.ctx == nil {
 		return ERR_STATEMENT
 	}
-	tableName := string(stmt.Table.Name)
+	tableName := tableNameString(stmt.Table)
 	tableView, err := e.ctx.CreateTableView(tableName)
 	if err != nil {
 		return err
@@ -409,7 +718,7 @@ func (e *Engine) UpdateHandler(stmt *sqlparser.Update) error {
 	if e.ctx == nil {
 		return ERR_STATEMENT
 	}
-	tableName := string(stmt.Table.Name)
+	tableName := tableNameString(stmt.Table)
 	tableView, err := e.ctx.CreateTableView(tableName)
 	if err != nil {
 		return err
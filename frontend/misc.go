@@ -6,6 +6,7 @@ import (
 
 	"github.com/gjc13/gsdl/core"
 	"github.com/gjc13/gsdl/view"
+	"github.com/xwb1989/sqlparser"
 )
 
 func nameContains(tableNames []string, tableName string) bool {
@@ -24,12 +25,40 @@ func addTableName(tableName string, columnName string) string {
 	return columnName
 }
 
+// Tables of attached databases are named schema.table, so the column is after the last dot
 func divideColumnName(columnName string) (string, string) {
-	names := strings.Split(columnName, ".")
-	if len(names) != 2 {
+	i := strings.LastIndex(columnName, ".")
+	if i < 0 {
 		panic("Wrong column name")
 	}
-	return names[0], names[1]
+	return columnName[:i], columnName[i+1:]
+}
+
+// A column of a table of an attached database may be named without the schema when the table is in the from list
+func qualifyColumnName(tableNames []string, columnName string) string {
+	if !strings.Contains(columnName, ".") {
+		if len(tableNames) == 1 {
+			return addTableName(tableNames[0], columnName)
+		}
+		return columnName
+	}
+	tableName, fieldName := divideColumnName(columnName)
+	if nameContains(tableNames, tableName) {
+		return columnName
+	}
+	for _, n := range tableNames {
+		if strings.HasSuffix(n, "."+tableName) {
+			return n + "." + fieldName
+		}
+	}
+	return columnName
+}
+
+func tableNameString(table *sqlparser.TableName) string {
+	if len(table.Qualifier) != 0 {
+		return string(table.Qualifier) + "." + string(table.Name)
+	}
+	return string(table.Name)
 }
 
 func (e *Engine) isColumnName(op string) bool {
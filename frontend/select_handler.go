@@ -41,15 +41,13 @@ func (e *Engine) checkClausesCompatible(tableNames []string, orOfAndClauses [][]
 }
 
 func (e *Engine) addTableNames(tableNames []string, orOfAndClauses [][]RawClause) {
-	if len(tableNames) == 1 {
-		for _, andClauses := range orOfAndClauses {
-			for i, _ := range andClauses {
-				if e.isColumnName(andClauses[i].lhs) {
-					andClauses[i].lhs = addTableName(tableNames[0], andClauses[i].lhs)
-				}
-				if e.isColumnName(andClauses[i].rhs) {
-					andClauses[i].rhs = addTableName(tableNames[0], andClauses[i].rhs)
-				}
+	for _, andClauses := range orOfAndClauses {
+		for i, _ := range andClauses {
+			if e.isColumnName(andClauses[i].lhs) {
+				andClauses[i].lhs = qualifyColumnName(tableNames, andClauses[i].lhs)
+			}
+			if e.isColumnName(andClauses[i].rhs) {
+				andClauses[i].rhs = qualifyColumnName(tableNames, andClauses[i].rhs)
 			}
 		}
 	}
@@ -1,16 +1,34 @@
 package main
 
 import (
+	"encoding/hex"
+	"flag"
+	"log"
 	"os"
 
+	"github.com/gjc13/gsdl/core"
 	"github.com/gjc13/gsdl/frontend"
 )
 
+var busyTimeout = flag.Duration("busy_timeout", 0, "how long to wait for a database locked by another process")
+
+var key = flag.String("key", "", "hex encoded AES key of 16, 24 or 32 bytes to encrypt databases with")
+
 func main() {
 	//for _, selectexp := range node.SelectExprs {
 	//	fmt.Println(sqlparser.String(selectexp))
 	//}
 	//fmt.Println(sqlparser.String(node.Where))
 
-	frontend.InputHandler(os.Stdin, frontend.MakeEngine())
+	flag.Parse()
+	core.SetBusyTimeout(*busyTimeout)
+	engine := frontend.MakeEngine()
+	if *key != "" {
+		keyData, err := hex.DecodeString(*key)
+		if err != nil {
+			log.Fatalf("Bad key: %v", err)
+		}
+		engine.SetKey(keyData)
+	}
+	frontend.InputHandler(os.Stdin, engine)
 }
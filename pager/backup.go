@@ -0,0 +1,177 @@
+package pager
+
+import (
+	"io"
+	"os"
+)
+
+// Pages copied by each step of a backup, the source is only locked for one step at a time
+const BACKUP_STEP_PAGES uint32 = 64
+
+// Times a backup starts again because of commits to the source before it gives up with BusyError
+const BACKUP_RETRY int = 10
+
+// Copy of a database made in steps, each step reads the source in its own read transaction
+// Commits to the source between the steps make the copy start again, so the finished copy is one snapshot
+type backup struct {
+	src     string
+	dst     string
+	pager   *Pager
+	out     *pageFile
+	changes uint64
+	//Number of the last commit copied while change tracking of the source is on
+	tracked  bool
+	lsn      uint64
+	next     uint32
+	done     bool
+	restarts int
+}
+
+// The destination must not be in use, its files are replaced
+func openBackup(src string, dst string) (*backup, error) {
+	if src == dst {
+		return nil, &PageIOError{dst, "cannot back up a database to itself"}
+	}
+	if getPagerManager().isOpen(dst) {
+		return nil, &PageIOError{dst, "cannot back up to a database in use"}
+	}
+	//The pager stays open between the steps, so its commits are counted
+	b := &backup{
+		src:   src,
+		dst:   dst,
+		pager: getPagerManager().OpenPager(src, nil),
+	}
+	if err := b.start(); err != nil {
+		b.close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Start the copy from the first page, the destination gets the page size, compression and key of the source
+func (b *backup) start() error {
+	if b.out != nil {
+		b.out.close()
+	}
+	if err := removeDatabaseFiles(b.dst); err != nil {
+		return err
+	}
+	b.pager.lock.Lock()
+	config := getFileConfig(b.src)
+	err := b.pager.file.open(false)
+	config.compress = err == nil && b.pager.file.slots != nil
+	//Steps compare the count read after their snapshot is pinned with this one
+	b.changes = b.pager.changes
+	b.tracked = b.pager.tracker != nil
+	if b.tracked {
+		b.lsn = b.pager.tracker.lsn
+	}
+	b.pager.lock.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fileConfigLock.Lock()
+	fileConfigs[b.dst] = config
+	fileConfigLock.Unlock()
+	b.out = openPageFile(b.dst, 0, nil)
+	b.next = 0
+	return nil
+}
+
+// Copy the next numPages pages, done is set after the last page of the source is copied
+// A step which finds the source changed only starts the copy again, the count must be read before a snapshot is pinned
+func (b *backup) step(numPages uint32) error {
+	rt := &ReadTransaction{}
+	if err := rt.StartTransaction(b.src); err != nil {
+		return err
+	}
+	defer rt.EndTransaction()
+	b.pager.lock.Lock()
+	changed := b.pager.changes != b.changes
+	var err error
+	if b.tracked {
+		//Commits of other processes are only seen in the change tracking file
+		var lsn uint64
+		lsn, err = b.pager.trackedLsnLocked()
+		changed = changed || lsn != b.lsn
+	}
+	b.pager.lock.Unlock()
+	if err != nil {
+		return err
+	} else if changed {
+		if b.restarts >= BACKUP_RETRY {
+			return &BusyError{b.src}
+		}
+		b.restarts++
+		return b.start()
+	}
+	srcPages, err1 := rt.NumPages()
+	if err1 != nil {
+		return err1
+	}
+	for end := b.next + numPages; b.next < end && b.next < srcPages; b.next++ {
+		data, err2 := rt.ReadPage(b.next)
+		if err2 == io.EOF || os.IsNotExist(err2) {
+			//Holes left by writing beyond the end of file, in wal mode the file itself may not be there yet
+			data, err2 = make([]byte, rt.PageSize()), nil
+		}
+		if err2 != nil {
+			return err2
+		}
+		if err3 := b.out.writePage(data, b.next); err3 != nil {
+			return err3
+		}
+	}
+	if b.next < srcPages {
+		return nil
+	}
+	return b.finish()
+}
+
+// The copy of a database with change tracking on keeps the number of the last commit copied as its backup id
+func (b *backup) finish() error {
+	if err := b.out.sync(); err != nil {
+		return err
+	}
+	if b.tracked {
+		t, err := createChangeTracker(b.dst, b.lsn)
+		if err != nil {
+			return err
+		}
+		t.close()
+	}
+	b.done = true
+	return syncDir(b.dst)
+}
+
+func (b *backup) close() {
+	if b.out != nil {
+		b.out.close()
+	}
+	getPagerManager().ClosePager(b.src)
+}
+
+// Copy a consistent image of the database src to dst while readers and writers of src go on
+// The shared lock of src is held for one step at a time, the copy starts again when src is changed by a commit
+// Only committed pages are copied, dst is removed if the copy fails
+func Backup(src string, dst string) error {
+	unlock, err := lockDatabaseAlone(dst)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	b, err1 := openBackup(src, dst)
+	if err1 != nil {
+		return err1
+	}
+	defer b.close()
+	for !b.done {
+		if err2 := b.step(BACKUP_STEP_PAGES); err2 != nil {
+			b.out.close()
+			removeStorage(dst)
+			removeStorage(changesFilename(dst))
+			return err2
+		}
+	}
+	return nil
+}
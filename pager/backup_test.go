@@ -0,0 +1,93 @@
+package pager
+
+import "testing"
+
+func testBackup(t *testing.T, src string, dst string) {
+	wt := &WriteTransaction{}
+	wt.StartTransaction(src)
+	for i := 0; i < 10; i++ {
+		testWritePage(t, wt, uint32(i), 1)
+	}
+	wt.EndTransaction()
+	unlock, _ := lockDatabaseAlone(dst)
+	b, err := openBackup(src, dst)
+	if err != nil {
+		t.Fatalf("Cannot open backup %v", err)
+	}
+	if err := b.step(4); err != nil || b.next != 4 {
+		t.Fatalf("Cannot copy first pages, %d copied %v", b.next, err)
+	}
+	//A commit between the steps makes the copy start again
+	wt.StartTransaction(src)
+	testWritePage(t, wt, 2, 2)
+	testWritePage(t, wt, 11, 2)
+	wt.EndTransaction()
+	if err := b.step(4); err != nil || b.next != 0 {
+		t.Errorf("Copy not started again after commit, %d copied %v", b.next, err)
+	}
+	//Pages written but not committed are not copied
+	wt.StartTransaction(src)
+	testWritePage(t, wt, 3, 3)
+	for !b.done {
+		if err := b.step(4); err != nil {
+			t.Fatalf("Cannot copy pages %v", err)
+		}
+	}
+	wt.EndTransaction()
+	b.close()
+	unlock()
+	rt := &ReadTransaction{}
+	rt.StartTransaction(dst)
+	defer rt.EndTransaction()
+	if n, err := rt.NumPages(); err != nil || n != 12 {
+		t.Errorf("Wrong number of pages in backup %d %v", n, err)
+	}
+	expectPageValue(t, rt, 1, 1)
+	expectPageValue(t, rt, 2, 2)
+	expectPageValue(t, rt, 3, 1)
+	expectPageValue(t, rt, 10, 0)
+	expectPageValue(t, rt, 11, 2)
+}
+
+func TestBackup(t *testing.T) {
+	src := ":memory:test_backup_src.gsdl"
+	dst := ":memory:test_backup_dst.gsdl"
+	removeTestDb(src)
+	removeTestDb(dst)
+	testBackup(t, src, dst)
+	if err := Backup(src, src); err == nil {
+		t.Error("Database backed up to itself")
+	}
+	//A full backup does not start tracking the changes of the database
+	if storageExists(changesFilename(src)) || storageExists(changesFilename(dst)) {
+		t.Error("Backup started change tracking")
+	}
+	if _, err := BackupId(dst); err == nil {
+		t.Error("Backup of untracked database has an id")
+	}
+}
+
+func TestBackupWal(t *testing.T) {
+	src := ":memory:test_backup_wal_src.gsdl"
+	dst := ":memory:test_backup_wal_dst.gsdl"
+	removeTestDb(src)
+	removeTestDb(dst)
+	if err := SetJournalMode(src, JOURNAL_MODE_WAL); err != nil {
+		t.Fatalf("Cannot switch to wal mode %v", err)
+	}
+	testBackup(t, src, dst)
+	if hasWal(dst) {
+		t.Error("Backup has a log")
+	}
+	//A full backup replaces the old copy
+	wt := &WriteTransaction{}
+	wt.StartTransaction(src)
+	wt.Truncate(5)
+	wt.EndTransaction()
+	if err := Backup(src, dst); err != nil {
+		t.Fatalf("Cannot back up %v", err)
+	}
+	if n, _ := countPages(dst); n != 5 {
+		t.Errorf("Wrong number of pages in backup %d", n)
+	}
+}
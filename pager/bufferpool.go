@@ -0,0 +1,204 @@
+package pager
+
+import "container/list"
+
+// Cached pages of a pager, replaced with the 2Q policy
+// A page read once goes to the in queue, which is replaced in fifo order, so a big scan only flushes that queue
+// Pages dropped from the in queue are remembered in the out queue, a page read again while remembered goes to the hot queue,
+// which is replaced in lru order
+// Pinned pages are never replaced, the pool grows beyond its size if every page is pinned
+type bufferPool struct {
+	size    int
+	inSize  int
+	outSize int
+	pages   map[uint32]*list.Element
+	in      *list.List
+	hot     *list.List
+	out     *list.List
+	ghosts  map[uint32]*list.Element
+	onEvict func(pgNumber uint32, data []byte)
+}
+
+type poolPage struct {
+	pgNumber uint32
+	data     []byte
+	pins     int
+	hot      bool
+}
+
+func newBufferPool(size int, onEvict func(pgNumber uint32, data []byte)) *bufferPool {
+	inSize := size / 4
+	if inSize == 0 {
+		inSize = 1
+	}
+	return &bufferPool{
+		size:    size,
+		inSize:  inSize,
+		outSize: size / 2,
+		pages:   map[uint32]*list.Element{},
+		in:      list.New(),
+		hot:     list.New(),
+		out:     list.New(),
+		ghosts:  map[uint32]*list.Element{},
+		onEvict: onEvict,
+	}
+}
+
+func (pool *bufferPool) queueOf(page *poolPage) *list.List {
+	if page.hot {
+		return pool.hot
+	}
+	return pool.in
+}
+
+// Get a page and count the access
+func (pool *bufferPool) Get(pgNumber uint32) ([]byte, bool) {
+	elem, ok := pool.pages[pgNumber]
+	if !ok {
+		return nil, false
+	}
+	page := elem.Value.(*poolPage)
+	if page.hot {
+		pool.hot.MoveToFront(elem)
+	}
+	return page.data, true
+}
+
+// Get a page without counting the access
+func (pool *bufferPool) Peek(pgNumber uint32) ([]byte, bool) {
+	elem, ok := pool.pages[pgNumber]
+	if !ok {
+		return nil, false
+	}
+	return elem.Value.(*poolPage).data, true
+}
+
+func (pool *bufferPool) Contains(pgNumber uint32) bool {
+	_, ok := pool.pages[pgNumber]
+	return ok
+}
+
+// Add or replace a page, pages beyond the size are replaced afterwards
+func (pool *bufferPool) Add(pgNumber uint32, data []byte) {
+	if elem, ok := pool.pages[pgNumber]; ok {
+		page := elem.Value.(*poolPage)
+		page.data = data
+		if page.hot {
+			pool.hot.MoveToFront(elem)
+		}
+		return
+	}
+	page := &poolPage{pgNumber: pgNumber, data: data}
+	if ghost, ok := pool.ghosts[pgNumber]; ok {
+		pool.out.Remove(ghost)
+		delete(pool.ghosts, pgNumber)
+		page.hot = true
+	}
+	pool.pages[pgNumber] = pool.queueOf(page).PushFront(page)
+	//The new page itself is kept, the caller may still mark it dirty
+	page.pins++
+	pool.evict()
+	page.pins--
+}
+
+func (pool *bufferPool) evict() {
+	for len(pool.pages) > pool.size {
+		//The in queue is replaced first when it is over its share, the hot queue keeps the pages read again
+		queues := []*list.List{pool.hot, pool.in}
+		if pool.in.Len() > pool.inSize || pool.hot.Len() == 0 {
+			queues = []*list.List{pool.in, pool.hot}
+		}
+		if !pool.evictFrom(queues[0]) && !pool.evictFrom(queues[1]) {
+			return
+		}
+	}
+}
+
+// Replace the oldest page not pinned in the queue, false if every page is pinned
+func (pool *bufferPool) evictFrom(queue *list.List) bool {
+	for elem := queue.Back(); elem != nil; elem = elem.Prev() {
+		page := elem.Value.(*poolPage)
+		if page.pins > 0 {
+			continue
+		}
+		pool.remove(elem)
+		if !page.hot && pool.outSize > 0 {
+			pool.ghosts[page.pgNumber] = pool.out.PushFront(page.pgNumber)
+			if pool.out.Len() > pool.outSize {
+				oldest := pool.out.Back()
+				pool.out.Remove(oldest)
+				delete(pool.ghosts, oldest.Value.(uint32))
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (pool *bufferPool) remove(elem *list.Element) {
+	page := elem.Value.(*poolPage)
+	pool.queueOf(page).Remove(elem)
+	delete(pool.pages, page.pgNumber)
+	if pool.onEvict != nil {
+		pool.onEvict(page.pgNumber, page.data)
+	}
+}
+
+// Drop a page even if it is pinned
+func (pool *bufferPool) Remove(pgNumber uint32) {
+	if elem, ok := pool.pages[pgNumber]; ok {
+		pool.remove(elem)
+	}
+}
+
+// Drop every page, pins are dropped with them
+func (pool *bufferPool) Purge() {
+	for _, elem := range pool.pages {
+		pool.remove(elem)
+	}
+	pool.out.Init()
+	pool.ghosts = map[uint32]*list.Element{}
+}
+
+func (pool *bufferPool) Keys() []uint32 {
+	keys := make([]uint32, 0, len(pool.pages))
+	for pgNumber := range pool.pages {
+		keys = append(keys, pgNumber)
+	}
+	return keys
+}
+
+func (pool *bufferPool) Len() int {
+	return len(pool.pages)
+}
+
+// Keep a cached page from being replaced, pins are counted
+func (pool *bufferPool) Pin(pgNumber uint32) bool {
+	elem, ok := pool.pages[pgNumber]
+	if !ok {
+		return false
+	}
+	elem.Value.(*poolPage).pins++
+	return true
+}
+
+// Pages over the size are replaced once they are not pinned
+func (pool *bufferPool) Unpin(pgNumber uint32) bool {
+	elem, ok := pool.pages[pgNumber]
+	if !ok || elem.Value.(*poolPage).pins == 0 {
+		return false
+	}
+	elem.Value.(*poolPage).pins--
+	pool.evict()
+	return true
+}
+
+func (pool *bufferPool) Pinned() int {
+	pinned := 0
+	for _, elem := range pool.pages {
+		if elem.Value.(*poolPage).pins > 0 {
+			pinned++
+		}
+	}
+	return pinned
+}
@@ -0,0 +1,99 @@
+package pager
+
+import "testing"
+
+func TestBufferPoolPinning(t *testing.T) {
+	evicted := map[uint32]bool{}
+	pool := newBufferPool(4, func(pgNumber uint32, data []byte) {
+		evicted[pgNumber] = true
+	})
+	for i := uint32(0); i < 4; i++ {
+		pool.Add(i, []byte{byte(i)})
+		pool.Pin(i)
+	}
+	pool.Add(4, []byte{4})
+	pool.Add(5, []byte{5})
+	for i := uint32(0); i < 4; i++ {
+		if evicted[i] || !pool.Contains(i) {
+			t.Errorf("Pinned page %d evicted", i)
+		}
+	}
+	if pool.Len() != 5 || pool.Pinned() != 4 {
+		t.Errorf("Wrong pool size %d with %d pinned", pool.Len(), pool.Pinned())
+	}
+	pool.Unpin(0)
+	if pool.Contains(0) || pool.Len() != 4 {
+		t.Errorf("Unpinned page kept beyond the pool size")
+	}
+	if pool.Unpin(0) {
+		t.Error("Unpin of a page not cached")
+	}
+}
+
+func TestBufferPoolScanResistance(t *testing.T) {
+	pool := newBufferPool(32, nil)
+	for i := uint32(0); i < 8; i++ {
+		pool.Add(i, []byte{byte(i)})
+	}
+	for i := uint32(100); i < 132; i++ {
+		pool.Add(i, []byte{byte(i)})
+	}
+	//Pages read again soon after they are replaced become hot
+	for i := uint32(0); i < 8; i++ {
+		if pool.Contains(i) {
+			t.Errorf("Page %d read once kept over newer pages", i)
+		}
+		pool.Add(i, []byte{byte(i)})
+	}
+	//A scan bigger than the pool only flushes the pages read once
+	for i := uint32(1000); i < 1100; i++ {
+		pool.Add(i, []byte{byte(i)})
+	}
+	for i := uint32(0); i < 8; i++ {
+		if !pool.Contains(i) {
+			t.Errorf("Hot page %d flushed by scan", i)
+		}
+	}
+}
+
+func TestFetchPage(t *testing.T) {
+	filename := ":memory:test_fetch_page.gsdl"
+	removeTestDb(filename)
+	SetCacheSize(filename, 4)
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	for i := 0; i < 8; i++ {
+		testWritePage(t, wt, uint32(i), 1)
+	}
+	wt.EndTransaction()
+	wt.StartTransaction(filename)
+	data, err := wt.FetchPage(2)
+	if err != nil {
+		t.Fatalf("Cannot fetch page %v", err)
+	}
+	data[0] = 2
+	//Enough pages to evict the page if it were not pinned
+	for i := 3; i < 8; i++ {
+		wt.ReadPage(uint32(i))
+	}
+	if stats := wt.Stats(); stats.PinnedPages != 1 {
+		t.Errorf("Wrong number of pinned pages %d", stats.PinnedPages)
+	}
+	if err := wt.UnpinPage(2, true); err != nil {
+		t.Errorf("Cannot unpin page %v", err)
+	}
+	if err := wt.UnpinPage(2, true); err == nil {
+		t.Error("Page unpinned twice")
+	}
+	for i := 3; i < 8; i++ {
+		wt.ReadPage(uint32(i))
+	}
+	wt.EndTransaction()
+	rt := &ReadTransaction{}
+	rt.StartTransaction(filename)
+	defer rt.EndTransaction()
+	data, _ = rt.ReadPage(2)
+	if data[0] != 2 || data[1] != 1 {
+		t.Errorf("Change of pinned page lost, get %d %d", data[0], data[1])
+	}
+}
@@ -0,0 +1,214 @@
+package pager
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const CHANGES_SUFFIX string = "-changes"
+
+const changesMagic uint32 = 0x43475347
+
+const changesHeaderSize int64 = 16
+
+// Commit number of the last change of each page, kept beside the database while change tracking is on
+// The file starts with the magic and the number of the last commit, followed by the number of each page
+// A commit is recorded before it is made durable, so the file may count a page changed when it is not, but never the other way
+type changeTracker struct {
+	filename string
+	file     Storage
+	lsn      uint64
+	pages    []uint64
+}
+
+func changesFilename(filename string) string {
+	return filename + CHANGES_SUFFIX
+}
+
+func hasChangeTracking(filename string) bool {
+	return storageExists(changesFilename(filename))
+}
+
+func openChangeTracker(filename string) (*changeTracker, error) {
+	file, err := openStorage(changesFilename(filename), false)
+	if err != nil {
+		return nil, err
+	}
+	t := &changeTracker{filename: filename, file: file}
+	if err1 := t.load(); err1 != nil {
+		file.Close()
+		return nil, err1
+	}
+	return t, nil
+}
+
+// Read the commit numbers from the file, other processes committing to the database write them too
+func (t *changeTracker) load() error {
+	size, err1 := t.file.Size()
+	if err1 != nil {
+		return err1
+	}
+	data := make([]byte, size)
+	if _, err2 := t.file.ReadAt(data, 0); err2 != nil && err2 != io.EOF {
+		return err2
+	}
+	if size < changesHeaderSize || binary.LittleEndian.Uint32(data[0:4]) != changesMagic {
+		return &PageIOError{t.filename, "bad change tracking file"}
+	}
+	t.lsn = binary.LittleEndian.Uint64(data[8:16])
+	t.pages = make([]uint64, (size-changesHeaderSize)/8)
+	for i := range t.pages {
+		t.pages[i] = binary.LittleEndian.Uint64(data[changesHeaderSize+int64(i)*8:])
+	}
+	return nil
+}
+
+// Number of the last commit in the file, ahead of lsn after another process committed to the database
+func (t *changeTracker) fileLsn() (uint64, error) {
+	header := make([]byte, changesHeaderSize)
+	if _, err := t.file.ReadAt(header, 0); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(header[8:16]), nil
+}
+
+// Start tracking the changes of a database at commit number lsn, no page is counted changed yet
+func createChangeTracker(filename string, lsn uint64) (*changeTracker, error) {
+	file, err1 := openStorage(changesFilename(filename), true)
+	if err1 != nil {
+		return nil, err1
+	}
+	t := &changeTracker{filename: filename, file: file}
+	if err2 := file.Truncate(0); err2 != nil {
+		file.Close()
+		return nil, err2
+	}
+	if err3 := t.record(nil, lsn, true); err3 != nil {
+		file.Close()
+		return nil, err3
+	}
+	if err4 := syncDir(changesFilename(filename)); err4 != nil {
+		file.Close()
+		return nil, err4
+	}
+	return t, nil
+}
+
+// Count the pages changed by commit lsn, the pages are written before the commit number
+func (t *changeTracker) record(pgNumbers []uint32, lsn uint64, sync bool) error {
+	entry := make([]byte, 8)
+	binary.LittleEndian.PutUint64(entry, lsn)
+	for _, pgNumber := range pgNumbers {
+		if _, err := t.file.WriteAt(entry, changesHeaderSize+int64(pgNumber)*8); err != nil {
+			return err
+		}
+		if int(pgNumber) >= len(t.pages) {
+			t.pages = append(t.pages, make([]uint64, int(pgNumber)+1-len(t.pages))...)
+		}
+		t.pages[pgNumber] = lsn
+	}
+	header := make([]byte, changesHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], changesMagic)
+	binary.LittleEndian.PutUint64(header[8:16], lsn)
+	if _, err := t.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	t.lsn = lsn
+	if !sync {
+		return nil
+	}
+	return t.file.Sync()
+}
+
+func (t *changeTracker) changedSince(pgNumber uint32, lsn uint64) bool {
+	return int(pgNumber) < len(t.pages) && t.pages[pgNumber] > lsn
+}
+
+func (t *changeTracker) close() error {
+	return t.file.Close()
+}
+
+// Record the pages of the commit being made, must be called before the commit is durable
+func (pager *Pager) trackCommitLocked(pgNumbers []uint32) error {
+	t := pager.tracker
+	if t == nil {
+		return nil
+	}
+	//The numbers go on from the commits of other processes, the write lock keeps them out now
+	fileLsn, err := t.fileLsn()
+	if err != nil {
+		return err
+	} else if fileLsn != t.lsn {
+		if err1 := t.load(); err1 != nil {
+			return err1
+		}
+	}
+	lsn := t.lsn + 1
+	if pager.restoreLsn > lsn {
+		//A restored backup takes the number of the backup applied
+		lsn = pager.restoreLsn
+	}
+	pager.restoreLsn = 0
+	return t.record(pgNumbers, lsn, pager.synchronous != SYNCHRONOUS_OFF)
+}
+
+// Track the changes of a database from now on, so backups of it can be incremental
+func EnableChangeTracking(filename string) error {
+	unlock, err := lockDatabaseAlone(filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	pager := getPagerManager().OpenPager(filename, nil)
+	defer getPagerManager().ClosePager(filename)
+	return pager.enableChangeTracking()
+}
+
+// Track the changes of the database from the commit of this transaction on, other commits wait for the writer
+func (transaction *WriteTransaction) EnableChangeTracking() error {
+	return transaction.pager.enableChangeTracking()
+}
+
+func (pager *Pager) enableChangeTracking() error {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	if pager.err != nil {
+		return pager.err
+	} else if pager.tracker != nil {
+		return nil
+	}
+	t, err := createChangeTracker(pager.filename, 1)
+	if err != nil {
+		return err
+	}
+	pager.tracker = t
+	return nil
+}
+
+// Number of the last commit of a database with change tracking on, a backup copied from it is known by the number
+// Incremental backups copy the pages changed after the number of an older backup
+func BackupId(filename string) (uint64, error) {
+	rt := &ReadTransaction{}
+	if err := rt.StartTransaction(filename); err != nil {
+		return 0, err
+	}
+	defer rt.EndTransaction()
+	rt.pager.lock.Lock()
+	defer rt.pager.lock.Unlock()
+	if rt.pager.tracker == nil {
+		return 0, &PageIOError{filename, "change tracking is off"}
+	}
+	return rt.pager.trackedLsnLocked()
+}
+
+// Number of the last commit recorded by the pager, must be called while the database is locked
+// Fails if another process committed since the pager was opened, the pages cached by the pager miss that commit
+func (pager *Pager) trackedLsnLocked() (uint64, error) {
+	lsn, err := pager.tracker.fileLsn()
+	if err != nil {
+		return 0, err
+	} else if lsn != pager.tracker.lsn {
+		return 0, &PageIOError{pager.filename, "database changed by another process"}
+	}
+	return lsn, nil
+}
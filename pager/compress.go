@@ -0,0 +1,388 @@
+package pager
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// A compressed database file starts with this magic, plain files start with page 0
+const compressMagic uint32 = 0x5a445347
+
+const slotMagic uint32 = 0x544f4c53
+
+const freeSlotMagic uint32 = 0x45455246
+
+// Slots start on this boundary, so a slot header never crosses a disk sector
+const slotUnit int64 = 256
+
+const slotHeaderSize int64 = 28
+
+// Compressed pages are kept in variable-size slots, each slot is the magic, the capacity of the slot,
+// the page number, the length of the compressed page, a sequence number and a crc32 checksum,
+// followed by the page compressed with flate, see encodeSlotPage
+// A page is never overwritten in place, the new image goes to another slot and the slot with the
+// highest sequence number wins when the file is opened, so a torn write leaves the old image
+type slotFile struct {
+	file     Storage
+	stats    *PagerStats
+	end      int64
+	seq      uint64
+	numPages uint32
+	live     map[uint32]*pageSlot
+	//Superseded slots are only reused after the slot replacing them is synced
+	stale []*pageSlot
+	free  []*pageSlot
+}
+
+type pageSlot struct {
+	offset   int64
+	capacity int64
+	length   int64
+	pgNumber uint32
+	seq      uint64
+	//The header still holds a page, it is cleared before the page is cut off
+	hasPage bool
+}
+
+func isCompressedFile(file Storage) (bool, error) {
+	header := make([]byte, 4)
+	if _, err := file.ReadAt(header, 0); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return binary.LittleEndian.Uint32(header) == compressMagic, nil
+}
+
+// True if the database file is compressed, a file not written yet is not
+func IsCompressed(filename string) (bool, error) {
+	file, err := openStorage(filename, false)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	return isCompressedFile(file)
+}
+
+// Start a compressed file, the file must be empty
+func createSlotFile(file Storage, stats *PagerStats) (*slotFile, error) {
+	header := make([]byte, slotUnit)
+	binary.LittleEndian.PutUint32(header, compressMagic)
+	if _, err := file.WriteAt(header, 0); err != nil {
+		return nil, err
+	}
+	stats.addWrite(len(header))
+	return &slotFile{
+		file:  file,
+		stats: stats,
+		end:   slotUnit,
+		live:  map[uint32]*pageSlot{},
+	}, nil
+}
+
+func slotChecksum(header []byte, payload []byte) uint32 {
+	return crc32.Update(crc32.Checksum(header[8:24], crcTable), crcTable, payload)
+}
+
+// Scan the slots of a compressed file to find the latest image of every page
+func loadSlotFile(file Storage, stats *PagerStats) (*slotFile, error) {
+	size, err1 := file.Size()
+	if err1 != nil {
+		return nil, err1
+	}
+	s := &slotFile{
+		file:  file,
+		stats: stats,
+		end:   slotUnit,
+		live:  map[uint32]*pageSlot{},
+	}
+	header := make([]byte, slotHeaderSize)
+	for s.end+slotHeaderSize <= size {
+		if _, err2 := file.ReadAt(header, s.end); err2 != nil {
+			return nil, err2
+		}
+		stats.addRead(len(header))
+		magic := binary.LittleEndian.Uint32(header[0:4])
+		slot := &pageSlot{
+			offset:   s.end,
+			capacity: int64(binary.LittleEndian.Uint32(header[4:8])),
+		}
+		if (magic != slotMagic && magic != freeSlotMagic) ||
+			slot.capacity == 0 || slot.capacity%slotUnit != 0 || slot.offset+slot.capacity > size {
+			//An append torn by a crash, the next slot is written over it
+			break
+		}
+		s.end += slot.capacity
+		if magic == slotMagic {
+			slot.length = int64(binary.LittleEndian.Uint32(header[12:16]))
+			if slotHeaderSize+slot.length <= slot.capacity {
+				payload := make([]byte, slot.length)
+				if _, err3 := file.ReadAt(payload, slot.offset+slotHeaderSize); err3 != nil {
+					return nil, err3
+				}
+				stats.addRead(len(payload))
+				slot.hasPage = binary.LittleEndian.Uint32(header[24:28]) == slotChecksum(header, payload)
+			}
+		}
+		if !slot.hasPage {
+			s.free = append(s.free, slot)
+			continue
+		}
+		slot.pgNumber = binary.LittleEndian.Uint32(header[8:12])
+		slot.seq = binary.LittleEndian.Uint64(header[16:24])
+		if slot.seq > s.seq {
+			s.seq = slot.seq
+		}
+		old, ok := s.live[slot.pgNumber]
+		if ok && old.seq > slot.seq {
+			s.stale = append(s.stale, slot)
+			continue
+		} else if ok {
+			s.stale = append(s.stale, old)
+		}
+		s.live[slot.pgNumber] = slot
+		if slot.pgNumber >= s.numPages {
+			s.numPages = slot.pgNumber + 1
+		}
+	}
+	return s, nil
+}
+
+// Returns the stored page as written by writePage, nil for pages never written
+func (s *slotFile) readPage(pgNumber uint32) ([]byte, error) {
+	if pgNumber >= s.numPages {
+		return nil, io.EOF
+	}
+	slot, ok := s.live[pgNumber]
+	if !ok {
+		return nil, nil
+	}
+	payload := make([]byte, slot.length)
+	if _, err := s.file.ReadAt(payload, slot.offset+slotHeaderSize); err != nil {
+		return nil, err
+	}
+	s.stats.addRead(len(payload))
+	return payload, nil
+}
+
+func deflatePage(data []byte) []byte {
+	var buf bytes.Buffer
+	writer, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	writer.Write(data)
+	writer.Close()
+	return buf.Bytes()
+}
+
+func inflatePage(filename string, payload []byte, pgNumber uint32) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(payload))
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, MakeCorruptionError(filename, pgNumber, "cannot inflate page")
+	}
+	return data, nil
+}
+
+// Pages are compressed before they are sealed, sealed pages do not compress
+// Plain pages are compressed with their trailer
+func encodeSlotPage(c *pageCipher, data []byte, pgNumber uint32) []byte {
+	if c == nil {
+		return deflatePage(encodePage(nil, data, pgNumber))
+	}
+	return encodePage(c, deflatePage(data), pgNumber)
+}
+
+func decodeSlotPage(filename string, c *pageCipher, payload []byte, pgNumber uint32) ([]byte, error) {
+	if c == nil {
+		raw, err := inflatePage(filename, payload, pgNumber)
+		if err != nil {
+			return nil, err
+		}
+		return decodePage(filename, nil, raw, pgNumber)
+	}
+	compressed, err := decodePage(filename, c, payload, pgNumber)
+	if err != nil {
+		return nil, err
+	}
+	return inflatePage(filename, compressed, pgNumber)
+}
+
+func slotCapacity(recordSize int) int64 {
+	return (int64(recordSize) + slotUnit - 1) / slotUnit * slotUnit
+}
+
+// The payload is the page encoded by encodeSlotPage
+func (s *slotFile) writePage(payload []byte, pgNumber uint32) error {
+	record := make([]byte, slotHeaderSize, slotHeaderSize+int64(len(payload)))
+	record = append(record, payload...)
+	capacity := slotCapacity(len(record))
+	slot := s.takeFreeSlot(capacity, s.end)
+	if slot == nil {
+		slot = &pageSlot{offset: s.end, capacity: capacity}
+		s.end += capacity
+	}
+	return s.writeSlot(slot, pgNumber, record)
+}
+
+// Write the record of a page into the slot, the record is room for the header followed by the payload
+func (s *slotFile) writeSlot(slot *pageSlot, pgNumber uint32, record []byte) error {
+	length := int64(len(record)) - slotHeaderSize
+	s.seq++
+	slot.length = length
+	slot.pgNumber = pgNumber
+	slot.seq = s.seq
+	//Appended slots are written whole, so the scan on open can step over them
+	if int64(len(record)) < slot.capacity && slot.offset+slot.capacity == s.end {
+		record = append(record, make([]byte, slot.capacity-int64(len(record)))...)
+	}
+	binary.LittleEndian.PutUint32(record[0:4], slotMagic)
+	binary.LittleEndian.PutUint32(record[4:8], uint32(slot.capacity))
+	binary.LittleEndian.PutUint32(record[8:12], pgNumber)
+	binary.LittleEndian.PutUint32(record[12:16], uint32(length))
+	binary.LittleEndian.PutUint64(record[16:24], slot.seq)
+	binary.LittleEndian.PutUint32(record[24:28], slotChecksum(record, record[slotHeaderSize:slotHeaderSize+length]))
+	n, err := s.file.WriteAt(record, slot.offset)
+	s.stats.addWrite(n)
+	if err != nil {
+		s.free = append(s.free, slot)
+		return err
+	}
+	slot.hasPage = true
+	if old, ok := s.live[pgNumber]; ok {
+		s.stale = append(s.stale, old)
+	}
+	s.live[pgNumber] = slot
+	if pgNumber >= s.numPages {
+		s.numPages = pgNumber + 1
+	}
+	return nil
+}
+
+// The smallest free slot before the offset the compressed page fits in, the first one of the file among equal ones
+func (s *slotFile) takeFreeSlot(capacity int64, before int64) *pageSlot {
+	best := -1
+	for i, slot := range s.free {
+		if slot.capacity < capacity || slot.offset >= before {
+			continue
+		}
+		if best < 0 || slot.capacity < s.free[best].capacity ||
+			(slot.capacity == s.free[best].capacity && slot.offset < s.free[best].offset) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	slot := s.free[best]
+	s.free = append(s.free[:best], s.free[best+1:]...)
+	return slot
+}
+
+// Cut the file to numPages pages, the slots of the pages cut off are cleared from the oldest image,
+// so a crash in the middle never brings back an image older than the one it had
+// An empty last page is written with the payload if the last page was never written
+func (s *slotFile) truncate(numPages uint32, emptyLast []byte) error {
+	var cut []*pageSlot
+	for _, slots := range [][]*pageSlot{s.stale, s.free} {
+		for _, slot := range slots {
+			if slot.hasPage && slot.pgNumber >= numPages {
+				cut = append(cut, slot)
+			}
+		}
+	}
+	for pgNumber, slot := range s.live {
+		if pgNumber >= numPages {
+			cut = append(cut, slot)
+		}
+	}
+	sort.Slice(cut, func(i, j int) bool {
+		return cut[i].seq < cut[j].seq
+	})
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header[0:4], freeSlotMagic)
+	for _, slot := range cut {
+		binary.LittleEndian.PutUint32(header[4:8], uint32(slot.capacity))
+		n, err := s.file.WriteAt(header, slot.offset)
+		s.stats.addWrite(n)
+		if err != nil {
+			return err
+		}
+		slot.hasPage = false
+		if s.live[slot.pgNumber] == slot {
+			delete(s.live, slot.pgNumber)
+			s.free = append(s.free, slot)
+		}
+	}
+	s.numPages = numPages
+	//The last page is kept in a slot, the number of pages is found from it on open
+	if _, ok := s.live[numPages-1]; numPages > 0 && !ok {
+		if err := s.writePage(emptyLast, numPages-1); err != nil {
+			return err
+		}
+	}
+	return s.shrink()
+}
+
+// Move the pages at the end of the file into free slots before them and cut the free slots left at the end off the file
+// The moved images are synced before the slots they were in are cut off
+func (s *slotFile) shrink() error {
+	if err1 := s.sync(); err1 != nil {
+		return err1
+	}
+	live := make([]*pageSlot, 0, len(s.live))
+	for _, slot := range s.live {
+		live = append(live, slot)
+	}
+	sort.Slice(live, func(i, j int) bool {
+		return live[i].offset > live[j].offset
+	})
+	for _, last := range live {
+		record := make([]byte, slotHeaderSize+last.length)
+		slot := s.takeFreeSlot(slotCapacity(len(record)), last.offset)
+		if slot == nil {
+			break
+		}
+		if _, err2 := s.file.ReadAt(record[slotHeaderSize:], last.offset+slotHeaderSize); err2 != nil {
+			s.free = append(s.free, slot)
+			return err2
+		}
+		s.stats.addRead(int(last.length))
+		if err3 := s.writeSlot(slot, last.pgNumber, record); err3 != nil {
+			return err3
+		}
+	}
+	if err4 := s.sync(); err4 != nil {
+		return err4
+	}
+	end := slotUnit
+	for _, slot := range s.live {
+		if slot.offset+slot.capacity > end {
+			end = slot.offset + slot.capacity
+		}
+	}
+	free := s.free[:0]
+	for _, slot := range s.free {
+		if slot.offset < end {
+			free = append(free, slot)
+		}
+	}
+	s.free = free
+	s.end = end
+	return s.file.Truncate(end)
+}
+
+func (s *slotFile) sync() error {
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	s.free = append(s.free, s.stale...)
+	s.stale = nil
+	return nil
+}
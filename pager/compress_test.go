@@ -0,0 +1,85 @@
+package pager
+
+import (
+	"io"
+	"testing"
+)
+
+func TestCompressedPages(t *testing.T) {
+	filename := ":memory:test_compress.gsdl"
+	removeTestDb(filename)
+	SetCompression(filename, true)
+	defer SetCompression(filename, false)
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	for i := 0; i < 16; i++ {
+		data := make([]byte, PGSIZE)
+		data[0] = byte(i)
+		wt.WritePage(uint32(i), data)
+	}
+	if err := wt.EndTransaction(); err != nil {
+		t.Fatalf("Cannot commit %v", err)
+	}
+	file, _ := openStorage(filename, false)
+	if size, _ := file.Size(); size >= 16*int64(PGSIZE) {
+		t.Errorf("Pages not compressed, file size %d", size)
+	}
+	//Pages written beyond the end are cut off again by the rollback
+	wt.StartTransaction(filename)
+	for i := 8; i < 20; i++ {
+		data := make([]byte, PGSIZE)
+		data[0] = 0xff
+		wt.WritePage(uint32(i), data)
+	}
+	wt.Sync()
+	wt.AbortTransaction()
+	wt.EndTransaction()
+	if n, _ := countPages(filename); n != 16 {
+		t.Errorf("Wrong number of pages after rollback %d", n)
+	}
+	rt := &ReadTransaction{}
+	rt.StartTransaction(filename)
+	for i := 0; i < 16; i++ {
+		data, err := rt.ReadPage(uint32(i))
+		if err != nil || data[0] != byte(i) {
+			t.Errorf("Wrong page %d read back %v", i, err)
+		}
+	}
+	rt.EndTransaction()
+	//Pages rewritten after the rollback left their slots at the end, the cut moves the kept pages down
+	wt.StartTransaction(filename)
+	for i := 0; i < 4; i++ {
+		data := make([]byte, PGSIZE)
+		data[0] = byte(i)
+		wt.WritePage(uint32(i), data)
+	}
+	wt.Sync()
+	wt.Truncate(4)
+	if err := wt.EndTransaction(); err != nil {
+		t.Fatalf("Cannot commit truncate %v", err)
+	}
+	file, _ = openStorage(filename, false)
+	if size, _ := file.Size(); size > 5*slotUnit {
+		t.Errorf("Free slots not cut off, file size %d", size)
+	}
+	file.Close()
+	f := openPageFile(filename, 0, nil)
+	defer f.close()
+	for i := uint32(0); i < 5; i++ {
+		data, err := f.loadPage(i)
+		if i == 4 && err != io.EOF {
+			t.Errorf("Page beyond the end read, %v", err)
+		} else if i < 4 && (err != nil || data[0] != byte(i)) {
+			t.Errorf("Wrong page %d after truncate %v", i, err)
+		}
+	}
+	//The gap before a page written beyond the end is kept in slots
+	if err := f.writePage(make([]byte, PGSIZE), 7); err != nil {
+		t.Fatalf("Cannot write beyond the end %v", err)
+	}
+	for i := uint32(4); i < 7; i++ {
+		if data, err := f.loadPage(i); err != nil || data[0] != 0 {
+			t.Errorf("Wrong page %d of the gap %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package pager
+
+import (
+	"fmt"
+	"sync"
+)
+
+const MIN_PGSIZE uint32 = 1024
+
+const MAX_PGSIZE uint32 = 65536
+
+// Page size and cache size of a file, they are read from the database header by the user of the pager
+type fileConfig struct {
+	pageSize  uint32
+	cacheSize int
+	mmapSize  int64
+	compress  bool
+	cipher    *pageCipher
+	//Level used by transactions which do not set their own
+	synchronous uint8
+	//Pages are kept without the trailer, as in files written before pages had one
+	noTrailers bool
+}
+
+var fileConfigs map[string]fileConfig = map[string]fileConfig{}
+var fileConfigLock sync.Mutex
+
+func getFileConfig(filename string) fileConfig {
+	fileConfigLock.Lock()
+	defer fileConfigLock.Unlock()
+	config, ok := fileConfigs[filename]
+	if !ok {
+		return fileConfig{PGSIZE, defaultCacheSize, 0, false, nil, SYNCHRONOUS_FULL, false}
+	}
+	return config
+}
+
+// Set the page size of a file, files not set use PGSIZE
+// The page size cannot change while the file is opened by a transaction
+func SetPageSize(filename string, pgSize uint32) error {
+	if pgSize < MIN_PGSIZE || pgSize > MAX_PGSIZE || pgSize&(pgSize-1) != 0 {
+		return &PageIOError{filename, fmt.Sprintf("page size %d is not a power of two from %d to %d", pgSize, MIN_PGSIZE, MAX_PGSIZE)}
+	}
+	config := getFileConfig(filename)
+	if config.pageSize == pgSize {
+		return nil
+	}
+	if getPagerManager().isOpen(filename) {
+		return &PageIOError{filename, "cannot change page size of an open file"}
+	}
+	config.pageSize = pgSize
+	fileConfigLock.Lock()
+	defer fileConfigLock.Unlock()
+	fileConfigs[filename] = config
+	return nil
+}
+
+// Set the number of pages cached for a file, takes effect the next time the file is opened
+func SetCacheSize(filename string, numPages int) error {
+	if numPages <= 0 {
+		return &PageIOError{filename, "cache size must be positive"}
+	}
+	config := getFileConfig(filename)
+	config.cacheSize = numPages
+	fileConfigLock.Lock()
+	defer fileConfigLock.Unlock()
+	fileConfigs[filename] = config
+	return nil
+}
+
+// Read pages through a read-only mapping of the first size bytes of the file, 0 turns it off
+// Takes effect the next time the file is opened
+func SetMmapSize(filename string, size int64) error {
+	if size < 0 {
+		return &PageIOError{filename, "mmap size cannot be negative"}
+	}
+	config := getFileConfig(filename)
+	config.mmapSize = size
+	fileConfigLock.Lock()
+	defer fileConfigLock.Unlock()
+	fileConfigs[filename] = config
+	return nil
+}
+
+// Keep the pages of a file compressed, only takes effect when the file is created
+func SetCompression(filename string, compress bool) error {
+	config := getFileConfig(filename)
+	if config.compress == compress {
+		return nil
+	}
+	if getPagerManager().isOpen(filename) {
+		return &PageIOError{filename, "cannot change compression of an open file"}
+	}
+	config.compress = compress
+	fileConfigLock.Lock()
+	defer fileConfigLock.Unlock()
+	fileConfigs[filename] = config
+	return nil
+}
+
+// Set the key pages of a file are encrypted with, an AES key of 16, 24 or 32 bytes or nil for plain pages
+// The key cannot change while the file is opened, use Rekey to encrypt a database with another key
+func SetKey(filename string, key []byte) error {
+	config := getFileConfig(filename)
+	if config.cipher.sameKey(key) {
+		return nil
+	}
+	if getPagerManager().isOpen(filename) {
+		return &PageIOError{filename, "cannot change key of an open file"}
+	}
+	c, err := newPageCipher(filename, key)
+	if err != nil {
+		return err
+	}
+	setFileCipher(filename, c)
+	return nil
+}
+
+func setFileCipher(filename string, c *pageCipher) {
+	fileConfigLock.Lock()
+	defer fileConfigLock.Unlock()
+	config, ok := fileConfigs[filename]
+	if !ok {
+		config = fileConfig{PGSIZE, defaultCacheSize, 0, false, nil, SYNCHRONOUS_FULL, false}
+	}
+	config.cipher = c
+	fileConfigs[filename] = config
+}
+
+func fileCipher(filename string) *pageCipher {
+	return getFileConfig(filename).cipher
+}
+
+func PageSize(filename string) uint32 {
+	return getFileConfig(filename).pageSize
+}
+
+// Keep the pages of a file with the trailer or without it, files written before pages had a trailer are read without it
+// Cannot change while the file is opened, see HasPageTrailers
+func SetPageTrailers(filename string, trailers bool) error {
+	config := getFileConfig(filename)
+	if config.noTrailers == !trailers {
+		return nil
+	}
+	if getPagerManager().isOpen(filename) {
+		return &PageIOError{filename, "cannot change page trailers of an open file"}
+	}
+	config.noTrailers = !trailers
+	fileConfigLock.Lock()
+	defer fileConfigLock.Unlock()
+	fileConfigs[filename] = config
+	return nil
+}
+
+func hasPageTrailers(filename string) bool {
+	return !getFileConfig(filename).noTrailers
+}
+
+func diskPageSize(filename string) uint32 {
+	if !hasPageTrailers(filename) {
+		return PageSize(filename)
+	}
+	return PageSize(filename) + fileCipher(filename).trailerSize()
+}
+
+// Read the start of the file without knowing its page size
+// Users keep their header at the start of page 0, so the page size can be found before the file is opened
+func ReadHeader(filename string, length int) ([]byte, error) {
+	f := openPageFile(filename, 0, nil)
+	defer f.close()
+	return f.readHeader(length)
+}
+
+// True unless the file was written before pages had a trailer, the page size must be set first
+func HasPageTrailers(filename string) (bool, error) {
+	f := openPageFile(filename, 0, nil)
+	defer f.close()
+	return f.hasTrailers()
+}
@@ -0,0 +1,177 @@
+package pager
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync/atomic"
+)
+
+// An encrypted page is sealed with AES-GCM and followed by the tag, the write counter and its page number
+// The nonce is the page number and the write counter, so a page moved to another place cannot be opened
+const ENCRYPTED_TRAILER_SIZE uint32 = 28
+
+const sealOverhead int = 24
+
+type pageCipher struct {
+	key  []byte
+	aead cipher.AEAD
+	//Starts at a random value for every key set, so nonces of different sessions never meet
+	counter uint64
+}
+
+// A nil key makes a nil cipher, which keeps pages plain
+func newPageCipher(filename string, key []byte) (*pageCipher, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	block, err1 := aes.NewCipher(key)
+	if err1 != nil {
+		return nil, &PageIOError{filename, fmt.Sprintf("bad key, %v", err1)}
+	}
+	aead, err2 := cipher.NewGCM(block)
+	if err2 != nil {
+		return nil, err2
+	}
+	c := &pageCipher{
+		key:  append([]byte(nil), key...),
+		aead: aead,
+	}
+	if err3 := binary.Read(rand.Reader, binary.LittleEndian, &c.counter); err3 != nil {
+		return nil, err3
+	}
+	return c, nil
+}
+
+func (c *pageCipher) sameKey(key []byte) bool {
+	if c == nil {
+		return len(key) == 0
+	}
+	return bytes.Equal(c.key, key)
+}
+
+func (c *pageCipher) trailerSize() uint32 {
+	if c == nil {
+		return PAGE_TRAILER_SIZE
+	}
+	return ENCRYPTED_TRAILER_SIZE
+}
+
+// Bytes a sealed page is longer than the page
+func (c *pageCipher) overhead() int {
+	if c == nil {
+		return 0
+	}
+	return sealOverhead
+}
+
+func pageNonce(pgNumber uint32, counter []byte) []byte {
+	nonce := make([]byte, 12)
+	binary.LittleEndian.PutUint32(nonce[0:4], pgNumber)
+	copy(nonce[4:], counter)
+	return nonce
+}
+
+// Returns the encrypted data followed by the tag and the write counter, a nil cipher returns the data
+func (c *pageCipher) seal(data []byte, pgNumber uint32) []byte {
+	if c == nil {
+		return data
+	}
+	counter := make([]byte, 8)
+	binary.LittleEndian.PutUint64(counter, atomic.AddUint64(&c.counter, 1))
+	sealed := c.aead.Seal(make([]byte, 0, len(data)+sealOverhead), pageNonce(pgNumber, counter), data, nil)
+	return append(sealed, counter...)
+}
+
+func (c *pageCipher) open(filename string, sealed []byte, pgNumber uint32) ([]byte, error) {
+	if c == nil {
+		return sealed, nil
+	}
+	if len(sealed) < sealOverhead {
+		return nil, MakeCorruptionError(filename, pgNumber, "encrypted page too short")
+	}
+	n := len(sealed) - 8
+	data, err := c.aead.Open(nil, pageNonce(pgNumber, sealed[n:]), sealed[:n], nil)
+	if err != nil {
+		return nil, MakeCorruptionError(filename, pgNumber, "cannot decrypt, wrong key or page changed")
+	}
+	return data, nil
+}
+
+// Encrypt every page of an encrypted database again with a new key
+// The old images are journaled first, so a crash in the middle leaves the database under the old key
+func Rekey(filename string, key []byte) error {
+	unlock, err := lockDatabaseAlone(filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	pager := getPagerManager().OpenPager(filename, nil)
+	defer getPagerManager().ClosePager(filename)
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	if pager.err != nil {
+		return pager.err
+	}
+	oldCipher := fileCipher(filename)
+	if oldCipher == nil || len(key) == 0 {
+		return &PageIOError{filename, "rekey needs an encrypted database and a new key"}
+	}
+	newCipher, err1 := newPageCipher(filename, key)
+	if err1 != nil {
+		return err1
+	}
+	if err2 := pager.checkpointLocked(); err2 != nil {
+		return err2
+	}
+	numPages, err3 := pager.file.numPages()
+	if err3 != nil {
+		return err3
+	}
+	j, err4 := openJournal(pager.file)
+	if err4 != nil {
+		return err4
+	}
+	if err5 := pager.rekeyPagesLocked(j, oldCipher, newCipher, numPages); err5 != nil {
+		j.close()
+		if _, err := pager.rollbackJournalLocked(); err != nil {
+			return err
+		}
+		return err5
+	}
+	//The journal holds pages under the old key, the new key is only taken once it is gone for good
+	if err6 := j.remove(); err6 != nil {
+		return err6
+	}
+	if err7 := syncDir(filename); err7 != nil {
+		return err7
+	}
+	setFileCipher(filename, newCipher)
+	return nil
+}
+
+func (pager *Pager) rekeyPagesLocked(j *journal, oldCipher *pageCipher, newCipher *pageCipher, numPages uint32) error {
+	pgNumbers := make([]uint32, numPages)
+	for i := range pgNumbers {
+		pgNumbers[i] = uint32(i)
+	}
+	if err1 := j.savePages(pgNumbers); err1 != nil {
+		return err1
+	}
+	if err2 := j.sync(); err2 != nil {
+		return err2
+	}
+	for _, pgNumber := range pgNumbers {
+		data, err3 := pager.file.loadPageWith(oldCipher, pgNumber)
+		if err3 != nil {
+			return err3
+		}
+		if err4 := pager.file.writePageWith(newCipher, data, pgNumber); err4 != nil {
+			return err4
+		}
+	}
+	return pager.file.sync()
+}
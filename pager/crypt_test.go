@@ -0,0 +1,120 @@
+package pager
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestEncryptedPages(t *testing.T) {
+	filename := ":memory:test_crypt.gsdl"
+	removeTestDb(filename)
+	oldKey := bytes.Repeat([]byte{1}, 16)
+	newKey := bytes.Repeat([]byte{2}, 32)
+	if err := SetKey(filename, []byte("short")); err == nil {
+		t.Error("Bad key accepted")
+	}
+	SetKey(filename, oldKey)
+	defer SetKey(filename, nil)
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	for i := 0; i < 4; i++ {
+		testWritePage(t, wt, uint32(i), 0x5a)
+	}
+	if err := wt.EndTransaction(); err != nil {
+		t.Fatalf("Cannot commit %v", err)
+	}
+	file, _ := openStorage(filename, false)
+	size, _ := file.Size()
+	raw := make([]byte, size)
+	file.ReadAt(raw, 0)
+	if bytes.Contains(raw, bytes.Repeat([]byte{0x5a}, 64)) {
+		t.Error("Plain page data found in encrypted file")
+	}
+	//A zeroed page is not authentic
+	file.WriteAt(make([]byte, diskPageSize(filename)), pageOffset(filename, 3))
+	if _, err := loadPage(filename, 3); err == nil {
+		t.Error("Zeroed encrypted page opened")
+	}
+	wt.StartTransaction(filename)
+	testWritePage(t, wt, 3, 0x5a)
+	wt.EndTransaction()
+	if err := Rekey(filename, newKey); err != nil {
+		t.Fatalf("Cannot rekey %v", err)
+	}
+	if storageExists(journalFilename(filename)) {
+		t.Error("Journal left after rekey")
+	}
+	SetKey(filename, oldKey)
+	if _, err := loadPage(filename, 0); err == nil {
+		t.Error("Page opened with old key after rekey")
+	}
+	SetKey(filename, newKey)
+	if _, err := ReadHeader(filename, 16); err != nil {
+		t.Errorf("Cannot read header %v", err)
+	}
+	//Frames of the log are sealed too
+	if err := SetJournalMode(filename, JOURNAL_MODE_WAL); err != nil {
+		t.Fatalf("Cannot change journal mode %v", err)
+	}
+	wt.StartTransaction(filename)
+	testWritePage(t, wt, 4, 0x5a)
+	wt.EndTransaction()
+	rt := &ReadTransaction{}
+	rt.StartTransaction(filename)
+	for i := 0; i < 5; i++ {
+		data, err := rt.ReadPage(uint32(i))
+		if err != nil || data[0] != 0x5a {
+			t.Errorf("Wrong page %d read back %v", i, err)
+		}
+	}
+	rt.EndTransaction()
+	SetJournalMode(filename, JOURNAL_MODE_ROLLBACK)
+}
+
+func TestEncryptedCompressedPages(t *testing.T) {
+	plain := ":memory:test_crypt_plain.gsdl"
+	filename := ":memory:test_crypt_compress.gsdl"
+	removeTestDb(plain)
+	removeTestDb(filename)
+	key := bytes.Repeat([]byte{3}, 16)
+	SetKey(filename, key)
+	defer SetKey(filename, nil)
+	SetCompression(filename, true)
+	defer SetCompression(filename, false)
+	for _, name := range []string{plain, filename} {
+		wt := &WriteTransaction{}
+		wt.StartTransaction(name)
+		for i := 0; i < 16; i++ {
+			data := bytes.Repeat([]byte(fmt.Sprintf("row %d ", i)), int(PGSIZE))[:PGSIZE]
+			wt.WritePage(uint32(i), data)
+		}
+		if err := wt.EndTransaction(); err != nil {
+			t.Fatalf("Cannot commit %v", err)
+		}
+	}
+	plainFile, _ := openStorage(plain, false)
+	plainSize, _ := plainFile.Size()
+	file, _ := openStorage(filename, false)
+	size, _ := file.Size()
+	if size >= plainSize {
+		t.Errorf("Encrypted compressed file of %d bytes not smaller than plain file of %d", size, plainSize)
+	}
+	raw := make([]byte, size)
+	file.ReadAt(raw, 0)
+	if bytes.Contains(raw, []byte("row 1 row 1 ")) {
+		t.Error("Plain page data found in encrypted file")
+	}
+	if err := Rekey(filename, bytes.Repeat([]byte{4}, 16)); err != nil {
+		t.Fatalf("Cannot rekey %v", err)
+	}
+	rt := &ReadTransaction{}
+	rt.StartTransaction(filename)
+	for i := 0; i < 16; i++ {
+		data, err := rt.ReadPage(uint32(i))
+		if err != nil || !bytes.HasPrefix(data, []byte(fmt.Sprintf("row %d ", i))) {
+			t.Errorf("Wrong page %d read back %v", i, err)
+		}
+	}
+	rt.EndTransaction()
+}
@@ -0,0 +1,236 @@
+package pager
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const deltaMagic uint32 = 0x49445347
+
+const deltaHeaderSize int64 = 40
+
+// A delta file holds the pages of a database changed between two backups
+// The header is the magic, the page size, the size of a stored page, the number of pages of the database,
+// the backup the delta starts after, the backup it makes, the number of pages stored and a crc32 checksum
+// Each page is stored as its page number and the page as it is written to the database file
+type deltaHeader struct {
+	pgSize   uint32
+	rawSize  uint32
+	numPages uint32
+	since    uint64
+	lsn      uint64
+	count    uint32
+}
+
+func (h *deltaHeader) toData() []byte {
+	data := make([]byte, deltaHeaderSize)
+	binary.LittleEndian.PutUint32(data[0:4], deltaMagic)
+	binary.LittleEndian.PutUint32(data[4:8], h.pgSize)
+	binary.LittleEndian.PutUint32(data[8:12], h.rawSize)
+	binary.LittleEndian.PutUint32(data[12:16], h.numPages)
+	binary.LittleEndian.PutUint64(data[16:24], h.since)
+	binary.LittleEndian.PutUint64(data[24:32], h.lsn)
+	binary.LittleEndian.PutUint32(data[32:36], h.count)
+	binary.LittleEndian.PutUint32(data[36:40], crc32.ChecksumIEEE(data[0:36]))
+	return data
+}
+
+func deltaHeaderFromData(filename string, data []byte) (*deltaHeader, error) {
+	if binary.LittleEndian.Uint32(data[0:4]) != deltaMagic ||
+		binary.LittleEndian.Uint32(data[36:40]) != crc32.ChecksumIEEE(data[0:36]) {
+		return nil, &PageIOError{filename, "bad delta file header"}
+	}
+	return &deltaHeader{
+		pgSize:   binary.LittleEndian.Uint32(data[4:8]),
+		rawSize:  binary.LittleEndian.Uint32(data[8:12]),
+		numPages: binary.LittleEndian.Uint32(data[12:16]),
+		since:    binary.LittleEndian.Uint64(data[16:24]),
+		lsn:      binary.LittleEndian.Uint64(data[24:32]),
+		count:    binary.LittleEndian.Uint32(data[32:36]),
+	}, nil
+}
+
+// Write the pages of src changed after backup since to the delta file dst, returns the id of the backup it makes
+// The pages are read in one read transaction, which is started again if src is changed by a commit before it is pinned
+func IncrementalBackup(src string, dst string, since uint64) (uint64, error) {
+	//The pager stays open between the tries, so its commits are counted
+	pager := getPagerManager().OpenPager(src, nil)
+	defer getPagerManager().ClosePager(src)
+	for i := 0; i < BACKUP_RETRY; i++ {
+		pager.lock.Lock()
+		changes := pager.changes
+		var lsn uint64
+		tracked := pager.tracker != nil
+		if tracked {
+			lsn = pager.tracker.lsn
+		}
+		pager.lock.Unlock()
+		if !tracked {
+			return 0, &PageIOError{src, "change tracking is off"}
+		} else if since > lsn {
+			return 0, &PageIOError{src, fmt.Sprintf("backup %d is newer than the database at %d", since, lsn)}
+		}
+		done, err := writeDelta(pager, dst, &deltaHeader{since: since, lsn: lsn}, changes)
+		if err != nil {
+			removeStorage(dst)
+			return 0, err
+		} else if done {
+			return lsn, nil
+		}
+	}
+	return 0, &BusyError{src}
+}
+
+// False if a commit has changed the source since changes was read
+func writeDelta(pager *Pager, dst string, header *deltaHeader, changes uint64) (bool, error) {
+	rt := &ReadTransaction{}
+	if err := rt.StartTransaction(pager.filename); err != nil {
+		return false, err
+	}
+	defer rt.EndTransaction()
+	pager.lock.Lock()
+	changed := pager.changes != changes
+	lsn, err := pager.trackedLsnLocked()
+	pager.lock.Unlock()
+	if err != nil {
+		return false, err
+	} else if changed || lsn != header.lsn {
+		return false, nil
+	}
+	numPages, err1 := rt.NumPages()
+	if err1 != nil {
+		return false, err1
+	}
+	//Pages changed by commits after the snapshot are taken too, their change may have started before
+	var pgNumbers []uint32
+	pager.lock.Lock()
+	for pgNumber := uint32(0); pgNumber < numPages; pgNumber++ {
+		if pager.tracker.changedSince(pgNumber, header.since) {
+			pgNumbers = append(pgNumbers, pgNumber)
+		}
+	}
+	pager.lock.Unlock()
+	file, err2 := openStorage(dst, true)
+	if err2 != nil {
+		return false, err2
+	}
+	defer file.Close()
+	if err3 := file.Truncate(0); err3 != nil {
+		return false, err3
+	}
+	header.pgSize = rt.PageSize()
+	header.rawSize = diskPageSize(pager.filename)
+	header.numPages = numPages
+	header.count = uint32(len(pgNumbers))
+	if _, err4 := file.WriteAt(header.toData(), 0); err4 != nil {
+		return false, err4
+	}
+	c := fileCipher(pager.filename)
+	offset := deltaHeaderSize
+	for _, pgNumber := range pgNumbers {
+		data, err5 := rt.ReadPage(pgNumber)
+		if err5 == io.EOF || os.IsNotExist(err5) {
+			data, err5 = make([]byte, header.pgSize), nil
+		}
+		if err5 != nil {
+			return false, err5
+		}
+		record := make([]byte, 4, 4+header.rawSize)
+		binary.LittleEndian.PutUint32(record, pgNumber)
+		record = append(record, encodePage(c, data, pgNumber)...)
+		if _, err6 := file.WriteAt(record, offset); err6 != nil {
+			return false, err6
+		}
+		offset += int64(len(record))
+	}
+	return true, file.Sync()
+}
+
+// Apply a delta file to a backup, which then takes the id of the backup the delta makes
+// The delta must start at or before the backup, deltas are applied in the order they were made
+func ApplyIncrementalBackup(filename string, delta string) error {
+	file, err1 := openStorage(delta, false)
+	if err1 != nil {
+		return err1
+	}
+	defer file.Close()
+	data := make([]byte, deltaHeaderSize)
+	if _, err2 := file.ReadAt(data, 0); err2 != nil {
+		return &PageIOError{delta, "bad delta file header"}
+	}
+	header, err3 := deltaHeaderFromData(delta, data)
+	if err3 != nil {
+		return err3
+	}
+	if header.pgSize != PageSize(filename) || header.rawSize != diskPageSize(filename) {
+		return &PageIOError{delta, "delta written with another page size or encryption"}
+	}
+	//The pager is kept open after the commit, so the backup id can be set if nothing was committed
+	pager := getPagerManager().OpenPager(filename, nil)
+	defer getPagerManager().ClosePager(filename)
+	wt := &WriteTransaction{}
+	if err4 := wt.StartTransaction(filename); err4 != nil {
+		return err4
+	}
+	pager.lock.Lock()
+	tracked := pager.tracker != nil
+	var lsn uint64
+	if tracked {
+		lsn = pager.tracker.lsn
+	}
+	pager.lock.Unlock()
+	if !tracked || header.since > lsn || header.lsn <= lsn {
+		wt.EndTransaction()
+		if !tracked {
+			return &PageIOError{filename, "change tracking is off"}
+		} else if header.since > lsn {
+			return &PageIOError{delta, fmt.Sprintf("delta starts after backup %d, not at or before %d", header.since, lsn)}
+		}
+		//Applied before
+		return nil
+	}
+	if err5 := applyDeltaPages(wt, file, delta, header); err5 != nil {
+		wt.AbortTransaction()
+		wt.EndTransaction()
+		return err5
+	}
+	pager.lock.Lock()
+	pager.restoreLsn = header.lsn
+	pager.lock.Unlock()
+	err6 := wt.EndTransaction()
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	pager.restoreLsn = 0
+	if err6 != nil {
+		return err6
+	}
+	//A delta without pages commits nothing
+	if pager.tracker.lsn < header.lsn {
+		return pager.tracker.record(nil, header.lsn, true)
+	}
+	return nil
+}
+
+func applyDeltaPages(wt *WriteTransaction, file Storage, delta string, header *deltaHeader) error {
+	c := fileCipher(wt.filename)
+	offset := deltaHeaderSize
+	record := make([]byte, 4+header.rawSize)
+	for i := uint32(0); i < header.count; i++ {
+		if _, err1 := file.ReadAt(record, offset); err1 != nil {
+			return &PageIOError{delta, fmt.Sprintf("cannot read page %d of %d, %v", i, header.count, err1)}
+		}
+		offset += int64(len(record))
+		pgNumber := binary.LittleEndian.Uint32(record[0:4])
+		data, err2 := decodePage(delta, c, append([]byte(nil), record[4:]...), pgNumber)
+		if err2 != nil {
+			return err2
+		}
+		if err3 := wt.WritePage(pgNumber, data); err3 != nil {
+			return err3
+		}
+	}
+	return wt.Truncate(header.numPages)
+}
@@ -0,0 +1,139 @@
+package pager
+
+import "testing"
+
+func testIncrementalBackup(t *testing.T, src string) {
+	full := src + "-full"
+	restored := src + "-restored"
+	deltas := []string{src + "-delta1", src + "-delta2"}
+	for _, name := range []string{full, restored} {
+		removeTestDb(name)
+		removeStorage(changesFilename(name))
+	}
+	if err := EnableChangeTracking(src); err != nil {
+		t.Fatalf("Cannot enable change tracking %v", err)
+	}
+	wt := &WriteTransaction{}
+	wt.StartTransaction(src)
+	for i := 0; i < 10; i++ {
+		testWritePage(t, wt, uint32(i), 1)
+	}
+	wt.EndTransaction()
+	if err := Backup(src, full); err != nil {
+		t.Fatalf("Cannot back up %v", err)
+	}
+	id, err := BackupId(full)
+	if err != nil {
+		t.Fatalf("No backup id %v", err)
+	}
+	wt.StartTransaction(src)
+	testWritePage(t, wt, 2, 2)
+	testWritePage(t, wt, 12, 2)
+	wt.EndTransaction()
+	if id, err = IncrementalBackup(src, deltas[0], id); err != nil {
+		t.Fatalf("Cannot write delta %v", err)
+	}
+	file, _ := openStorage(deltas[0], false)
+	data := make([]byte, deltaHeaderSize)
+	file.ReadAt(data, 0)
+	file.Close()
+	if header, err := deltaHeaderFromData(deltas[0], data); err != nil || header.count > 4 || header.numPages != 13 {
+		t.Errorf("Wrong delta header %v %v", header, err)
+	}
+	wt.StartTransaction(src)
+	wt.Truncate(6)
+	testWritePage(t, wt, 3, 3)
+	wt.EndTransaction()
+	if _, err := IncrementalBackup(src, deltas[1], id); err != nil {
+		t.Fatalf("Cannot write delta %v", err)
+	}
+	if err := Backup(full, restored); err != nil {
+		t.Fatalf("Cannot copy full backup %v", err)
+	}
+	if err := ApplyIncrementalBackup(restored, deltas[1]); err == nil {
+		t.Error("Delta applied before the one it follows")
+	}
+	for _, delta := range append(deltas, deltas[0]) {
+		if err := ApplyIncrementalBackup(restored, delta); err != nil {
+			t.Fatalf("Cannot apply delta %v", err)
+		}
+	}
+	srcId, _ := BackupId(src)
+	if restoredId, err := BackupId(restored); err != nil || restoredId != srcId {
+		t.Errorf("Wrong backup id of restored database, want %d get %d %v", srcId, restoredId, err)
+	}
+	rt := &ReadTransaction{}
+	rt.StartTransaction(restored)
+	defer rt.EndTransaction()
+	if n, _ := rt.NumPages(); n != 6 {
+		t.Errorf("Wrong number of pages of restored database %d", n)
+	}
+	expectPageValue(t, rt, 1, 1)
+	expectPageValue(t, rt, 2, 2)
+	expectPageValue(t, rt, 3, 3)
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	src := ":memory:test_incremental.gsdl"
+	removeTestDb(src)
+	removeStorage(changesFilename(src))
+	testIncrementalBackup(t, src)
+}
+
+func TestIncrementalBackupWal(t *testing.T) {
+	src := ":memory:test_incremental_wal.gsdl"
+	removeTestDb(src)
+	removeStorage(changesFilename(src))
+	if err := SetJournalMode(src, JOURNAL_MODE_WAL); err != nil {
+		t.Fatalf("Cannot switch to wal mode %v", err)
+	}
+	testIncrementalBackup(t, src)
+}
+
+func TestIncrementalBackupOtherProcess(t *testing.T) {
+	src := ":memory:test_incremental_other.gsdl"
+	delta := src + "-delta"
+	removeTestDb(src)
+	removeStorage(changesFilename(src))
+	if err := EnableChangeTracking(src); err != nil {
+		t.Fatalf("Cannot enable change tracking %v", err)
+	}
+	wt := &WriteTransaction{}
+	wt.StartTransaction(src)
+	for i := 0; i < 4; i++ {
+		testWritePage(t, wt, uint32(i), 1)
+	}
+	wt.EndTransaction()
+	id, _ := BackupId(src)
+	//The pager stays open while another process commits, which is only seen in the change tracking file
+	getPagerManager().OpenPager(src, nil)
+	defer getPagerManager().ClosePager(src)
+	other, err := openChangeTracker(src)
+	if err != nil {
+		t.Fatalf("Cannot open change tracking %v", err)
+	}
+	other.record([]uint32{2}, other.lsn+1, true)
+	other.close()
+	if _, err := IncrementalBackup(src, delta, id); err == nil {
+		t.Error("Incremental backup missed the commit of another process")
+	}
+	if _, err := BackupId(src); err == nil {
+		t.Error("Backup id missed the commit of another process")
+	}
+	wt.StartTransaction(src)
+	testWritePage(t, wt, 3, 2)
+	wt.EndTransaction()
+	if lsn, err := BackupId(src); err != nil || lsn != id+2 {
+		t.Errorf("Commit number does not follow the other process, want %d get %d %v", id+2, lsn, err)
+	}
+	if _, err := IncrementalBackup(src, delta, id); err != nil {
+		t.Fatalf("Cannot write delta %v", err)
+	}
+	file, _ := openStorage(delta, false)
+	data := make([]byte, deltaHeaderSize)
+	file.ReadAt(data, 0)
+	file.Close()
+	if header, err := deltaHeaderFromData(delta, data); err != nil || header.count != 2 {
+		t.Errorf("Delta misses pages changed by another process %v %v", header, err)
+	}
+}
@@ -0,0 +1,331 @@
+package pager
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+)
+
+const JOURNAL_SUFFIX string = "-journal"
+
+const journalMagic uint32 = 0x4a4c5347
+
+// The header is the magic, the number of pages of the database, the page size and the salt of the journal
+// Each record is the page number and the raw page followed by a crc32 checksum of the salt and the record
+const journalHeaderSize int64 = 16
+
+const journalChecksumSize int64 = 4
+
+type journal struct {
+	filename   string
+	db         *pageFile
+	file       Storage
+	numPages   uint32
+	pgSize     uint32
+	salt       uint32
+	savedPages map[uint32]int64
+	size       int64
+	unsynced   bool
+}
+
+func journalFilename(filename string) string {
+	return filename + JOURNAL_SUFFIX
+}
+
+func openJournal(db *pageFile) (*journal, error) {
+	filename := db.filename
+	numPages, err1 := db.numPages()
+	if err1 != nil {
+		return nil, err1
+	}
+	file, err2 := openStorage(journalFilename(filename), true)
+	if err2 != nil {
+		return nil, err2
+	}
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, err
+	}
+	pgSize := PageSize(filename)
+	//A fresh salt, so records left by an older journal are never taken as valid
+	salt := rand.Uint32()
+	header := make([]byte, journalHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], journalMagic)
+	binary.LittleEndian.PutUint32(header[4:8], numPages)
+	binary.LittleEndian.PutUint32(header[8:12], pgSize)
+	binary.LittleEndian.PutUint32(header[12:16], salt)
+	if _, err3 := file.WriteAt(header, 0); err3 != nil {
+		file.Close()
+		return nil, err3
+	}
+	return &journal{
+		filename:   filename,
+		db:         db,
+		file:       file,
+		numPages:   numPages,
+		pgSize:     pgSize,
+		salt:       salt,
+		savedPages: map[uint32]int64{},
+		size:       journalHeaderSize,
+		unsynced:   true,
+	}, nil
+}
+
+// Save the on disk image of pages before they are overwritten for the first time in a transaction
+// Pages beyond the original end of file need no image, they are cut off on rollback
+func (j *journal) savePages(pgNumbers []uint32) error {
+	for _, pgNumber := range pgNumbers {
+		if _, ok := j.savedPages[pgNumber]; ok || pgNumber >= j.numPages {
+			continue
+		}
+		//The raw image is saved, so even a corrupted page is put back as it was
+		data, err1 := j.db.readRawPage(pgNumber)
+		if err1 != nil {
+			return err1
+		}
+		n := 4 + int64(len(data))
+		record := make([]byte, n+journalChecksumSize)
+		binary.LittleEndian.PutUint32(record, pgNumber)
+		copy(record[4:], data)
+		binary.LittleEndian.PutUint32(record[n:], journalChecksum(j.salt, record[:n]))
+		if _, err2 := j.file.WriteAt(record, j.size); err2 != nil {
+			return err2
+		}
+		j.db.stats.addWrite(len(record))
+		j.savedPages[pgNumber] = j.size + 4
+		j.size += int64(len(record))
+		j.unsynced = true
+	}
+	return nil
+}
+
+// Read the image a page had before the transaction, ok is false if the page is not saved
+func (j *journal) readPage(pgNumber uint32) ([]byte, bool, error) {
+	offset, ok := j.savedPages[pgNumber]
+	if !ok {
+		return nil, false, nil
+	}
+	raw := make([]byte, diskPageSize(j.filename))
+	if _, err := j.file.ReadAt(raw, offset); err != nil {
+		return nil, true, err
+	}
+	j.db.stats.addRead(len(raw))
+	data, err := decodeFilePage(j.filename, raw, pgNumber)
+	return data, true, err
+}
+
+func (j *journal) sync() error {
+	if !j.unsynced {
+		return nil
+	}
+	j.db.stats.addSync()
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.unsynced = false
+	return nil
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+func (j *journal) remove() error {
+	if err := j.close(); err != nil {
+		return err
+	}
+	return removeStorage(journalFilename(j.filename))
+}
+
+func journalChecksum(salt uint32, record []byte) uint32 {
+	saltData := make([]byte, 4)
+	binary.LittleEndian.PutUint32(saltData, salt)
+	return crc32.Update(crc32.Checksum(saltData, crcTable), crcTable, record)
+}
+
+func hasHotJournal(filename string) bool {
+	return storageExists(journalFilename(filename))
+}
+
+// Copy the saved page images back to the database file and cut it to the original size
+// Returns true if there was a journal to roll back
+func rollbackJournal(db *pageFile) (bool, error) {
+	filename := db.filename
+	jfile, err1 := openStorage(journalFilename(filename), false)
+	if os.IsNotExist(err1) {
+		return false, nil
+	} else if err1 != nil {
+		return false, err1
+	}
+	defer jfile.Close()
+	header := make([]byte, journalHeaderSize)
+	if _, err2 := jfile.ReadAt(header, 0); err2 != nil ||
+		binary.LittleEndian.Uint32(header[0:4]) != journalMagic {
+		//The header is synced before the first database write, so the database is untouched
+		return true, removeStorage(journalFilename(filename))
+	}
+	numPages := binary.LittleEndian.Uint32(header[4:8])
+	salt := binary.LittleEndian.Uint32(header[12:16])
+	if pgSize := binary.LittleEndian.Uint32(header[8:12]); pgSize != PageSize(filename) {
+		return true, &PageIOError{filename, fmt.Sprintf("journal written with page size %d", pgSize)}
+	}
+	super, end, err3 := journalSuper(jfile)
+	if err3 != nil {
+		return true, err3
+	}
+	if super != "" && !storageExists(super) {
+		//The commit of several databases was made when the super journal was removed
+		return true, removeStorage(journalFilename(filename))
+	}
+	record := make([]byte, 4+int64(diskPageSize(filename))+journalChecksumSize)
+	for offset := journalHeaderSize; offset+int64(len(record)) <= end; offset += int64(len(record)) {
+		_, err4 := jfile.ReadAt(record, offset)
+		if err4 == io.EOF {
+			//A record cut short by a crash was never followed by a database write
+			break
+		} else if err4 != nil {
+			return true, err4
+		}
+		n := int64(len(record)) - journalChecksumSize
+		if binary.LittleEndian.Uint32(record[n:]) != journalChecksum(salt, record[:n]) {
+			//A record torn or never synced, the database was not written over its page after it
+			break
+		}
+		pgNumber := binary.LittleEndian.Uint32(record[0:4])
+		if err5 := db.writeRawPage(record[4:n], pgNumber); err5 != nil {
+			return true, err5
+		}
+	}
+	if err6 := db.truncate(numPages); err6 != nil {
+		return true, err6
+	}
+	if err7 := db.sync(); err7 != nil {
+		return true, err7
+	}
+	if err8 := removeStorage(journalFilename(filename)); err8 != nil || super == "" {
+		return true, err8
+	}
+	return true, cleanSuperJournal(super)
+}
+
+func (pager *Pager) journalPagesLocked(pgNumbers []uint32) error {
+	if len(pgNumbers) == 0 {
+		return nil
+	}
+	if pager.journal == nil {
+		j, err := openJournal(pager.file)
+		if err != nil {
+			return err
+		}
+		pager.journal = j
+		if pager.synchronous == SYNCHRONOUS_FULL {
+			if err := syncDir(journalFilename(pager.filename)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := pager.journal.savePages(pgNumbers); err != nil {
+		return err
+	}
+	if pager.synchronous == SYNCHRONOUS_OFF {
+		return nil
+	}
+	//The old images must be on disk before the database is written over them
+	return pager.journal.sync()
+}
+
+// Write back a page evicted in the middle of a transaction
+func (pager *Pager) writeBackLocked(pgData []byte, pgNumber uint32) error {
+	if err := pager.journalPagesLocked([]uint32{pgNumber}); err != nil {
+		return err
+	}
+	return pager.file.writePage(pgData, pgNumber)
+}
+
+func (pager *Pager) commitJournal() error {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	j, err := pager.prepareCommitLocked()
+	if err != nil || j == nil {
+		return err
+	}
+	return pager.finishCommitLocked(j)
+}
+
+// Write the transaction to the database file and make it durable, the journal is left to undo it
+// Returns nil if the transaction changed nothing
+func (pager *Pager) prepareCommitLocked() (*journal, error) {
+	if err1 := pager.syncAllLocked(); err1 != nil {
+		return nil, err1
+	}
+	j := pager.journal
+	if j == nil {
+		return nil, nil
+	}
+	if pager.synchronous != SYNCHRONOUS_OFF {
+		if err2 := pager.file.sync(); err2 != nil {
+			return nil, err2
+		}
+	}
+	if pager.synchronous == SYNCHRONOUS_FULL && j.numPages == 0 {
+		//The database file may be new, it must not be lost with the journal gone
+		if err := syncDir(pager.filename); err != nil {
+			return nil, err
+		}
+	}
+	//Pages beyond the old end of file are not saved in the journal
+	changed := make([]uint32, 0, len(j.savedPages))
+	for pgNumber := range j.savedPages {
+		changed = append(changed, pgNumber)
+	}
+	numPages, err3 := pager.file.numPages()
+	if err3 != nil {
+		return nil, err3
+	}
+	for pgNumber := j.numPages; pgNumber < numPages; pgNumber++ {
+		changed = append(changed, pgNumber)
+	}
+	if err4 := pager.trackCommitLocked(changed); err4 != nil {
+		return nil, err4
+	}
+	return j, nil
+}
+
+// Remove the journal of a prepared transaction, which commits it
+func (pager *Pager) finishCommitLocked(j *journal) error {
+	if err5 := pager.keepVersionsLocked(); err5 != nil {
+		return err5
+	}
+	pager.journal = nil
+	pager.commitSeq++
+	pager.changes++
+	if err6 := j.remove(); err6 != nil {
+		return err6
+	}
+	if pager.synchronous == SYNCHRONOUS_FULL {
+		return syncDir(pager.filename)
+	}
+	return nil
+}
+
+// Put the database back as it was before the transaction, also used for a journal left by a crash
+func (pager *Pager) abortJournal() error {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	pager.purgeCacheLocked()
+	if pager.journal != nil {
+		pager.journal.close()
+		pager.journal = nil
+	}
+	_, err := pager.rollbackJournalLocked()
+	return err
+}
+
+// The rollback may shrink the file, so the mapping is dropped first
+func (pager *Pager) rollbackJournalLocked() (bool, error) {
+	pager.file.unmap()
+	return rollbackJournal(pager.file)
+}
@@ -0,0 +1,116 @@
+package pager
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func expectPageValue(t *testing.T, transaction TransactionReader, pgNumber uint32, value byte) {
+	data, err := transaction.ReadPage(pgNumber)
+	if err != nil {
+		t.Errorf("Cannot read page %d: %v", pgNumber, err)
+		return
+	}
+	if data[0] != value || data[PGSIZE-1] != value {
+		t.Errorf("Wrong value in page %d, expect %d get %d", pgNumber, value, data[0])
+	}
+}
+
+func TestAbortRollback(t *testing.T) {
+	filename := "/tmp/test_journal_abort.gsdl"
+	removeTestDb(filename)
+	defer removeTestDb(filename)
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	for i := 0; i < 4; i++ {
+		testWritePage(t, wt, uint32(i), 1)
+	}
+	if err := wt.EndTransaction(); err != nil {
+		t.Error("Cannot commit first transaction")
+	}
+	if hasHotJournal(filename) {
+		t.Error("Journal not removed after commit")
+	}
+	wt.StartTransaction(filename)
+	for i := 0; i < 8; i++ {
+		testWritePage(t, wt, uint32(i), 2)
+	}
+	if err := wt.Sync(); err != nil {
+		t.Error("Cannot sync pages to disk")
+	}
+	if !hasHotJournal(filename) {
+		t.Error("Journal not written before overwrite")
+	}
+	wt.AbortTransaction()
+	wt.EndTransaction()
+	if n, _ := countPages(filename); n != 4 {
+		t.Errorf("Wrong number of pages after rollback %d", n)
+	}
+	rt := &ReadTransaction{}
+	rt.StartTransaction(filename)
+	for i := 0; i < 4; i++ {
+		expectPageValue(t, rt, uint32(i), 1)
+	}
+	rt.EndTransaction()
+}
+
+func TestHotJournalRecovery(t *testing.T) {
+	filename := "/tmp/test_journal_hot.gsdl"
+	removeTestDb(filename)
+	defer removeTestDb(filename)
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	for i := 0; i < 4; i++ {
+		testWritePage(t, wt, uint32(i), 3)
+	}
+	wt.EndTransaction()
+	//Simulate a crash in the middle of writing back a transaction
+	j, err := openJournal(openPageFile(filename, 0, nil))
+	if err != nil {
+		t.Fatal("Cannot open journal")
+	}
+	j.savePages([]uint32{0, 2})
+	//A record appended without a sync may be found as zeros after the crash
+	j.file.WriteAt(make([]byte, 4+int64(diskPageSize(filename))+journalChecksumSize), j.size)
+	j.sync()
+	j.close()
+	data := make([]byte, PGSIZE)
+	writePage(filename, data, 0)
+	writePage(filename, data, 2)
+	writePage(filename, data, 6)
+	wt.StartTransaction(filename)
+	if hasHotJournal(filename) {
+		t.Error("Hot journal not rolled back")
+	}
+	for i := 0; i < 4; i++ {
+		expectPageValue(t, wt, uint32(i), 3)
+	}
+	if _, err := wt.ReadPage(6); err == nil {
+		t.Error("Pages appended by crashed transaction not truncated")
+	}
+	wt.EndTransaction()
+}
+
+func TestHotJournalRollbackError(t *testing.T) {
+	filename := ":memory:test_journal_bad.gsdl"
+	removeTestDb(filename)
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	testWritePage(t, wt, 0, 1)
+	wt.EndTransaction()
+	j, _ := openJournal(openPageFile(filename, 0, nil))
+	pgSize := make([]byte, 4)
+	binary.LittleEndian.PutUint32(pgSize, PGSIZE*2)
+	j.file.WriteAt(pgSize, 8)
+	j.close()
+	if _, ok := wt.StartTransaction(filename).(*RecoveryError); !ok {
+		t.Fatal("Expect recovery error for a journal which cannot be rolled back")
+	}
+	//The failed start keeps no lock
+	removeStorage(journalFilename(filename))
+	if err := wt.StartTransaction(filename); err != nil {
+		t.Fatalf("Cannot start writer after the journal is gone %v", err)
+	}
+	expectPageValue(t, wt, 0, 1)
+	wt.EndTransaction()
+}
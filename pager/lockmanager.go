@@ -1,54 +1,375 @@
 package pager
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const LOCK_SUFFIX string = "-lock"
+
+const busyRetryInterval time.Duration = 10 * time.Millisecond
+
+// Waits of transactions without a lock owner cannot be told from waits on their own caller, so they do not wait for ever by default
+const DEFAULT_LOCK_TIMEOUT time.Duration = 5 * time.Second
+
+type BusyError struct {
+	filename string
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("%s: database is locked", e.filename)
+}
+
+// Lock on the database taken for the whole process, other processes see it through an os file lock
+// Exclusive while any transaction of the process writes, shared while only readers are running
+type dbLock struct {
+	file      Storage
+	shared    int
+	exclusive int
+	waiting   int
+}
+
+type DeadlockError struct {
+	filename string
+}
+
+func (e *DeadlockError) Error() string {
+	return fmt.Sprintf("%s: deadlock detected, the transaction can be retried", e.filename)
+}
+
+// Lock of a file inside the process, held by lock owners
+// An owner waiting for a lock it holds itself is a deadlock, since nothing else would release it
+type fileLock struct {
+	shared         map[int64]int
+	exclusive      int64
+	exclusiveCount int
+	//Owners waiting for the exclusive lock, new shared holders wait behind them
+	exclusiveWaiters map[int64]int
+	//Closed and replaced whenever the lock is released
+	released chan struct{}
+}
+
+// The lock an owner is waiting for, the edges of the wait-for graph
+type lockWait struct {
+	filename  string
+	exclusive bool
+}
+
 type lockManager struct {
-	filelocks map[string]*sync.RWMutex
-	mtx       sync.Mutex
+	filelocks   map[string]*fileLock
+	waits       map[int64]lockWait
+	dblocks     map[string]*dbLock
+	busyTimeout time.Duration
+	lockTimeout time.Duration
+	mtx         sync.Mutex
+	dbmtx       sync.Mutex
 }
 
-func (manager *lockManager) ensureFileLock(filename string) *sync.RWMutex {
-	manager.mtx.Lock()
-	defer manager.mtx.Unlock()
+var lastLockOwner int64
+
+type lockOwnerKey struct{}
+
+// Lock owners are tokens, every transaction gets its own unless its context carries one
+// Locks are released by the token, so a transaction can be ended on another goroutine
+// A caller whose transactions may wait for each other gives them one owner, the wait is then a DeadlockError
+func NewLockOwner() int64 {
+	return atomic.AddInt64(&lastLockOwner, 1)
+}
+
+// Transactions started with the returned context share the owner, a wait of one for another is then a deadlock
+func WithLockOwner(ctx context.Context, owner int64) context.Context {
+	return context.WithValue(ctx, lockOwnerKey{}, owner)
+}
+
+func lockOwnerOf(ctx context.Context) int64 {
+	if owner, ok := ctx.Value(lockOwnerKey{}).(int64); ok {
+		return owner
+	}
+	return NewLockOwner()
+}
+
+func (manager *lockManager) ensureFileLock(filename string) *fileLock {
 	lock, ok := manager.filelocks[filename]
 	if !ok {
-		lock = &sync.RWMutex{}
+		lock = &fileLock{
+			shared:           map[int64]int{},
+			exclusiveWaiters: map[int64]int{},
+			released:         make(chan struct{}),
+		}
 		manager.filelocks[filename] = lock
 	}
 	return lock
 }
 
-func (manager *lockManager) AcquireLockShared(filename string) {
+// Holders of the lock which the owner has to wait for, the owner itself included
+func (lock *fileLock) blockers(owner int64, exclusive bool) []int64 {
+	blockers := make([]int64, 0)
+	if exclusive {
+		if lock.exclusive != 0 {
+			blockers = append(blockers, lock.exclusive)
+		}
+		for holder := range lock.shared {
+			blockers = append(blockers, holder)
+		}
+		return blockers
+	}
+	if lock.exclusive != 0 && lock.exclusive != owner {
+		blockers = append(blockers, lock.exclusive)
+	}
+	if lock.shared[owner] == 0 && lock.exclusive != owner {
+		for waiter := range lock.exclusiveWaiters {
+			if waiter != owner {
+				blockers = append(blockers, waiter)
+			}
+		}
+	}
+	return blockers
+}
+
+// Follow the wait-for graph from the owner, true if it leads back to the owner
+func (manager *lockManager) hasCycle(owner int64) bool {
+	visited := map[int64]bool{}
+	stack := []int64{owner}
+	for len(stack) > 0 {
+		waiter := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		wait, ok := manager.waits[waiter]
+		if !ok {
+			continue
+		}
+		for _, blocker := range manager.filelocks[wait.filename].blockers(waiter, wait.exclusive) {
+			if blocker == owner {
+				return true
+			}
+			if !visited[blocker] {
+				visited[blocker] = true
+				stack = append(stack, blocker)
+			}
+		}
+	}
+	return false
+}
+
+// Wait until the owner gets the lock, the context or the lock timeout limits the wait
+// Fails with DeadlockError if the wait would never end, and with BusyError when the time is up
+func (manager *lockManager) acquire(ctx context.Context, filename string, owner int64, exclusive bool) error {
+	manager.mtx.Lock()
+	defer manager.mtx.Unlock()
+	if manager.lockTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, manager.lockTimeout)
+		defer cancel()
+	}
 	lock := manager.ensureFileLock(filename)
-	lock.RLock()
+	if exclusive {
+		lock.exclusiveWaiters[owner]++
+		defer func() {
+			lock.exclusiveWaiters[owner]--
+			if lock.exclusiveWaiters[owner] == 0 {
+				delete(lock.exclusiveWaiters, owner)
+			}
+		}()
+	}
+	for {
+		if len(lock.blockers(owner, exclusive)) == 0 {
+			delete(manager.waits, owner)
+			if exclusive {
+				lock.exclusive = owner
+				lock.exclusiveCount++
+			} else {
+				lock.shared[owner]++
+			}
+			return nil
+		}
+		manager.waits[owner] = lockWait{filename, exclusive}
+		if manager.hasCycle(owner) {
+			delete(manager.waits, owner)
+			manager.wakeWaiters(lock)
+			return &DeadlockError{filename}
+		}
+		released := lock.released
+		manager.mtx.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+		}
+		manager.mtx.Lock()
+		if err := ctx.Err(); err != nil {
+			delete(manager.waits, owner)
+			//Shared waiters behind this one may go on now
+			manager.wakeWaiters(lock)
+			if err == context.DeadlineExceeded {
+				return &BusyError{filename}
+			}
+			return err
+		}
+	}
+}
+
+func (manager *lockManager) wakeWaiters(lock *fileLock) {
+	close(lock.released)
+	lock.released = make(chan struct{})
 }
 
-func (manager *lockManager) ReleaseLockShared(filename string) {
+func (manager *lockManager) release(filename string, owner int64, exclusive bool) {
 	manager.mtx.Lock()
+	defer manager.mtx.Unlock()
 	lock, ok := manager.filelocks[filename]
-	manager.mtx.Unlock()
-	if !ok {
-		log.Panicf("Cannot release lock for i %s since it is not in the manager", filename)
+	if exclusive && (!ok || lock.exclusive != owner) {
+		log.Panicf("Cannot release exclusive lock for %s since it is not held", filename)
+	} else if !exclusive && (!ok || lock.shared[owner] == 0) {
+		log.Panicf("Cannot release shared lock for %s since it is not held", filename)
 	}
-	lock.RUnlock()
+	if exclusive {
+		lock.exclusiveCount--
+		if lock.exclusiveCount == 0 {
+			lock.exclusive = 0
+		}
+	} else {
+		lock.shared[owner]--
+		if lock.shared[owner] == 0 {
+			delete(lock.shared, owner)
+		}
+	}
+	manager.wakeWaiters(lock)
+}
+
+func (manager *lockManager) AcquireLockShared(ctx context.Context, filename string, owner int64) error {
+	return manager.acquire(ctx, filename, owner, false)
+}
+
+func (manager *lockManager) ReleaseLockShared(filename string, owner int64) {
+	manager.release(filename, owner, false)
 }
 
-func (manager *lockManager) AcquireLockExlusive(filename string) {
+func (manager *lockManager) AcquireLockExlusive(ctx context.Context, filename string, owner int64) error {
+	return manager.acquire(ctx, filename, owner, true)
+}
+
+// Take the exclusive lock only if it is free at once
+func (manager *lockManager) TryAcquireLockExlusive(filename string, owner int64) bool {
+	manager.mtx.Lock()
+	defer manager.mtx.Unlock()
 	lock := manager.ensureFileLock(filename)
-	lock.Lock()
+	if len(lock.blockers(owner, true)) != 0 {
+		return false
+	}
+	lock.exclusive = owner
+	lock.exclusiveCount++
+	return true
+}
+
+func (manager *lockManager) ReleaseLockExlusive(filename string, owner int64) {
+	manager.release(filename, owner, true)
 }
 
-func (manager *lockManager) ReleaseLockExlusive(filename string) {
+func (manager *lockManager) setLockTimeout(timeout time.Duration) {
 	manager.mtx.Lock()
-	lock, ok := manager.filelocks[filename]
-	manager.mtx.Unlock()
+	defer manager.mtx.Unlock()
+	manager.lockTimeout = timeout
+}
+
+func (manager *lockManager) setBusyTimeout(timeout time.Duration) {
+	manager.dbmtx.Lock()
+	defer manager.dbmtx.Unlock()
+	manager.busyTimeout = timeout
+}
+
+// Take the process wide lock of a database, waits at most busy timeout for other processes
+func (manager *lockManager) LockDatabase(filename string, exclusive bool) error {
+	manager.dbmtx.Lock()
+	defer manager.dbmtx.Unlock()
+	lock, ok := manager.dblocks[filename]
+	if !ok {
+		file, err := openStorage(filename+LOCK_SUFFIX, true)
+		if err != nil {
+			return err
+		}
+		lock = &dbLock{file: file}
+		manager.dblocks[filename] = lock
+	}
+	if lock.exclusive > 0 || (lock.shared > 0 && !exclusive) {
+		//The process already holds a strong enough lock
+		manager.countLock(lock, exclusive, 1)
+		return nil
+	}
+	deadline := time.Now().Add(manager.busyTimeout)
+	for {
+		level := LOCK_SHARED
+		if exclusive {
+			level = LOCK_EXCLUSIVE
+		}
+		err := lock.file.Lock(level)
+		if err == nil {
+			break
+		} else if err != errLockBusy {
+			manager.releaseUnused(filename, lock)
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			manager.releaseUnused(filename, lock)
+			return &BusyError{filename}
+		}
+		//Other goroutines of this process must not wait behind a busy database
+		lock.waiting++
+		manager.dbmtx.Unlock()
+		time.Sleep(busyRetryInterval)
+		manager.dbmtx.Lock()
+		lock.waiting--
+		if lock.exclusive > 0 || (lock.shared > 0 && !exclusive) {
+			break
+		}
+	}
+	manager.countLock(lock, exclusive, 1)
+	return nil
+}
+
+func (manager *lockManager) UnlockDatabase(filename string, exclusive bool) {
+	manager.dbmtx.Lock()
+	defer manager.dbmtx.Unlock()
+	lock, ok := manager.dblocks[filename]
 	if !ok {
-		log.Panicf("Cannot release lock for i %s since it is not in the manager", filename)
+		log.Panicf("Cannot unlock database %s since it is not in the manager", filename)
 	}
-	lock.Unlock()
+	manager.countLock(lock, exclusive, -1)
+	if lock.exclusive == 0 && lock.shared > 0 {
+		//Going down to a shared lock never waits
+		if err := lock.file.Lock(LOCK_SHARED); err != nil {
+			log.Panicf("Cannot downgrade lock of database %s: %v", filename, err)
+		}
+	}
+	manager.releaseUnused(filename, lock)
+}
+
+func (manager *lockManager) countLock(lock *dbLock, exclusive bool, n int) {
+	if exclusive {
+		lock.exclusive += n
+	} else {
+		lock.shared += n
+	}
+}
+
+func (manager *lockManager) releaseUnused(filename string, lock *dbLock) {
+	if lock.exclusive == 0 && lock.shared == 0 && lock.waiting == 0 {
+		lock.file.Lock(LOCK_NONE)
+		lock.file.Close()
+		delete(manager.dblocks, filename)
+	}
+}
+
+// Set how long a transaction waits for other processes before it fails with BusyError
+func SetBusyTimeout(timeout time.Duration) {
+	getLockManger().setBusyTimeout(timeout)
+}
+
+// Set how long a transaction waits for transactions of this process before it fails with BusyError, 0 waits for ever
+// Waits which would never end fail at once with DeadlockError, the default is DEFAULT_LOCK_TIMEOUT
+func SetLockTimeout(timeout time.Duration) {
+	getLockManger().setLockTimeout(timeout)
 }
 
 var lockManagerInstance *lockManager = nil
@@ -57,7 +378,10 @@ var onceLockManager sync.Once
 func getLockManger() *lockManager {
 	onceLockManager.Do(func() {
 		lockManagerInstance = &lockManager{
-			filelocks: map[string]*sync.RWMutex{},
+			filelocks:   map[string]*fileLock{},
+			waits:       map[int64]lockWait{},
+			dblocks:     map[string]*dbLock{},
+			lockTimeout: DEFAULT_LOCK_TIMEOUT,
 		}
 	})
 	return lockManagerInstance
@@ -0,0 +1,202 @@
+package pager
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Run in a child process to hold the database lock, os locks do not conflict inside one process
+func TestLockHelperProcess(t *testing.T) {
+	filename := os.Getenv("GSDL_LOCK_HELPER")
+	if filename == "" {
+		return
+	}
+	wt := &WriteTransaction{}
+	if err := wt.StartTransaction(filename); err != nil {
+		os.Exit(1)
+	}
+	os.Stdout.WriteString("locked\n")
+	io.Copy(io.Discard, os.Stdin)
+	wt.EndTransaction()
+	os.Exit(0)
+}
+
+func TestDatabaseLockedByOtherProcess(t *testing.T) {
+	filename := "/tmp/test_lock_busy.gsdl"
+	removeTestDb(filename)
+	defer removeTestDb(filename)
+	cmd := exec.Command(os.Args[0], "-test.run=TestLockHelperProcess")
+	cmd.Env = append(os.Environ(), "GSDL_LOCK_HELPER="+filename)
+	stdin, _ := cmd.StdinPipe()
+	stdout, _ := cmd.StdoutPipe()
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Cannot start helper process %v", err)
+	}
+	if line, _ := bufio.NewReader(stdout).ReadString('\n'); line != "locked\n" {
+		t.Fatal("Helper process cannot lock the database")
+	}
+	rt := &ReadTransaction{}
+	err := rt.StartTransaction(filename)
+	if _, ok := err.(*BusyError); !ok {
+		t.Errorf("Expect busy error, get %v", err)
+	}
+	//The helper quits while this reader waits
+	SetBusyTimeout(5 * time.Second)
+	defer SetBusyTimeout(0)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		stdin.Close()
+	}()
+	if err := rt.StartTransaction(filename); err != nil {
+		t.Fatalf("Cannot start reader after helper quit %v", err)
+	}
+	rt.EndTransaction()
+	cmd.Wait()
+}
+
+func TestDeadlockOfOwner(t *testing.T) {
+	filename := ":memory:test_deadlock_self.gsdl"
+	removeTestDb(filename)
+	ctx := WithLockOwner(context.Background(), NewLockOwner())
+	rt := &ReadTransaction{}
+	if err := rt.StartTransactionContext(ctx, filename); err != nil {
+		t.Fatalf("Cannot start reader %v", err)
+	}
+	//Taking the database alone waits for the reader of its own owner
+	if _, err := lockDatabaseAloneContext(ctx, filename); err == nil {
+		t.Error("Database taken alone under a reader")
+	} else if _, ok := err.(*DeadlockError); !ok {
+		t.Errorf("Expect deadlock error for taking the database alone under a reader, get %v", err)
+	}
+	rt.EndTransaction()
+	wt := &WriteTransaction{}
+	wt.StartTransactionContext(ctx, filename)
+	nested := &WriteTransaction{}
+	if _, ok := nested.StartTransactionContext(ctx, filename).(*DeadlockError); !ok {
+		t.Error("Expect deadlock error for nested writers")
+	}
+	wt.EndTransaction()
+	if err := nested.StartTransactionContext(ctx, filename); err != nil {
+		t.Fatalf("Cannot start writer after deadlock %v", err)
+	}
+	nested.EndTransaction()
+}
+
+func TestEndTransactionInOtherGoroutine(t *testing.T) {
+	filename := ":memory:test_lock_handover.gsdl"
+	removeTestDb(filename)
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	//Without a shared owner the second writer waits for the first, which is ended elsewhere
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		wt.EndTransaction()
+	}()
+	other := &WriteTransaction{}
+	if err := other.StartTransaction(filename); err != nil {
+		t.Fatalf("Cannot start writer after the first one ended %v", err)
+	}
+	other.EndTransaction()
+}
+
+func TestCheckpointUnderReader(t *testing.T) {
+	filename := ":memory:test_checkpoint_reader.gsdl"
+	removeTestDb(filename)
+	rt := &ReadTransaction{}
+	if err := rt.StartTransaction(filename); err != nil {
+		t.Fatalf("Cannot start reader %v", err)
+	}
+	//Without an owner the checkpoint cannot know the reader is its own, it gives up after the default timeout
+	start := time.Now()
+	if _, ok := Checkpoint(filename).(*BusyError); !ok {
+		t.Error("Expect busy error for checkpoint under a reader")
+	}
+	if time.Since(start) > DEFAULT_LOCK_TIMEOUT+time.Second {
+		t.Errorf("Checkpoint waited %v", time.Since(start))
+	}
+	rt.EndTransaction()
+	ctx := WithLockOwner(context.Background(), NewLockOwner())
+	rt.StartTransactionContext(ctx, filename)
+	if _, ok := CheckpointContext(ctx, filename).(*DeadlockError); !ok {
+		t.Error("Expect deadlock error for checkpoint under a reader of its owner")
+	}
+	rt.EndTransaction()
+	if err := Checkpoint(filename); err != nil {
+		t.Errorf("Cannot checkpoint after the reader ended %v", err)
+	}
+}
+
+func TestDeadlockAcrossFiles(t *testing.T) {
+	filenames := []string{":memory:test_deadlock_a.gsdl", ":memory:test_deadlock_b.gsdl"}
+	for _, filename := range filenames {
+		removeTestDb(filename)
+	}
+	var started sync.WaitGroup
+	started.Add(2)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func(first string, second string) {
+			ctx := WithLockOwner(context.Background(), NewLockOwner())
+			wt := &WriteTransaction{}
+			wt.StartTransactionContext(ctx, first)
+			defer wt.EndTransaction()
+			started.Done()
+			started.Wait()
+			other := &WriteTransaction{}
+			err := other.StartTransactionContext(ctx, second)
+			if err == nil {
+				other.EndTransaction()
+			}
+			errs <- err
+		}(filenames[i], filenames[1-i])
+	}
+	deadlocks := 0
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if _, ok := err.(*DeadlockError); ok {
+				deadlocks++
+			} else if err != nil {
+				t.Errorf("Unexpected error %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Deadlock not detected")
+		}
+	}
+	if deadlocks != 1 {
+		t.Errorf("Expect one deadlock error, get %d", deadlocks)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	filename := ":memory:test_lock_timeout.gsdl"
+	removeTestDb(filename)
+	SetLockTimeout(50 * time.Millisecond)
+	defer SetLockTimeout(DEFAULT_LOCK_TIMEOUT)
+	locked := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		wt := &WriteTransaction{}
+		wt.StartTransaction(filename)
+		close(locked)
+		<-done
+		wt.EndTransaction()
+	}()
+	<-locked
+	wt := &WriteTransaction{}
+	if _, ok := wt.StartTransaction(filename).(*BusyError); !ok {
+		t.Error("Expect busy error when the lock timeout is up")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := wt.StartTransactionContext(ctx, filename); err != context.Canceled {
+		t.Errorf("Expect canceled error, get %v", err)
+	}
+	close(done)
+}
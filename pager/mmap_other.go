@@ -0,0 +1,17 @@
+//go:build !unix
+
+package pager
+
+import (
+	"errors"
+	"os"
+)
+
+// Reads fall back to the file handle
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mmap not supported")
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package pager
+
+import (
+	"errors"
+	"os"
+)
+
+var errLockBusy = errors.New("lock held by another process")
+
+// No os file locks on this platform, only goroutines of one process are coordinated
+func tryLockFile(file *os.File, level int) error {
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build unix
+
+package pager
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var errLockBusy = errors.New("lock held by another process")
+
+// Record locks belong to the process, so changing between shared and exclusive never drops the lock held
+func tryLockFile(file *os.File, level int) error {
+	lock := syscall.Flock_t{Type: syscall.F_UNLCK}
+	switch level {
+	case LOCK_SHARED:
+		lock.Type = syscall.F_RDLCK
+	case LOCK_EXCLUSIVE:
+		lock.Type = syscall.F_WRLCK
+	}
+	err := syscall.FcntlFlock(file.Fd(), syscall.F_SETLK, &lock)
+	if err == syscall.EAGAIN || err == syscall.EACCES {
+		return errLockBusy
+	}
+	return err
+}
@@ -1,14 +1,22 @@
 package pager
 
 import (
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"math"
 	"os"
 )
 
+// Default page size, see SetPageSize
 const PGSIZE uint32 = 4096
 
+// Every page on disk is followed by a trailer holding the crc32 of the page and its page number
+const PAGE_TRAILER_SIZE uint32 = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
 type PageIOError struct {
 	filename string
 	msg      string
@@ -18,94 +26,508 @@ func (err *PageIOError) Error() string {
 	return fmt.Sprintf("%s: %s", err.filename, err.msg)
 }
 
-func loadPage(filename string, pgNumber uint32) ([]byte, error) {
-	file, err1 := os.Open(filename)
-	if err1 != nil {
-		return nil, err1
+type CorruptionError struct {
+	Filename string
+	PgNumber uint32
+	msg      string
+}
+
+func (err *CorruptionError) Error() string {
+	return fmt.Sprintf("%s: page %d corrupted, %s", err.Filename, err.PgNumber, err.msg)
+}
+
+func MakeCorruptionError(filename string, pgNumber uint32, msg string) *CorruptionError {
+	return &CorruptionError{
+		Filename: filename,
+		PgNumber: pgNumber,
+		msg:      msg,
 	}
-	defer file.Close()
-	data := make([]byte, PGSIZE)
-	_, err2 := file.ReadAt(data, int64(PGSIZE*pgNumber))
-	if err2 != nil {
-		return nil, err2
+}
+
+func pageOffset(filename string, pgNumber uint32) int64 {
+	return int64(diskPageSize(filename)) * int64(pgNumber)
+}
+
+func pageChecksum(data []byte, pgNumber uint32) uint32 {
+	pgNumberData := make([]byte, 4)
+	binary.LittleEndian.PutUint32(pgNumberData, pgNumber)
+	return crc32.Update(crc32.Checksum(data, crcTable), crcTable, pgNumberData)
+}
+
+func encodePage(c *pageCipher, data []byte, pgNumber uint32) []byte {
+	if c != nil {
+		raw := c.seal(data, pgNumber)
+		pgNumberData := make([]byte, 4)
+		binary.LittleEndian.PutUint32(pgNumberData, pgNumber)
+		return append(raw, pgNumberData...)
 	}
-	return data, nil
+	pgSize := len(data)
+	raw := make([]byte, pgSize+int(PAGE_TRAILER_SIZE))
+	copy(raw, data)
+	binary.LittleEndian.PutUint32(raw[pgSize:], pageChecksum(data, pgNumber))
+	binary.LittleEndian.PutUint32(raw[pgSize+4:], pgNumber)
+	return raw
 }
 
-func writePage(filename string, data []byte, pgNumber uint32) error {
-	if len(data) != int(PGSIZE) {
-		return &PageIOError{filename, "write data length can only be a page"}
+func decodePage(filename string, c *pageCipher, raw []byte, pgNumber uint32) ([]byte, error) {
+	pgSize := len(raw) - int(c.trailerSize())
+	data := raw[:pgSize]
+	if c != nil {
+		//Every page is authenticated, an empty page is sealed like any other
+		if binary.LittleEndian.Uint32(raw[len(raw)-4:]) != pgNumber {
+			return nil, MakeCorruptionError(filename, pgNumber, "wrong page number in trailer")
+		}
+		return c.open(filename, raw[:len(raw)-4], pgNumber)
 	}
-	file, err1 := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0660)
-	if err1 != nil {
-		return err1
+	if binary.LittleEndian.Uint32(raw[pgSize+4:]) == pgNumber &&
+		binary.LittleEndian.Uint32(raw[pgSize:]) == pageChecksum(data, pgNumber) {
+		return data, nil
 	}
-	defer file.Close()
-	_, err2 := file.WriteAt(data, int64(PGSIZE*pgNumber))
-	if err2 != nil {
-		err3 := appendPage(filename, pgNumber)
-		return err3
+	if binary.LittleEndian.Uint32(raw[pgSize+4:]) != pgNumber {
+		return nil, MakeCorruptionError(filename, pgNumber, "wrong page number in trailer")
 	}
-	return nil
+	return nil, MakeCorruptionError(filename, pgNumber, "checksum mismatch")
+}
+
+// Pages of files without trailers are kept as they are
+func encodeFilePage(filename string, data []byte, pgNumber uint32) []byte {
+	if !hasPageTrailers(filename) {
+		return data
+	}
+	return encodePage(fileCipher(filename), data, pgNumber)
+}
+
+func decodeFilePage(filename string, raw []byte, pgNumber uint32) ([]byte, error) {
+	if !hasPageTrailers(filename) {
+		return raw, nil
+	}
+	return decodePage(filename, fileCipher(filename), raw, pgNumber)
 }
 
-func writePageWithAppend(filename string, data []byte, pgNumber uint32) error {
-	err1 := writePage(filename, data, pgNumber)
-	if err1 == io.EOF {
-		err2 := appendPage(filename, pgNumber)
+// Database file kept open for the life of a pager, reads can go through a read-only mapping
+// Callers serialize access, the pager does it with its lock
+type pageFile struct {
+	filename string
+	file     Storage
+	mmapSize int64
+	mapped   []byte
+	stats    *PagerStats
+	//Set for compressed files, pages are then kept in slots instead of at fixed offsets
+	slots *slotFile
+}
+
+func openPageFile(filename string, mmapSize int64, stats *PagerStats) *pageFile {
+	return &pageFile{
+		filename: filename,
+		mmapSize: mmapSize,
+		stats:    stats,
+	}
+}
+
+// The file is opened on first use, it is only created by a write
+func (f *pageFile) open(create bool) error {
+	if f.file == nil {
+		file, err1 := openStorage(f.filename, create)
+		if err1 != nil {
+			return err1
+		}
+		compressed, err2 := isCompressedFile(file)
+		if err2 == nil && compressed {
+			f.slots, err2 = loadSlotFile(file, f.stats)
+		}
 		if err2 != nil {
+			file.Close()
 			return err2
 		}
-		return writePage(filename, data, pgNumber)
+		f.file = file
+	}
+	if create && f.slots == nil && getFileConfig(f.filename).compress {
+		//Only new files are compressed, a plain file stays plain
+		size, err3 := f.file.Size()
+		if err3 != nil || size != 0 {
+			return err3
+		}
+		slots, err4 := createSlotFile(f.file, f.stats)
+		if err4 != nil {
+			return err4
+		}
+		f.slots = slots
 	}
 	return nil
 }
 
-func appendPage(filename string, pgNumber uint32) error {
-	file, err1 := os.OpenFile(filename, os.O_WRONLY, 0660)
-	if err1 != nil {
-		return err1
+func (f *pageFile) close() error {
+	f.unmap()
+	if f.file == nil {
+		return nil
 	}
-	defer file.Close()
-	info, err2 := file.Stat()
-	if err2 != nil {
-		return err2
+	err := f.file.Close()
+	f.file = nil
+	f.slots = nil
+	return err
+}
+
+func (f *pageFile) unmap() {
+	if f.mapped != nil {
+		munmapFile(f.mapped)
+		f.mapped = nil
+	}
+}
+
+// Map the file as it is now, must be unmapped before the file shrinks
+func (f *pageFile) remap() {
+	f.unmap()
+	file, ok := f.file.(*fileStorage)
+	if !ok || f.slots != nil {
+		return
+	}
+	size, err := file.Size()
+	if err != nil || size == 0 {
+		return
+	}
+	if size > f.mmapSize {
+		size = f.mmapSize
+	}
+	if mapped, err := file.mmap(size); err == nil {
+		f.mapped = mapped
+	}
+}
+
+// Pages of compressed files are encoded again, the file keeps them compressed
+func (f *pageFile) readRawPage(pgNumber uint32) ([]byte, error) {
+	if err := f.open(false); err != nil {
+		return nil, err
+	}
+	if f.slots != nil {
+		data, err := f.loadSlotPage(fileCipher(f.filename), pgNumber)
+		if err != nil {
+			return nil, err
+		}
+		return encodeFilePage(f.filename, data, pgNumber), nil
+	}
+	raw := make([]byte, diskPageSize(f.filename))
+	offset := pageOffset(f.filename, pgNumber)
+	end := offset + int64(len(raw))
+	if f.mmapSize > 0 && end > int64(len(f.mapped)) && end <= f.mmapSize {
+		//The file may have grown since it was mapped
+		f.remap()
+	}
+	if end <= int64(len(f.mapped)) {
+		copy(raw, f.mapped[offset:end])
+	} else if _, err := f.file.ReadAt(raw, offset); err != nil {
+		return nil, err
+	}
+	f.stats.addRead(len(raw))
+	return raw, nil
+}
+
+func (f *pageFile) loadSlotPage(c *pageCipher, pgNumber uint32) ([]byte, error) {
+	payload, err := f.slots.readPage(pgNumber)
+	if err != nil {
+		return nil, err
+	} else if payload == nil {
+		//Pages below the end are written when the file grows, so the image of this one was lost
+		return nil, MakeCorruptionError(f.filename, pgNumber, "page missing from compressed file")
+	}
+	return decodeSlotPage(f.filename, c, payload, pgNumber)
+}
+
+func (f *pageFile) loadPage(pgNumber uint32) ([]byte, error) {
+	return f.loadPageWith(fileCipher(f.filename), pgNumber)
+}
+
+// Load the page sealed with the cipher, which may not be the cipher of the file yet
+func (f *pageFile) loadPageWith(c *pageCipher, pgNumber uint32) ([]byte, error) {
+	if err := f.open(false); err != nil {
+		return nil, err
+	}
+	if f.slots != nil {
+		return f.loadSlotPage(c, pgNumber)
+	}
+	raw, err := f.readRawPage(pgNumber)
+	if err != nil {
+		return nil, err
+	}
+	if !hasPageTrailers(f.filename) {
+		return raw, nil
+	}
+	return decodePage(f.filename, c, raw, pgNumber)
+}
+
+// Pages beyond the end of file are appended, the gap is filled with zero pages
+func (f *pageFile) writePage(data []byte, pgNumber uint32) error {
+	return f.writePageWith(fileCipher(f.filename), data, pgNumber)
+}
+
+func (f *pageFile) writePageWith(c *pageCipher, data []byte, pgNumber uint32) error {
+	if len(data) != int(PageSize(f.filename)) {
+		return &PageIOError{f.filename, "write data length can only be a page"}
+	}
+	if pgNumber == math.MaxUint32 {
+		return &PageIOError{f.filename, "number of pages bigger than uint32 limit"}
+	}
+	if err := f.open(true); err != nil {
+		return err
 	}
-	nowSize := info.Size()
-	if nowSize/int64(PGSIZE) > math.MaxUint32 {
-		return &PageIOError{filename, "number of pages bigger than uint32 limit"}
+	if err := f.extend(c, pgNumber); err != nil {
+		return err
 	}
-	var nowPgNumber uint32 = uint32(nowSize/int64(PGSIZE) - 1)
-	if pgNumber <= nowPgNumber {
+	return f.writeEncodedPage(c, data, pgNumber)
+}
+
+// The zero pages of the gap get a trailer like any other page, so a page zeroed on disk is found corrupted
+func (f *pageFile) extend(c *pageCipher, pgNumber uint32) error {
+	if !hasPageTrailers(f.filename) {
 		return nil
 	}
-	_, err3 := file.Seek(0, os.SEEK_END)
-	if err3 != nil {
-		return err3
+	numPages, err := f.numPages()
+	if err != nil {
+		return err
 	}
-	data := make([]byte, PGSIZE)
-	for i := nowPgNumber; i < pgNumber; i++ {
-		_, err4 := file.Write(data)
-		if err4 != nil {
-			return err4
+	empty := make([]byte, PageSize(f.filename))
+	for gap := numPages; gap < pgNumber; gap++ {
+		if err1 := f.writeEncodedPage(c, empty, gap); err1 != nil {
+			return err1
 		}
 	}
 	return nil
 }
 
-func shrinkFile(filename string, targetNumberPages uint32) error {
-	file, err1 := os.OpenFile(filename, os.O_WRONLY, 0660)
-	if err1 != nil {
+func (f *pageFile) writeEncodedPage(c *pageCipher, data []byte, pgNumber uint32) error {
+	if f.slots != nil {
+		return f.slots.writePage(encodeSlotPage(c, data, pgNumber), pgNumber)
+	}
+	if !hasPageTrailers(f.filename) {
+		return f.writeRawPage(data, pgNumber)
+	}
+	return f.writeRawPage(encodePage(c, data, pgNumber), pgNumber)
+}
+
+// Raw pages are written back as they were read by readRawPage
+func (f *pageFile) writeRawPage(raw []byte, pgNumber uint32) error {
+	if err := f.open(true); err != nil {
+		return err
+	}
+	if f.slots != nil {
+		data, err := decodeFilePage(f.filename, raw, pgNumber)
+		if err != nil {
+			return err
+		}
+		return f.slots.writePage(encodeSlotPage(fileCipher(f.filename), data, pgNumber), pgNumber)
+	}
+	n, err := f.file.WriteAt(raw, pageOffset(f.filename, pgNumber))
+	f.stats.addWrite(n)
+	return err
+}
+
+func (f *pageFile) numPages() (uint32, error) {
+	if err := f.open(false); os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if f.slots != nil {
+		return f.slots.numPages, nil
+	}
+	size, err := f.file.Size()
+	if err != nil {
+		return 0, err
+	}
+	return uint32(size / int64(diskPageSize(f.filename))), nil
+}
+
+func (f *pageFile) truncate(numPages uint32) error {
+	if err := f.open(true); err != nil {
+		return err
+	}
+	f.unmap()
+	if f.slots != nil && numPages > 0 {
+		empty := encodeSlotPage(fileCipher(f.filename), make([]byte, PageSize(f.filename)), numPages-1)
+		return f.slots.truncate(numPages, empty)
+	} else if f.slots != nil {
+		return f.slots.truncate(numPages, nil)
+	}
+	return f.file.Truncate(pageOffset(f.filename, numPages))
+}
+
+func (f *pageFile) sync() error {
+	if f.file == nil {
+		return nil
+	}
+	f.stats.addSync()
+	if f.slots != nil {
+		return f.slots.sync()
+	}
+	return f.file.Sync()
+}
+
+// Read the start of page 0 without knowing the page size
+func (f *pageFile) readHeader(length int) ([]byte, error) {
+	if err := f.open(false); err != nil {
+		return nil, err
+	}
+	c := fileCipher(f.filename)
+	if c != nil {
+		return f.readEncryptedHeader(c, length)
+	}
+	data := make([]byte, length)
+	if f.slots != nil {
+		payload, err := f.slots.readPage(0)
+		if err != nil {
+			return nil, err
+		}
+		raw, err1 := inflatePage(f.filename, payload, 0)
+		if err1 != nil {
+			return nil, err1
+		} else if len(raw) < length {
+			return nil, io.EOF
+		}
+		copy(data, raw)
+	} else if _, err := f.file.ReadAt(data, 0); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Compressed and encrypted files always had trailers, a plain file has one if it follows page 0
+// A file written without trailers holds page 1 there, or ends before it
+func (f *pageFile) hasTrailers() (bool, error) {
+	if err := f.open(false); err != nil {
+		return false, err
+	}
+	if f.slots != nil || fileCipher(f.filename) != nil {
+		return true, nil
+	}
+	pgSize := PageSize(f.filename)
+	raw := make([]byte, pgSize+PAGE_TRAILER_SIZE)
+	if _, err := f.file.ReadAt(raw, 0); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return binary.LittleEndian.Uint32(raw[pgSize+4:]) == 0 &&
+		binary.LittleEndian.Uint32(raw[pgSize:]) == pageChecksum(raw[:pgSize], 0), nil
+}
+
+// Page 0 can only be opened whole, so each page size is tried until one opens
+func (f *pageFile) readEncryptedHeader(c *pageCipher, length int) ([]byte, error) {
+	var raws [][]byte
+	if f.slots != nil {
+		//Compressed pages are kept whole, so the page size is known from the slot
+		payload, err := f.slots.readPage(0)
+		if err != nil {
+			return nil, err
+		}
+		if data, err := decodeSlotPage(f.filename, c, payload, 0); err == nil && len(data) >= length {
+			return data[:length], nil
+		}
+	} else {
+		for pgSize := MIN_PGSIZE; pgSize <= MAX_PGSIZE; pgSize *= 2 {
+			raw := make([]byte, pgSize+c.trailerSize())
+			if _, err := f.file.ReadAt(raw, 0); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			raws = append(raws, raw)
+		}
+	}
+	for _, raw := range raws {
+		if data, err := decodePage(f.filename, c, raw, 0); err == nil && len(data) >= length {
+			return data[:length], nil
+		}
+	}
+	return nil, &PageIOError{f.filename, "cannot decrypt header, wrong key or not encrypted"}
+}
+
+// Pages of a file without trailers are copied to this file with trailers, which then replaces it
+const UPGRADE_SUFFIX string = "-upgrade"
+
+// Write a trailer after every page of a file written before pages had one, nothing is done for other files
+// The file is replaced at once by a copy, so a crash leaves the old file or the new one
+func AddPageTrailers(filename string) error {
+	if hasPageTrailers(filename) {
+		return nil
+	}
+	unlock, err := lockDatabaseAlone(filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if getPagerManager().isOpen(filename) {
+		return &PageIOError{filename, "cannot add page trailers to an open file"}
+	}
+	if err1 := copyWithTrailers(filename, filename+UPGRADE_SUFFIX); err1 != nil {
+		removeStorage(filename + UPGRADE_SUFFIX)
 		return err1
 	}
-	defer file.Close()
-	return file.Truncate(int64(targetNumberPages * PGSIZE))
+	if err2 := renameStorage(filename+UPGRADE_SUFFIX, filename); err2 != nil {
+		return err2
+	}
+	if err3 := syncDir(filename); err3 != nil {
+		return err3
+	}
+	return SetPageTrailers(filename, true)
+}
+
+// Remove the database file with its journal, its log and its change tracking before it is created again
+func RemoveDatabase(filename string) error {
+	unlock, err := lockDatabaseAlone(filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if getPagerManager().isOpen(filename) {
+		return &PageIOError{filename, "cannot remove an open file"}
+	}
+	if err1 := removeDatabaseFiles(filename); err1 != nil {
+		return err1
+	}
+	return syncDir(filename)
 }
 
-func createFile(filename string, targetNumberPages uint32) error {
-	file, err1 := os.Create(filename)
+func copyWithTrailers(filename string, dst string) error {
+	src := openPageFile(filename, 0, nil)
+	defer src.close()
+	numPages, err1 := src.numPages()
 	if err1 != nil {
-		file.Close()
+		return err1
 	}
-	return err1
+	removeStorage(dst)
+	file, err2 := openStorage(dst, true)
+	if err2 != nil {
+		return err2
+	}
+	defer file.Close()
+	diskSize := int64(PageSize(filename) + PAGE_TRAILER_SIZE)
+	for pgNumber := uint32(0); pgNumber < numPages; pgNumber++ {
+		data, err3 := src.loadPage(pgNumber)
+		if err3 != nil {
+			return err3
+		}
+		if _, err4 := file.WriteAt(encodePage(nil, data, pgNumber), diskSize*int64(pgNumber)); err4 != nil {
+			return err4
+		}
+	}
+	return file.Sync()
+}
+
+// Helpers for callers without a pager, the file is opened for each call
+
+func loadPage(filename string, pgNumber uint32) ([]byte, error) {
+	f := openPageFile(filename, 0, nil)
+	defer f.close()
+	return f.loadPage(pgNumber)
+}
+
+func writePage(filename string, data []byte, pgNumber uint32) error {
+	f := openPageFile(filename, 0, nil)
+	defer f.close()
+	return f.writePage(data, pgNumber)
+}
+
+func countPages(filename string) (uint32, error) {
+	f := openPageFile(filename, 0, nil)
+	defer f.close()
+	return f.numPages()
 }
@@ -0,0 +1,199 @@
+package pager
+
+import (
+	"os"
+	"testing"
+)
+
+func TestPageChecksum(t *testing.T) {
+	filename := "/tmp/test_checksum.gsdl"
+	removeTestDb(filename)
+	defer removeTestDb(filename)
+	data := make([]byte, PGSIZE)
+	data[10] = 42
+	if err := writePage(filename, data, 3); err != nil {
+		t.Fatalf("Cannot write page %v", err)
+	}
+	if _, err := loadPage(filename, 3); err != nil {
+		t.Errorf("Cannot load written page %v", err)
+	}
+	if _, err := loadPage(filename, 1); err != nil {
+		t.Errorf("Hole before written page not read as zero page %v", err)
+	}
+	file, _ := os.OpenFile(filename, os.O_WRONLY, 0660)
+	file.WriteAt([]byte{43}, pageOffset(filename, 3)+10)
+	file.Close()
+	_, err := loadPage(filename, 3)
+	corruption, ok := err.(*CorruptionError)
+	if !ok {
+		t.Fatalf("Bit flip not detected, get %v", err)
+	}
+	if corruption.PgNumber != 3 || corruption.Filename != filename {
+		t.Errorf("Wrong corrupted page reported %v", corruption)
+	}
+	//A page zeroed on disk is not taken for an empty page
+	file, _ = os.OpenFile(filename, os.O_WRONLY, 0660)
+	file.WriteAt(make([]byte, diskPageSize(filename)), pageOffset(filename, 1))
+	file.Close()
+	if _, err := loadPage(filename, 1); err == nil {
+		t.Error("Zeroed page not reported corrupted")
+	} else if _, ok := err.(*CorruptionError); !ok {
+		t.Errorf("Wrong error for zeroed page %v", err)
+	}
+}
+
+func TestPageSize(t *testing.T) {
+	filename := "/tmp/test_page_size.gsdl"
+	removeTestDb(filename)
+	defer removeTestDb(filename)
+	if err := SetPageSize(filename, 3000); err == nil {
+		t.Error("Page size which is not a power of two accepted")
+	}
+	if err := SetPageSize(filename, 1024); err != nil {
+		t.Fatalf("Cannot set page size %v", err)
+	}
+	defer SetPageSize(filename, PGSIZE)
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	if wt.PageSize() != 1024 {
+		t.Errorf("Wrong page size of transaction %d", wt.PageSize())
+	}
+	if err := SetPageSize(filename, 2048); err == nil {
+		t.Error("Page size changed while the file is open")
+	}
+	for i := 0; i < 4; i++ {
+		wt.WritePage(uint32(i), make([]byte, 1024))
+	}
+	wt.EndTransaction()
+	info, _ := os.Stat(filename)
+	if info.Size() != 4*int64(1024+PAGE_TRAILER_SIZE) {
+		t.Errorf("Wrong file size %d", info.Size())
+	}
+	if _, err := loadPage(filename, 3); err != nil {
+		t.Errorf("Cannot load small page %v", err)
+	}
+}
+
+func TestMmapReads(t *testing.T) {
+	filename := "/tmp/test_mmap.gsdl"
+	removeTestDb(filename)
+	defer removeTestDb(filename)
+	SetMmapSize(filename, 1<<20)
+	defer SetMmapSize(filename, 0)
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	for i := 0; i < 4; i++ {
+		testWritePage(t, wt, uint32(i), 1)
+	}
+	wt.EndTransaction()
+	rt := &ReadTransaction{}
+	rt.StartTransaction(filename)
+	expectPageValue(t, rt, 3, 1)
+	if rt.pager.file.mapped == nil {
+		t.Error("Pages not read through mapping")
+	}
+	//The rollback cuts the file under the mapping
+	wt.StartTransaction(filename)
+	for i := 0; i < 8; i++ {
+		testWritePage(t, wt, uint32(i), 2)
+	}
+	wt.Sync()
+	expectPageValue(t, rt, 3, 1)
+	wt.AbortTransaction()
+	wt.EndTransaction()
+	for i := 0; i < 4; i++ {
+		expectPageValue(t, rt, uint32(i), 1)
+	}
+	if _, err := rt.ReadPage(6); err == nil {
+		t.Error("Page cut by rollback still readable")
+	}
+	rt.EndTransaction()
+}
+
+func TestBaselineLayout(t *testing.T) {
+	filename := "/tmp/test_baseline_layout.gsdl"
+	removeTestDb(filename)
+	defer removeTestDb(filename)
+	//Files written before pages had a trailer hold the pages back to back
+	raw := make([]byte, 3*PGSIZE)
+	for i := range raw {
+		raw[i] = byte(i/int(PGSIZE) + 1)
+	}
+	os.WriteFile(filename, raw, 0660)
+	if trailers, err := HasPageTrailers(filename); err != nil || trailers {
+		t.Fatalf("Baseline file taken as having trailers, %v", err)
+	}
+	SetPageTrailers(filename, false)
+	defer SetPageTrailers(filename, true)
+	rt := &ReadTransaction{}
+	if err := rt.StartTransaction(filename); err != nil {
+		t.Fatalf("Cannot open baseline file %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		expectPageValue(t, rt, uint32(i), byte(i+1))
+	}
+	rt.EndTransaction()
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	testWritePage(t, wt, 1, 9)
+	wt.Sync()
+	wt.AbortTransaction()
+	wt.EndTransaction()
+	wt.StartTransaction(filename)
+	expectPageValue(t, wt, 1, 2)
+	testWritePage(t, wt, 3, 4)
+	wt.EndTransaction()
+	if info, _ := os.Stat(filename); info.Size() != 4*int64(PGSIZE) {
+		t.Errorf("Pages of baseline file written with trailers, size %d", info.Size())
+	}
+	SetPageTrailers(filename, true)
+	removeTestDb(filename)
+	writePage(filename, make([]byte, PGSIZE), 0)
+	if trailers, err := HasPageTrailers(filename); err != nil || !trailers {
+		t.Errorf("Trailers of new file not found, %v", err)
+	}
+}
+
+func TestAddPageTrailers(t *testing.T) {
+	filename := ":memory:test_add_trailers.gsdl"
+	removeTestDb(filename)
+	file, _ := openStorage(filename, true)
+	for i := 0; i < 3; i++ {
+		data := make([]byte, PGSIZE)
+		data[0] = byte(i + 1)
+		file.WriteAt(data, int64(i)*int64(PGSIZE))
+	}
+	SetPageTrailers(filename, false)
+	defer SetPageTrailers(filename, true)
+	if err := AddPageTrailers(filename); err != nil {
+		t.Fatalf("Cannot add page trailers %v", err)
+	}
+	if trailers, err := HasPageTrailers(filename); err != nil || !trailers || !hasPageTrailers(filename) {
+		t.Errorf("Trailers not added, %v", err)
+	}
+	for i := uint32(0); i < 3; i++ {
+		if data, err := loadPage(filename, i); err != nil || data[0] != byte(i+1) {
+			t.Errorf("Wrong page %d after adding trailers %v", i, err)
+		}
+	}
+	if storageExists(filename + UPGRADE_SUFFIX) {
+		t.Error("Copy with trailers left behind")
+	}
+}
+
+func TestRemoveDatabase(t *testing.T) {
+	filename := ":memory:test_remove_database.gsdl"
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	wt.WritePage(0, make([]byte, PGSIZE))
+	wt.EndTransaction()
+	if err := RemoveDatabase(filename); err != nil {
+		t.Fatalf("Cannot remove database %v", err)
+	}
+	if storageExists(filename) || storageExists(journalFilename(filename)) {
+		t.Error("Database files left behind")
+	}
+	if err := RemoveDatabase(filename); err != nil {
+		t.Errorf("Cannot remove missing database %v", err)
+	}
+}
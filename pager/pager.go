@@ -1,25 +1,49 @@
 package pager
 
 import (
+	"fmt"
+	"io"
 	"log"
+	"sort"
 	"sync"
-
-	lru "github.com/hashicorp/golang-lru"
 )
 
-const lruCacheSize int = 4096
+// Default number of cached pages, see SetCacheSize
+const defaultCacheSize int = 4096
 
 type WritebackCallback func(filename string, pgData []byte, pgNumber uint32)
 
 type Pager struct {
-	//Cache is thread safe, map in golang can be read concurrently
-	//Locked when there is need to handle evict
-	//No need to lock in WritePage since only one go routine can acquire the rwlock for file in LockManager
+	//Cache and maps are guarded by lock, since readers can run beside the writer in wal mode
+	//Eviction callbacks run inside cache operations, so they are always called with lock held
 	filename    string
-	filecache   *lru.Cache
+	pageSize    uint32
+	file        *pageFile
+	filecache   *bufferPool
 	dirtyMap    map[uint32]bool
+	frameMap    map[uint32]uint32
 	lock        sync.Mutex
 	onWriteback WritebackCallback
+	wal         *wal
+	err         error
+	stats       PagerStats
+	purging     bool
+	//Rollback mode state, the writer's journal and the old page images kept for readers
+	journal      *journal
+	commitSeq    uint64
+	snapshots    map[uint64]int
+	versions     map[uint32][]pageVersion
+	sizeVersions []sizeVersion
+	//Savepoints of the writer, newest last
+	savepoints []*savepoint
+	//Set by the writer when it starts
+	synchronous uint8
+	group       *groupCommit
+	//Commits made through the pager in both modes, a backup starts again when it changes
+	changes uint64
+	//Set while change tracking is on, restoreLsn is the number the next commit takes when a backup is restored
+	tracker    *changeTracker
+	restoreLsn uint64
 }
 
 type pagerManager struct {
@@ -32,16 +56,30 @@ func (manager *pagerManager) OpenPager(filename string, onWriteback WritebackCal
 	manager.lock.Lock()
 	defer manager.lock.Unlock()
 	pager, ok := manager.pagers[filename]
-	filecache, _ := lru.NewWithEvict(lruCacheSize,
-		func(key interface{}, value interface{}) {
-			pager.onEvicted(key, value)
-		})
 	if !ok {
+		config := getFileConfig(filename)
 		pager = &Pager{
 			filename:    filename,
-			filecache:   filecache,
+			pageSize:    config.pageSize,
 			dirtyMap:    map[uint32]bool{},
+			frameMap:    map[uint32]uint32{},
 			onWriteback: onWriteback,
+			snapshots:   map[uint64]int{},
+			versions:    map[uint32][]pageVersion{},
+			synchronous: config.synchronous,
+			group:       newGroupCommit(),
+		}
+		pager.file = openPageFile(filename, config.mmapSize, &pager.stats)
+		pager.stats.CacheSize = config.cacheSize
+		pager.filecache = newBufferPool(config.cacheSize,
+			func(pgNumber uint32, data []byte) {
+				pager.onEvicted(pgNumber, data)
+			})
+		if hasWal(filename) {
+			pager.wal, pager.err = openWal(filename, &pager.stats)
+		}
+		if hasChangeTracking(filename) && pager.err == nil {
+			pager.tracker, pager.err = openChangeTracker(filename)
 		}
 		manager.pagers[filename] = pager
 		manager.pagerRefs[filename] = 1
@@ -51,69 +89,222 @@ func (manager *pagerManager) OpenPager(filename string, onWriteback WritebackCal
 	return pager
 }
 
-func (manager *pagerManager) ClosePager(filename string) {
+func (manager *pagerManager) isOpen(filename string) bool {
 	manager.lock.Lock()
 	defer manager.lock.Unlock()
 	_, ok := manager.pagers[filename]
+	return ok
+}
+
+func (manager *pagerManager) ClosePager(filename string) {
+	manager.lock.Lock()
+	defer manager.lock.Unlock()
+	pager, ok := manager.pagers[filename]
 	if !ok {
 		log.Panicf("File %s not managed by Pager Manager", filename)
 	}
 	manager.pagerRefs[filename]--
 	if manager.pagerRefs[filename] <= 0 {
+		if pager.wal != nil {
+			pager.wal.close()
+		}
+		if pager.tracker != nil {
+			pager.tracker.close()
+		}
+		pager.file.close()
 		delete(manager.pagerRefs, filename)
 		delete(manager.pagers, filename)
 	}
 }
 
-func (pager *Pager) onEvicted(key interface{}, value interface{}) {
-	pager.lock.Lock()
-	defer pager.lock.Unlock()
-	pgNumber := key.(uint32)
+func (pager *Pager) onEvicted(pgNumber uint32, data []byte) {
 	dirty := pager.dirtyMap[pgNumber]
+	if !pager.purging {
+		pager.stats.Evictions++
+	}
 	if dirty {
-		if pager.onWriteback != nil {
-			pager.onWriteback(pager.filename, value.([]byte), pgNumber)
+		pager.stats.Writebacks++
+		if pager.wal != nil {
+			if _, err := pager.wal.appendFrame(pgNumber, data, 0); err != nil {
+				pager.wal.spillErr = err
+			}
+		} else if pager.onWriteback != nil {
+			pager.onWriteback(pager.filename, data, pgNumber)
 		}
 	}
 	delete(pager.dirtyMap, pgNumber)
+	delete(pager.frameMap, pgNumber)
 }
 
 func (pager *Pager) ReadPage(pgNumber uint32) ([]byte, error) {
-	val, ok := pager.filecache.Get(pgNumber)
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	pgData, err := pager.getPageLocked(pgNumber)
+	if err != nil {
+		return nil, err
+	}
+	if pager.wal != nil || len(pager.savepoints) > 0 {
+		//Pages are changed in place by the writer, keep the cached copy intact for wal readers and savepoints
+		return append([]byte(nil), pgData...), nil
+	}
+	return pgData, nil
+}
+
+// Get the cached page, it is loaded into the cache on a miss
+func (pager *Pager) getPageLocked(pgNumber uint32) ([]byte, error) {
+	if pager.err != nil {
+		return nil, pager.err
+	}
+	if val, ok := pager.filecache.Get(pgNumber); ok {
+		pager.stats.Hits++
+		return val, nil
+	}
+	pager.stats.Misses++
+	data, frame, err := pager.loadLatestPage(pgNumber)
+	if err != nil {
+		return nil, err
+	}
+	pager.filecache.Add(pgNumber, data)
+	pager.dirtyMap[pgNumber] = false
+	pager.frameMap[pgNumber] = frame
+	return data, nil
+}
+
+func (pager *Pager) loadLatestPage(pgNumber uint32) ([]byte, uint32, error) {
+	if pager.wal == nil {
+		data, err := pager.file.loadPage(pgNumber)
+		return data, 0, err
+	}
+	if pager.wal.beyondEnd(pgNumber) {
+		return nil, 0, io.EOF
+	}
+	frame, ok := pager.wal.spilled[pgNumber]
 	if !ok {
-		pgData, err := loadPage(pager.filename, pgNumber)
-		if err != nil {
-			return nil, err
-		}
-		pager.filecache.Add(pgNumber, pgData)
-		pager.dirtyMap[pgNumber] = false
-		return pgData, nil
-	} else {
-		return val.([]byte), nil
+		frame = pager.wal.findFrame(pgNumber, pager.wal.maxFrame)
 	}
+	if frame == 0 {
+		data, err := pager.file.loadPage(pgNumber)
+		return data, 0, err
+	}
+	data, err := pager.wal.readFrame(frame)
+	return data, frame, err
 }
 
 func (pager *Pager) WritePage(pgNumber uint32, page []byte) {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	if len(pager.savepoints) > 0 {
+		pager.savePageImageLocked(pgNumber)
+	}
 	pager.filecache.Add(pgNumber, page)
 	pager.dirtyMap[pgNumber] = true
 }
 
+// Pin a page in the cache and return the cached data, which the writer may change in place until UnpinPage
+// Each fetch must be paired with an unpin, pinned pages are never evicted
+func (pager *Pager) FetchPage(pgNumber uint32) ([]byte, error) {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	pgData, err := pager.getPageLocked(pgNumber)
+	if err != nil {
+		return nil, err
+	}
+	if len(pager.savepoints) > 0 {
+		pager.savePageImageLocked(pgNumber)
+	}
+	if pager.wal != nil || len(pager.savepoints) > 0 {
+		//The cached data may be held by wal readers or a savepoint, the writer gets its own copy
+		pgData = append([]byte(nil), pgData...)
+		pager.filecache.Add(pgNumber, pgData)
+		if pager.wal != nil {
+			//Readers must not take the page from the cache while it is changed
+			pager.dirtyMap[pgNumber] = true
+		}
+	}
+	pager.filecache.Pin(pgNumber)
+	return pgData, nil
+}
+
+// Release a page pinned by FetchPage, dirty if its data has been changed
+func (pager *Pager) UnpinPage(pgNumber uint32, dirty bool) error {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	if !pager.filecache.Contains(pgNumber) {
+		//Pins are dropped with the cache when the transaction is aborted
+		return &PageIOError{pager.filename, fmt.Sprintf("page %d not pinned", pgNumber)}
+	}
+	if dirty {
+		pager.dirtyMap[pgNumber] = true
+	}
+	if !pager.filecache.Unpin(pgNumber) {
+		return &PageIOError{pager.filename, fmt.Sprintf("page %d not pinned", pgNumber)}
+	}
+	return nil
+}
+
+func (pager *Pager) setWriteback(onWriteback WritebackCallback) {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	pager.onWriteback = onWriteback
+}
+
+func (pager *Pager) dirtyPages() []uint32 {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	return pager.dirtyPagesLocked()
+}
+
+func (pager *Pager) dirtyPagesLocked() []uint32 {
+	pgNumbers := make([]uint32, 0)
+	for _, pgNumber := range pager.filecache.Keys() {
+		if pager.dirtyMap[pgNumber] {
+			pgNumbers = append(pgNumbers, pgNumber)
+		}
+	}
+	sort.Slice(pgNumbers, func(i, j int) bool { return pgNumbers[i] < pgNumbers[j] })
+	return pgNumbers
+}
+
+// Pages are saved in the journal before they are overwritten
 func (pager *Pager) SyncAllToDisk() error {
-	for _, key := range pager.filecache.Keys() {
-		val, _ := pager.filecache.Get(key)
-		pgData := val.([]byte)
-		err := writePageWithAppend(pager.filename, pgData, key.(uint32))
-		pager.dirtyMap[key.(uint32)] = false
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	return pager.syncAllLocked()
+}
+
+func (pager *Pager) syncAllLocked() error {
+	pgNumbers := pager.dirtyPagesLocked()
+	if err := pager.journalPagesLocked(pgNumbers); err != nil {
+		return err
+	}
+	for _, pgNumber := range pgNumbers {
+		val, ok := pager.filecache.Peek(pgNumber)
+		if !ok {
+			continue
+		}
+		err := pager.file.writePage(val, pgNumber)
 		if err != nil {
 			return err
 		}
+		pager.stats.Writebacks++
+		pager.dirtyMap[pgNumber] = false
 	}
 	return nil
 }
 
 func (pager *Pager) PurgeCache() {
-	pager.filecache.Purge()
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	pager.purgeCacheLocked()
+}
+
+func (pager *Pager) purgeCacheLocked() {
+	//Dirty pages are dropped without write back
 	pager.dirtyMap = map[uint32]bool{}
+	pager.frameMap = map[uint32]uint32{}
+	pager.purging = true
+	pager.filecache.Purge()
+	pager.purging = false
 }
 
 var pagerManagerInstance *pagerManager = nil
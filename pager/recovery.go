@@ -0,0 +1,71 @@
+package pager
+
+import (
+	"context"
+	"fmt"
+)
+
+type RecoveryError struct {
+	filename string
+	msg      string
+}
+
+func (err *RecoveryError) Error() string {
+	return fmt.Sprintf("cannot recover %s: %s", err.filename, err.msg)
+}
+
+func MakeRecoveryError(filename string, msg string) *RecoveryError {
+	return &RecoveryError{
+		filename: filename,
+		msg:      msg,
+	}
+}
+
+// Undo the transaction left in a hot journal and replay the committed frames of the log into the database file
+// Should be called before a database is used after it may have been left by a crash
+func Recover(filename string) error {
+	return RecoverContext(context.Background(), filename)
+}
+
+// Recover with the lock owner of the context, see WithLockOwner
+func RecoverContext(ctx context.Context, filename string) error {
+	unlock, err := lockDatabaseAloneContext(ctx, filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	pager := getPagerManager().OpenPager(filename, nil)
+	defer getPagerManager().ClosePager(filename)
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	rolledBack, err1 := pager.rollbackJournalLocked()
+	if err1 != nil {
+		return &RecoveryError{filename, fmt.Sprintf("journal rollback failed, %v", err1)}
+	}
+	if rolledBack {
+		pager.purgeCacheLocked()
+	}
+	if pager.err != nil {
+		return &RecoveryError{filename, fmt.Sprintf("cannot read log, %v", pager.err)}
+	}
+	if err2 := pager.checkpointLocked(); err2 != nil {
+		return &RecoveryError{filename, fmt.Sprintf("log replay failed, %v", err2)}
+	}
+	return nil
+}
+
+func (pager *Pager) numPages() (uint32, error) {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	return pager.numPagesLocked()
+}
+
+func (pager *Pager) numPagesLocked() (uint32, error) {
+	if w := pager.wal; w != nil && w.shrinking {
+		return w.shrinkSize, nil
+	} else if w != nil && w.maxFrame > 0 {
+		//The log holds the size of the last commit, the file may be bigger until the next checkpoint
+		return w.numPages, nil
+	}
+	return pager.file.numPages()
+}
@@ -0,0 +1,109 @@
+package pager
+
+import (
+	"io"
+	"os"
+)
+
+// Images of the pages as they were when the savepoint was set, nil for pages that did not exist
+// A page is saved the first time it is written after the savepoint
+type savepoint struct {
+	name   string
+	images map[uint32][]byte
+	err    error
+}
+
+func (pager *Pager) setSavepoint(name string) {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	pager.savepoints = append(pager.savepoints, &savepoint{
+		name:   name,
+		images: map[uint32][]byte{},
+	})
+}
+
+// The newest savepoint with the name, -1 if there is none
+func (pager *Pager) findSavepointLocked(name string) int {
+	for i := len(pager.savepoints) - 1; i >= 0; i-- {
+		if pager.savepoints[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Called before a page is overwritten in the cache
+func (pager *Pager) savePageImageLocked(pgNumber uint32) {
+	sp := pager.savepoints[len(pager.savepoints)-1]
+	if _, ok := sp.images[pgNumber]; ok {
+		return
+	}
+	if val, ok := pager.filecache.Peek(pgNumber); ok {
+		sp.images[pgNumber] = val
+		return
+	}
+	data, _, err := pager.loadLatestPage(pgNumber)
+	if err != nil && err != io.EOF && !os.IsNotExist(err) {
+		sp.err = err
+	}
+	sp.images[pgNumber] = data
+}
+
+// Put back the pages written since the savepoint, the savepoint itself is kept
+func (pager *Pager) rollbackToSavepoint(name string) error {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	i := pager.findSavepointLocked(name)
+	if i < 0 {
+		return &WriteTransactionError{pager.filename, "no such savepoint " + name}
+	}
+	for _, sp := range pager.savepoints[i:] {
+		if sp.err != nil {
+			return sp.err
+		}
+	}
+	//Newer savepoints first, so the image saved by the oldest one is left
+	for k := len(pager.savepoints) - 1; k >= i; k-- {
+		for pgNumber, image := range pager.savepoints[k].images {
+			if image == nil {
+				image = make([]byte, pager.pageSize)
+			}
+			pager.filecache.Add(pgNumber, image)
+			pager.dirtyMap[pgNumber] = true
+		}
+	}
+	pager.savepoints = pager.savepoints[:i+1]
+	pager.savepoints[i].images = map[uint32][]byte{}
+	return nil
+}
+
+// Forget the savepoint and the ones set after it, their images move to the savepoint before
+func (pager *Pager) releaseSavepoint(name string) error {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	i := pager.findSavepointLocked(name)
+	if i < 0 {
+		return &WriteTransactionError{pager.filename, "no such savepoint " + name}
+	}
+	if i > 0 {
+		prev := pager.savepoints[i-1]
+		for _, sp := range pager.savepoints[i:] {
+			for pgNumber, image := range sp.images {
+				if _, ok := prev.images[pgNumber]; !ok {
+					prev.images[pgNumber] = image
+				}
+			}
+			if prev.err == nil {
+				prev.err = sp.err
+			}
+		}
+	}
+	pager.savepoints = pager.savepoints[:i]
+	return nil
+}
+
+func (pager *Pager) clearSavepoints() {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	pager.savepoints = nil
+}
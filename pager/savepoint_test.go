@@ -0,0 +1,47 @@
+package pager
+
+import "testing"
+
+func TestSavepoints(t *testing.T) {
+	filename := ":memory:test_savepoint.gsdl"
+	removeTestDb(filename)
+	SetCacheSize(filename, 4)
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	defer wt.EndTransaction()
+	for i := 0; i < 8; i++ {
+		testWritePage(t, wt, uint32(i), 1)
+	}
+	wt.Savepoint("a")
+	//Enough pages to push saved pages out of the cache
+	for i := 0; i < 8; i++ {
+		testWritePage(t, wt, uint32(i), 2)
+	}
+	wt.Savepoint("b")
+	testWritePage(t, wt, 0, 3)
+	testWritePage(t, wt, 9, 3)
+	checkPage := func(pgNumber uint32, value byte) {
+		data, err := wt.ReadPage(pgNumber)
+		if err != nil || data[0] != value {
+			t.Errorf("Wrong page %d, want %d get %v %v", pgNumber, value, data[0], err)
+		}
+	}
+	if err := wt.RollbackTo("b"); err != nil {
+		t.Fatalf("Cannot rollback to savepoint %v", err)
+	}
+	checkPage(0, 2)
+	checkPage(9, 0)
+	testWritePage(t, wt, 1, 3)
+	if err := wt.Release("b"); err != nil {
+		t.Fatalf("Cannot release savepoint %v", err)
+	}
+	if err := wt.RollbackTo("b"); err == nil {
+		t.Error("Released savepoint still set")
+	}
+	if err := wt.RollbackTo("a"); err != nil {
+		t.Fatalf("Cannot rollback to savepoint %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		checkPage(uint32(i), 1)
+	}
+}
@@ -0,0 +1,80 @@
+package pager
+
+// Cut the database to numPages pages for the running writer, the cut pages come back on abort
+// In rollback mode the pages are saved in the journal and the file is cut at once,
+// in wal mode the new size is written with the commit frame and the file is cut by the next checkpoint
+func (pager *Pager) shrinkFile(numPages uint32) error {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	oldNumPages, err1 := pager.numPagesLocked()
+	if err1 != nil {
+		return err1
+	}
+	//Pages written by the writer may not have reached the file yet
+	endPage := oldNumPages
+	for _, pgNumber := range pager.filecache.Keys() {
+		if pgNumber >= endPage {
+			endPage = pgNumber + 1
+		}
+	}
+	if w := pager.wal; w != nil {
+		for pgNumber := range w.spilled {
+			if pgNumber >= endPage {
+				endPage = pgNumber + 1
+			}
+		}
+	}
+	if numPages >= endPage {
+		return nil
+	}
+	if len(pager.savepoints) > 0 {
+		for pgNumber := numPages; pgNumber < endPage; pgNumber++ {
+			pager.savePageImageLocked(pgNumber)
+		}
+	}
+	//Cut pages are dropped from the cache without write back
+	for _, pgNumber := range pager.filecache.Keys() {
+		if pgNumber >= numPages {
+			pager.dirtyMap[pgNumber] = false
+			pager.purging = true
+			pager.filecache.Remove(pgNumber)
+			pager.purging = false
+		}
+	}
+	if w := pager.wal; w != nil {
+		for pgNumber := range w.spilled {
+			if pgNumber >= numPages {
+				delete(w.spilled, pgNumber)
+			}
+		}
+		w.shrinking = true
+		w.shrinkSize = numPages
+		if numPages > oldNumPages {
+			w.shrinkSize = oldNumPages
+		}
+		return nil
+	}
+	if numPages >= oldNumPages {
+		return nil
+	}
+	pgNumbers := make([]uint32, 0, oldNumPages-numPages)
+	for pgNumber := numPages; pgNumber < oldNumPages; pgNumber++ {
+		pgNumbers = append(pgNumbers, pgNumber)
+	}
+	if err2 := pager.journalPagesLocked(pgNumbers); err2 != nil {
+		return err2
+	}
+	return pager.file.truncate(numPages)
+}
+
+// Pages at or beyond the end of the database read as the end of file, unless the writer has written them again
+// The database file keeps the pages cut by a commit until the next checkpoint
+func (w *wal) beyondEnd(pgNumber uint32) bool {
+	if _, ok := w.spilled[pgNumber]; ok {
+		return false
+	}
+	if w.shrinking {
+		return pgNumber >= w.shrinkSize
+	}
+	return w.maxFrame > 0 && pgNumber >= w.numPages
+}
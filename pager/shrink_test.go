@@ -0,0 +1,78 @@
+package pager
+
+import (
+	"io"
+	"testing"
+)
+
+func testShrink(t *testing.T, filename string) {
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	for i := 0; i < 10; i++ {
+		testWritePage(t, wt, uint32(i), 1)
+	}
+	wt.EndTransaction()
+	checkNumPages := func(numPages uint32) {
+		if n, err := wt.NumPages(); err != nil || n != numPages {
+			t.Errorf("Wrong number of pages, want %d get %d %v", numPages, n, err)
+		}
+	}
+	wt.StartTransaction(filename)
+	testWritePage(t, wt, 8, 2)
+	if err := wt.Truncate(4); err != nil {
+		t.Fatalf("Cannot truncate %v", err)
+	}
+	checkNumPages(4)
+	if _, err := wt.ReadPage(8); err != io.EOF {
+		t.Errorf("Truncated page still read, %v", err)
+	}
+	wt.AbortTransaction()
+	wt.EndTransaction()
+	wt.StartTransaction(filename)
+	checkNumPages(10)
+	expectPageValue(t, wt, 8, 1)
+	wt.Savepoint("a")
+	wt.Truncate(4)
+	if err := wt.RollbackTo("a"); err != nil {
+		t.Fatalf("Cannot rollback to savepoint %v", err)
+	}
+	expectPageValue(t, wt, 8, 1)
+	wt.Truncate(4)
+	testWritePage(t, wt, 5, 3)
+	if err := wt.EndTransaction(); err != nil {
+		t.Fatalf("Cannot commit truncate %v", err)
+	}
+	wt.StartTransaction(filename)
+	defer wt.EndTransaction()
+	checkNumPages(6)
+	expectPageValue(t, wt, 3, 1)
+	expectPageValue(t, wt, 4, 0)
+	expectPageValue(t, wt, 5, 3)
+	if _, err := wt.ReadPage(8); err != io.EOF {
+		t.Errorf("Truncated page still read, %v", err)
+	}
+}
+
+func TestShrinkFile(t *testing.T) {
+	filename := ":memory:test_shrink.gsdl"
+	removeTestDb(filename)
+	testShrink(t, filename)
+	if n, _ := countPages(filename); n != 6 {
+		t.Errorf("Wrong file size %d after truncate", n)
+	}
+}
+
+func TestShrinkWal(t *testing.T) {
+	filename := ":memory:test_shrink_wal.gsdl"
+	removeTestDb(filename)
+	if err := SetJournalMode(filename, JOURNAL_MODE_WAL); err != nil {
+		t.Fatalf("Cannot switch to wal mode %v", err)
+	}
+	testShrink(t, filename)
+	if err := Checkpoint(filename); err != nil {
+		t.Fatalf("Cannot checkpoint %v", err)
+	}
+	if n, _ := countPages(filename); n != 6 {
+		t.Errorf("Wrong file size %d after checkpoint", n)
+	}
+}
@@ -0,0 +1,145 @@
+package pager
+
+import "io"
+
+// Image of a page for the readers started before commit validUntil
+type pageVersion struct {
+	validUntil uint64
+	data       []byte
+	err        error
+}
+
+type sizeVersion struct {
+	validUntil uint64
+	numPages   uint32
+}
+
+// Pin the database as it is now for a reader
+// Returns the log mark in wal mode, otherwise the number of the last commit
+func (pager *Pager) pinSnapshot() (uint64, uint32, bool) {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	if pager.wal != nil {
+		return 0, pager.wal.maxFrame, true
+	}
+	pager.snapshots[pager.commitSeq]++
+	return pager.commitSeq, 0, false
+}
+
+func (pager *Pager) unpinSnapshot(seq uint64) {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	pager.snapshots[seq]--
+	if pager.snapshots[seq] <= 0 {
+		delete(pager.snapshots, seq)
+	}
+	if len(pager.snapshots) == 0 {
+		pager.versions = map[uint32][]pageVersion{}
+		pager.sizeVersions = nil
+		return
+	}
+	oldest := pager.commitSeq
+	for s := range pager.snapshots {
+		if s < oldest {
+			oldest = s
+		}
+	}
+	//Versions are appended in commit order, drop those no reader can see anymore
+	for pgNumber, versions := range pager.versions {
+		i := 0
+		for i < len(versions) && versions[i].validUntil <= oldest {
+			i++
+		}
+		if i == len(versions) {
+			delete(pager.versions, pgNumber)
+		} else {
+			pager.versions[pgNumber] = versions[i:]
+		}
+	}
+	i := 0
+	for i < len(pager.sizeVersions) && pager.sizeVersions[i].validUntil <= oldest {
+		i++
+	}
+	pager.sizeVersions = pager.sizeVersions[i:]
+}
+
+// Keep the images saved in the journal for the readers pinned before this commit
+// Called before the journal is removed
+func (pager *Pager) keepVersionsLocked() error {
+	if len(pager.snapshots) == 0 {
+		return nil
+	}
+	j := pager.journal
+	validUntil := pager.commitSeq + 1
+	for pgNumber := range j.savedPages {
+		data, _, err := j.readPage(pgNumber)
+		if _, ok := err.(*CorruptionError); err != nil && !ok {
+			return err
+		}
+		pager.versions[pgNumber] = append(pager.versions[pgNumber], pageVersion{validUntil, data, err})
+	}
+	pager.sizeVersions = append(pager.sizeVersions, sizeVersion{validUntil, j.numPages})
+	return nil
+}
+
+// Number of pages committed at seq in rollback mode
+func (pager *Pager) numPagesAtSeq(seq uint64) (uint32, error) {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	for _, size := range pager.sizeVersions {
+		if size.validUntil > seq {
+			return size.numPages, nil
+		}
+	}
+	if j := pager.journal; j != nil {
+		return j.numPages, nil
+	}
+	return pager.file.numPages()
+}
+
+// Read a page as it was committed at seq in rollback mode
+// Pages changed after seq come from their saved versions, the others from the cache while no writer changes it in place
+func (pager *Pager) readPageAtSeq(pgNumber uint32, seq uint64) ([]byte, error) {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	for _, size := range pager.sizeVersions {
+		if size.validUntil > seq {
+			if pgNumber >= size.numPages {
+				return nil, io.EOF
+			}
+			break
+		}
+	}
+	for _, version := range pager.versions[pgNumber] {
+		if version.validUntil > seq {
+			pager.stats.Hits++
+			if version.err != nil {
+				return nil, version.err
+			}
+			return append([]byte(nil), version.data...), nil
+		}
+	}
+	//Between writers the cache holds the last commit, which the reader sees for pages not changed after seq
+	writing := pager.onWriteback != nil
+	if val, ok := pager.filecache.Peek(pgNumber); ok && !writing && !pager.dirtyMap[pgNumber] {
+		pager.stats.Hits++
+		return append([]byte(nil), val...), nil
+	}
+	//Pages the running writer has put on disk are read back from its journal
+	pager.stats.Misses++
+	if j := pager.journal; j != nil {
+		if pgNumber >= j.numPages {
+			return nil, io.EOF
+		}
+		if data, ok, err := j.readPage(pgNumber); ok {
+			return data, err
+		}
+	}
+	data, err := pager.file.loadPage(pgNumber)
+	if err != nil || writing || pager.filecache.Contains(pgNumber) {
+		return data, err
+	}
+	pager.filecache.Add(pgNumber, data)
+	pager.dirtyMap[pgNumber] = false
+	return append([]byte(nil), data...), nil
+}
@@ -0,0 +1,70 @@
+package pager
+
+import "testing"
+
+func TestRollbackReaderSnapshot(t *testing.T) {
+	filename := "/tmp/test_rollback_snapshot.gsdl"
+	removeTestDb(filename)
+	defer removeTestDb(filename)
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	for i := 0; i < 4; i++ {
+		testWritePage(t, wt, uint32(i), 1)
+	}
+	wt.EndTransaction()
+	rt := &ReadTransaction{}
+	rt.StartTransaction(filename)
+	//The writer must not wait for the reader
+	wt.StartTransaction(filename)
+	for i := 0; i < 6; i++ {
+		testWritePage(t, wt, uint32(i), 2)
+	}
+	if err := wt.Sync(); err != nil {
+		t.Error("Cannot sync pages to disk")
+	}
+	for i := 0; i < 4; i++ {
+		expectPageValue(t, rt, uint32(i), 1)
+	}
+	if err := wt.EndTransaction(); err != nil {
+		t.Error("Cannot commit second transaction")
+	}
+	for i := 0; i < 4; i++ {
+		expectPageValue(t, rt, uint32(i), 1)
+	}
+	if _, err := rt.ReadPage(5); err == nil {
+		t.Error("Reader sees page created after its snapshot")
+	}
+	rt2 := &ReadTransaction{}
+	rt2.StartTransaction(filename)
+	wt.StartTransaction(filename)
+	testWritePage(t, wt, 0, 3)
+	wt.EndTransaction()
+	expectPageValue(t, rt, 0, 1)
+	expectPageValue(t, rt2, 0, 2)
+	expectPageValue(t, rt2, 5, 2)
+	rt.EndTransaction()
+	expectPageValue(t, rt2, 0, 2)
+	rt2.EndTransaction()
+	rt.StartTransaction(filename)
+	expectPageValue(t, rt, 0, 3)
+	if len(rt.pager.versions) != 0 {
+		t.Error("Old page versions kept after readers ended")
+	}
+	//Pages not changed after the snapshot are served from the cache once loaded
+	expectPageValue(t, rt, 1, 2)
+	hits := rt.pager.Stats().Hits
+	expectPageValue(t, rt, 1, 2)
+	if rt.pager.Stats().Hits == hits {
+		t.Error("Unchanged page not read from the cache")
+	}
+	//The writer's pages in the cache are not seen before or after its commit
+	wt.StartTransaction(filename)
+	testWritePage(t, wt, 1, 4)
+	expectPageValue(t, rt, 1, 2)
+	wt.EndTransaction()
+	expectPageValue(t, rt, 1, 2)
+	rt.EndTransaction()
+	rt.StartTransaction(filename)
+	expectPageValue(t, rt, 1, 4)
+	rt.EndTransaction()
+}
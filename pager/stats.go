@@ -0,0 +1,44 @@
+package pager
+
+// Counters of a pager since the file was opened
+// Writebacks are dirty pages written to the file or the log, bytes count the journal and the log too
+type PagerStats struct {
+	CacheSize    int
+	CachedPages  int
+	PinnedPages  int
+	Hits         uint64
+	Misses       uint64
+	Evictions    uint64
+	Writebacks   uint64
+	BytesRead    uint64
+	BytesWritten uint64
+	Syncs        uint64
+}
+
+// Files opened without a pager have no stats, so the counters accept nil
+func (stats *PagerStats) addRead(n int) {
+	if stats != nil {
+		stats.BytesRead += uint64(n)
+	}
+}
+
+func (stats *PagerStats) addWrite(n int) {
+	if stats != nil {
+		stats.BytesWritten += uint64(n)
+	}
+}
+
+func (stats *PagerStats) addSync() {
+	if stats != nil {
+		stats.Syncs++
+	}
+}
+
+func (pager *Pager) Stats() PagerStats {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	stats := pager.stats
+	stats.CachedPages = pager.filecache.Len()
+	stats.PinnedPages = pager.filecache.Pinned()
+	return stats
+}
@@ -0,0 +1,232 @@
+package pager
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Files named with this prefix live in memory until they are removed or the process ends
+const MEMORY_PREFIX string = ":memory:"
+
+const (
+	LOCK_NONE int = iota
+	LOCK_SHARED
+	LOCK_EXCLUSIVE
+)
+
+// Bytes of one file of a database, the database file, its journal, its log or its lock file
+// Lock changes the lock other processes see, returns errLockBusy if another process holds it
+type Storage interface {
+	ReadAt(p []byte, off int64) (int, error)
+	WriteAt(p []byte, off int64) (int, error)
+	Truncate(size int64) error
+	Size() (int64, error)
+	Sync() error
+	Lock(level int) error
+	Close() error
+}
+
+func isMemoryStorage(name string) bool {
+	return strings.HasPrefix(name, MEMORY_PREFIX)
+}
+
+func openStorage(name string, create bool) (Storage, error) {
+	if isMemoryStorage(name) {
+		return openMemStorage(name, create)
+	}
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+	}
+	file, err := os.OpenFile(name, flag, 0660)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStorage{file}, nil
+}
+
+func removeStorage(name string) error {
+	if isMemoryStorage(name) {
+		return removeMemStorage(name)
+	}
+	return os.Remove(name)
+}
+
+// Remove a database file with its journal, its log and its change tracking, missing files are skipped
+func removeDatabaseFiles(filename string) error {
+	for _, name := range []string{filename, journalFilename(filename), walFilename(filename), changesFilename(filename)} {
+		if err := removeStorage(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace the file newName with the file name
+func renameStorage(name string, newName string) error {
+	if isMemoryStorage(name) {
+		memFilesLock.Lock()
+		defer memFilesLock.Unlock()
+		s, ok := memFiles[name]
+		if !ok {
+			return &os.PathError{Op: "rename", Path: name, Err: os.ErrNotExist}
+		}
+		memFiles[newName] = s
+		delete(memFiles, name)
+		return nil
+	}
+	return os.Rename(name, newName)
+}
+
+func storageExists(name string) bool {
+	if isMemoryStorage(name) {
+		memFilesLock.Lock()
+		defer memFilesLock.Unlock()
+		_, ok := memFiles[name]
+		return ok
+	}
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// Make the creation or removal of a file durable
+func syncDir(name string) error {
+	if isMemoryStorage(name) {
+		return nil
+	}
+	dir, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+type fileStorage struct {
+	file *os.File
+}
+
+func (s *fileStorage) ReadAt(p []byte, off int64) (int, error) {
+	return s.file.ReadAt(p, off)
+}
+
+func (s *fileStorage) WriteAt(p []byte, off int64) (int, error) {
+	return s.file.WriteAt(p, off)
+}
+
+func (s *fileStorage) Truncate(size int64) error {
+	return s.file.Truncate(size)
+}
+
+func (s *fileStorage) Size() (int64, error) {
+	info, err := s.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *fileStorage) Sync() error {
+	return s.file.Sync()
+}
+
+func (s *fileStorage) Lock(level int) error {
+	return tryLockFile(s.file, level)
+}
+
+// Closing the file drops its os lock
+func (s *fileStorage) Close() error {
+	return s.file.Close()
+}
+
+func (s *fileStorage) mmap(size int64) ([]byte, error) {
+	return mmapFile(s.file, size)
+}
+
+// Memory files are shared by every handle opened with the same name
+type memStorage struct {
+	data []byte
+	lock sync.RWMutex
+}
+
+var memFiles map[string]*memStorage = map[string]*memStorage{}
+var memFilesLock sync.Mutex
+
+func openMemStorage(name string, create bool) (Storage, error) {
+	memFilesLock.Lock()
+	defer memFilesLock.Unlock()
+	s, ok := memFiles[name]
+	if !ok {
+		if !create {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		s = &memStorage{}
+		memFiles[name] = s
+	}
+	return s, nil
+}
+
+func removeMemStorage(name string) error {
+	memFilesLock.Lock()
+	defer memFilesLock.Unlock()
+	if _, ok := memFiles[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(memFiles, name)
+	return nil
+}
+
+func (s *memStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if off >= int64(len(s.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *memStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if end := off + int64(len(p)); end > int64(len(s.data)) {
+		s.data = append(s.data, make([]byte, end-int64(len(s.data)))...)
+	}
+	return copy(s.data[off:], p), nil
+}
+
+func (s *memStorage) Truncate(size int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if size <= int64(len(s.data)) {
+		s.data = s.data[:size]
+	} else {
+		s.data = append(s.data, make([]byte, size-int64(len(s.data)))...)
+	}
+	return nil
+}
+
+func (s *memStorage) Size() (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return int64(len(s.data)), nil
+}
+
+func (s *memStorage) Sync() error {
+	return nil
+}
+
+// Memory files are never seen by other processes
+func (s *memStorage) Lock(level int) error {
+	return nil
+}
+
+func (s *memStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,40 @@
+package pager
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	filename := ":memory:test_storage.gsdl"
+	removeTestDb(filename)
+	wt := &WriteTransaction{}
+	if err := wt.StartTransaction(filename); err != nil {
+		t.Fatalf("Cannot start transaction %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		testWritePage(t, wt, uint32(i), byte(i))
+	}
+	if err := wt.EndTransaction(); err != nil {
+		t.Fatalf("Cannot commit %v", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Error("Memory database written to disk")
+	}
+	if storageExists(journalFilename(filename)) {
+		t.Error("Journal left after commit")
+	}
+	rt := &ReadTransaction{}
+	rt.StartTransaction(filename)
+	data, err := rt.ReadPage(7)
+	if err != nil || data[0] != 7 {
+		t.Errorf("Wrong page read back %v", err)
+	}
+	rt.EndTransaction()
+	removeTestDb(filename)
+	rt.StartTransaction(filename)
+	if _, err := rt.ReadPage(0); err == nil {
+		t.Error("Removed memory database still readable")
+	}
+	rt.EndTransaction()
+}
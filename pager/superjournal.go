@@ -0,0 +1,261 @@
+package pager
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const SUPER_JOURNAL_SUFFIX string = "-super-"
+
+const superJournalMagic uint32 = 0x50555347
+
+const superTrailerMagic uint64 = 0x52455055534c4a47
+
+const superTrailerSize int64 = 16
+
+// A commit of several databases is made atomic by a super journal listing them
+// The journal of each database ends with a trailer naming the super journal, which is the name,
+// its length, its crc32 checksum and the magic
+// Removing the super journal commits all the databases at once, a journal naming a super journal
+// which is gone belongs to a committed transaction and is removed instead of rolled back
+func superJournalFilename(filename string) (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	//A new name for each commit, so a journal left by an older commit never names it
+	return filename + SUPER_JOURNAL_SUFFIX + hex.EncodeToString(id), nil
+}
+
+func createSuperJournal(name string, filenames []string, sync bool) error {
+	file, err1 := openStorage(name, true)
+	if err1 != nil {
+		return err1
+	}
+	defer file.Close()
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint32(data[0:4], superJournalMagic)
+	binary.LittleEndian.PutUint32(data[4:8], uint32(len(filenames)))
+	for _, filename := range filenames {
+		entry := make([]byte, 4, 4+len(filename))
+		binary.LittleEndian.PutUint32(entry, uint32(len(filename)))
+		data = append(data, append(entry, filename...)...)
+	}
+	if _, err2 := file.WriteAt(data, 0); err2 != nil {
+		return err2
+	}
+	if !sync {
+		return nil
+	}
+	if err3 := file.Sync(); err3 != nil {
+		return err3
+	}
+	return syncDir(name)
+}
+
+func readSuperJournal(name string) ([]string, error) {
+	file, err1 := openStorage(name, false)
+	if err1 != nil {
+		return nil, err1
+	}
+	defer file.Close()
+	size, err2 := file.Size()
+	if err2 != nil {
+		return nil, err2
+	}
+	data := make([]byte, size)
+	if _, err3 := file.ReadAt(data, 0); err3 != nil && err3 != io.EOF {
+		return nil, err3
+	}
+	if size < 8 || binary.LittleEndian.Uint32(data[0:4]) != superJournalMagic {
+		return nil, &PageIOError{name, "bad super journal"}
+	}
+	filenames := make([]string, 0, binary.LittleEndian.Uint32(data[4:8]))
+	for offset := int64(8); offset+4 <= size; {
+		length := int64(binary.LittleEndian.Uint32(data[offset : offset+4]))
+		if offset+4+length > size {
+			return nil, &PageIOError{name, "bad super journal"}
+		}
+		filenames = append(filenames, string(data[offset+4:offset+4+length]))
+		offset += 4 + length
+	}
+	return filenames, nil
+}
+
+// Name the super journal at the end of the journal, no page is saved after it
+func (j *journal) setSuper(name string, sync bool) error {
+	trailer := make([]byte, len(name), len(name)+int(superTrailerSize))
+	copy(trailer, name)
+	tail := make([]byte, superTrailerSize)
+	binary.LittleEndian.PutUint32(tail[0:4], uint32(len(name)))
+	binary.LittleEndian.PutUint32(tail[4:8], crc32.ChecksumIEEE([]byte(name)))
+	binary.LittleEndian.PutUint64(tail[8:16], superTrailerMagic)
+	trailer = append(trailer, tail...)
+	if _, err := j.file.WriteAt(trailer, j.size); err != nil {
+		return err
+	}
+	j.size += int64(len(trailer))
+	j.unsynced = true
+	if !sync {
+		return nil
+	}
+	return j.sync()
+}
+
+// The super journal named by a journal and where its page records end, no name for a journal of one database
+func journalSuper(file Storage) (string, int64, error) {
+	size, err1 := file.Size()
+	if err1 != nil {
+		return "", 0, err1
+	}
+	if size < journalHeaderSize+superTrailerSize {
+		return "", size, nil
+	}
+	tail := make([]byte, superTrailerSize)
+	if _, err2 := file.ReadAt(tail, size-superTrailerSize); err2 != nil {
+		return "", 0, err2
+	}
+	length := int64(binary.LittleEndian.Uint32(tail[0:4]))
+	if binary.LittleEndian.Uint64(tail[8:16]) != superTrailerMagic ||
+		length > size-journalHeaderSize-superTrailerSize {
+		return "", size, nil
+	}
+	name := make([]byte, length)
+	if _, err3 := file.ReadAt(name, size-superTrailerSize-length); err3 != nil {
+		return "", 0, err3
+	}
+	if crc32.ChecksumIEEE(name) != binary.LittleEndian.Uint32(tail[4:8]) {
+		//A trailer torn by a crash, the super journal was never removed after it
+		return "", size, nil
+	}
+	return string(name), size - superTrailerSize - length, nil
+}
+
+// Remove a super journal once no journal of its databases names it
+func cleanSuperJournal(super string) error {
+	filenames, err1 := readSuperJournal(super)
+	if os.IsNotExist(err1) {
+		return nil
+	} else if err1 != nil {
+		return err1
+	}
+	for _, filename := range filenames {
+		file, err2 := openStorage(journalFilename(filename), false)
+		if os.IsNotExist(err2) {
+			continue
+		} else if err2 != nil {
+			return err2
+		}
+		name, _, err3 := journalSuper(file)
+		file.Close()
+		if err3 != nil {
+			return err3
+		} else if name == super {
+			return nil
+		}
+	}
+	return removeStorage(super)
+}
+
+// Commit the transactions of several databases, after a crash either all or none of the commits are found
+// The databases must be in rollback journal mode, the transactions are ended even when the commit fails
+func EndTransactions(transactions []*WriteTransaction) error {
+	for _, transaction := range transactions {
+		if transaction.walMode {
+			abortTransactions(transactions)
+			return &WriteTransactionError{transaction.filename, "cannot commit with other databases in wal mode"}
+		} else if transaction.aborted {
+			abortTransactions(transactions)
+			return &WriteTransactionError{transaction.filename, "cannot write back"}
+		}
+	}
+	//Writers hold the write lock of their files and readers lock one pager at a time, so the order does not matter
+	for _, transaction := range transactions {
+		transaction.pager.lock.Lock()
+	}
+	journals, super, err := commitTogetherLocked(transactions)
+	for _, transaction := range transactions {
+		transaction.pager.lock.Unlock()
+	}
+	if journals == nil {
+		abortTransactions(transactions)
+		if super != "" {
+			removeStorage(super)
+		}
+		return err
+	}
+	for _, transaction := range transactions {
+		if err1 := transaction.endCommitted(); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// Returns nil journals if the commit failed before it was made, the transactions must then be rolled back
+// before the super journal is removed
+func commitTogetherLocked(transactions []*WriteTransaction) ([]*journal, string, error) {
+	journals := make([]*journal, len(transactions))
+	var changed []*WriteTransaction
+	for i, transaction := range transactions {
+		j, err1 := transaction.pager.prepareCommitLocked()
+		if err1 != nil {
+			return nil, "", err1
+		}
+		journals[i] = j
+		if j != nil {
+			changed = append(changed, transaction)
+		}
+	}
+	if len(changed) > 1 {
+		sync := false
+		filenames := make([]string, 0, len(changed))
+		for _, transaction := range changed {
+			sync = sync || transaction.pager.synchronous != SYNCHRONOUS_OFF
+			filenames = append(filenames, transaction.filename)
+		}
+		super, err2 := superJournalFilename(changed[0].filename)
+		if err2 != nil {
+			return nil, "", err2
+		}
+		if err3 := createSuperJournal(super, filenames, sync); err3 != nil {
+			return nil, super, err3
+		}
+		for _, transaction := range changed {
+			j := transaction.pager.journal
+			if err4 := j.setSuper(super, transaction.pager.synchronous != SYNCHRONOUS_OFF); err4 != nil {
+				return nil, super, err4
+			}
+		}
+		if err5 := removeStorage(super); err5 != nil {
+			return nil, super, err5
+		}
+		if sync {
+			if err6 := syncDir(super); err6 != nil {
+				return journals, "", err6
+			}
+		}
+	}
+	//Committed, a journal not removed names a super journal which is gone
+	var err error
+	for i, transaction := range transactions {
+		if journals[i] == nil {
+			continue
+		}
+		if err7 := transaction.pager.finishCommitLocked(journals[i]); err == nil {
+			err = err7
+		}
+	}
+	return journals, "", err
+}
+
+func abortTransactions(transactions []*WriteTransaction) {
+	for _, transaction := range transactions {
+		transaction.AbortTransaction()
+		transaction.EndTransaction()
+	}
+}
@@ -0,0 +1,113 @@
+package pager
+
+import "testing"
+
+func TestEndTransactions(t *testing.T) {
+	filenames := []string{":memory:test_end_transactions_a.gsdl", ":memory:test_end_transactions_b.gsdl"}
+	transactions := make([]*WriteTransaction, 0, len(filenames))
+	for _, filename := range filenames {
+		removeTestDb(filename)
+		wt := &WriteTransaction{}
+		wt.StartTransaction(filename)
+		for i := 0; i < 4; i++ {
+			testWritePage(t, wt, uint32(i), 1)
+		}
+		transactions = append(transactions, wt)
+	}
+	if err := EndTransactions(transactions); err != nil {
+		t.Fatalf("Cannot commit together %v", err)
+	}
+	for _, filename := range filenames {
+		if hasHotJournal(filename) {
+			t.Errorf("Journal of %s not removed", filename)
+		}
+		rt := &ReadTransaction{}
+		rt.StartTransaction(filename)
+		expectPageValue(t, rt, 3, 1)
+		rt.EndTransaction()
+	}
+	//Databases in wal mode cannot take part
+	SetJournalMode(filenames[1], JOURNAL_MODE_WAL)
+	for i, filename := range filenames {
+		transactions[i].StartTransaction(filename)
+		testWritePage(t, transactions[i], 0, 2)
+	}
+	if err := EndTransactions(transactions); err == nil {
+		t.Error("Database in wal mode committed with others")
+	}
+	rt := &ReadTransaction{}
+	rt.StartTransaction(filenames[0])
+	expectPageValue(t, rt, 0, 1)
+	rt.EndTransaction()
+}
+
+// Leave the state of a crash after the journals of both databases named the super journal
+func crashInCommitTogether(t *testing.T, filenames []string, super string) {
+	for _, filename := range filenames {
+		removeTestDb(filename)
+		wt := &WriteTransaction{}
+		wt.StartTransaction(filename)
+		for i := 0; i < 4; i++ {
+			testWritePage(t, wt, uint32(i), 1)
+		}
+		wt.EndTransaction()
+	}
+	if err := createSuperJournal(super, filenames, true); err != nil {
+		t.Fatalf("Cannot create super journal %v", err)
+	}
+	data := make([]byte, PGSIZE)
+	for _, filename := range filenames {
+		j, err := openJournal(openPageFile(filename, 0, nil))
+		if err != nil {
+			t.Fatal("Cannot open journal")
+		}
+		j.savePages([]uint32{0, 1})
+		j.setSuper(super, true)
+		j.close()
+		writePage(filename, data, 0)
+		writePage(filename, data, 1)
+		writePage(filename, data, 5)
+	}
+}
+
+func TestSuperJournalRollback(t *testing.T) {
+	filenames := []string{":memory:test_super_rollback_a.gsdl", ":memory:test_super_rollback_b.gsdl"}
+	super := filenames[0] + SUPER_JOURNAL_SUFFIX + "test"
+	crashInCommitTogether(t, filenames, super)
+	for i, filename := range filenames {
+		if err := Recover(filename); err != nil {
+			t.Fatalf("Cannot recover %v", err)
+		}
+		if storageExists(super) != (i == 0) {
+			t.Errorf("Super journal kept %v after %d of %d databases recovered", storageExists(super), i+1, len(filenames))
+		}
+		rt := &ReadTransaction{}
+		rt.StartTransaction(filename)
+		expectPageValue(t, rt, 0, 1)
+		if n, _ := rt.NumPages(); n != 4 {
+			t.Errorf("Pages of transaction not committed kept, %d pages", n)
+		}
+		rt.EndTransaction()
+	}
+}
+
+func TestSuperJournalCommitted(t *testing.T) {
+	filenames := []string{":memory:test_super_committed_a.gsdl", ":memory:test_super_committed_b.gsdl"}
+	super := filenames[0] + SUPER_JOURNAL_SUFFIX + "test"
+	crashInCommitTogether(t, filenames, super)
+	//The commit is made once the super journal is gone
+	removeStorage(super)
+	for _, filename := range filenames {
+		wt := &WriteTransaction{}
+		wt.StartTransaction(filename)
+		if hasHotJournal(filename) {
+			t.Error("Journal of committed transaction kept")
+		}
+		expectPageValue(t, wt, 0, 0)
+		expectPageValue(t, wt, 2, 1)
+		if n, _ := wt.NumPages(); n != 6 {
+			t.Errorf("Wrong number of pages after commit %d", n)
+		}
+		wt.EndTransaction()
+	}
+}
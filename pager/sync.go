@@ -0,0 +1,105 @@
+package pager
+
+import (
+	"fmt"
+	"sync"
+)
+
+// How hard commits try to reach the disk
+// Full syncs the journal before the database is written, the database or the log at commit,
+// and the directory when files of the database are created or removed
+// Normal skips the directory syncs, a power loss may lose the last commit but cannot damage the database
+// Off never syncs, a power loss may lose or damage recent commits, a crash of the process alone cannot
+const (
+	SYNCHRONOUS_FULL uint8 = iota
+	SYNCHRONOUS_NORMAL
+	SYNCHRONOUS_OFF
+)
+
+func checkSynchronous(filename string, level uint8) error {
+	if level > SYNCHRONOUS_OFF {
+		return &PageIOError{filename, fmt.Sprintf("unknown synchronous level %d", level)}
+	}
+	return nil
+}
+
+// Set the synchronous level of a file, transactions started later use it unless they set their own
+func SetSynchronous(filename string, level uint8) error {
+	if err := checkSynchronous(filename, level); err != nil {
+		return err
+	}
+	config := getFileConfig(filename)
+	config.synchronous = level
+	fileConfigLock.Lock()
+	defer fileConfigLock.Unlock()
+	fileConfigs[filename] = config
+	return nil
+}
+
+func (pager *Pager) setSynchronous(level uint8) {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	pager.synchronous = level
+}
+
+// Commits to the log wait here for their frames to be synced
+// The first waiter syncs for every commit written so far, the ones coming meanwhile share the next sync
+type groupCommit struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	written uint64
+	synced  uint64
+	syncing bool
+}
+
+func newGroupCommit() *groupCommit {
+	g := &groupCommit{}
+	g.cond = sync.NewCond(&g.lock)
+	return g
+}
+
+// Called when the frames of a commit are written, returns the number to wait for
+func (g *groupCommit) add() uint64 {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.written++
+	return g.written
+}
+
+func (g *groupCommit) wait(seq uint64, syncFunc func() error) error {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for g.synced < seq {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		target := g.written
+		g.lock.Unlock()
+		err := syncFunc()
+		g.lock.Lock()
+		g.syncing = false
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+		g.synced = target
+	}
+	return nil
+}
+
+// Wait until the log is synced up to the commit
+func (pager *Pager) syncWalCommit(seq uint64) error {
+	return pager.group.wait(seq, func() error {
+		pager.lock.Lock()
+		w := pager.wal
+		pager.lock.Unlock()
+		if w == nil {
+			//The log was checkpointed and removed, the database file is synced
+			return nil
+		}
+		w.stats.addSync()
+		return w.file.Sync()
+	})
+}
@@ -0,0 +1,71 @@
+package pager
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSynchronousLevels(t *testing.T) {
+	filename := ":memory:test_sync.gsdl"
+	removeTestDb(filename)
+	if err := SetSynchronous(filename, 7); err == nil {
+		t.Error("Unknown level accepted")
+	}
+	SetSynchronous(filename, SYNCHRONOUS_OFF)
+	defer SetSynchronous(filename, SYNCHRONOUS_FULL)
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	testWritePage(t, wt, 0, 1)
+	stats := wt.Stats()
+	wt.EndTransaction()
+	if wt.Stats().Syncs != stats.Syncs {
+		t.Errorf("Synced with synchronous off %+v", wt.Stats())
+	}
+	//The session level is used instead of the level of the file
+	wt.SetSynchronous(SYNCHRONOUS_NORMAL)
+	wt.StartTransaction(filename)
+	testWritePage(t, wt, 0, 2)
+	stats = wt.Stats()
+	wt.EndTransaction()
+	//The journal is synced before the database is written, the database at commit
+	if wt.Stats().Syncs != stats.Syncs+2 {
+		t.Errorf("Wrong syncs with synchronous normal %+v", wt.Stats())
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	g := newGroupCommit()
+	syncs := 0
+	started := make(chan bool)
+	release := make(chan bool)
+	done := make(chan bool)
+	//The first commit holds its sync until the others are written
+	go func() {
+		g.wait(g.add(), func() error {
+			syncs++
+			started <- true
+			<-release
+			return nil
+		})
+		done <- true
+	}()
+	<-started
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		seq := g.add()
+		wg.Add(1)
+		go func() {
+			g.wait(seq, func() error {
+				syncs++
+				return nil
+			})
+			wg.Done()
+		}()
+	}
+	release <- true
+	<-done
+	wg.Wait()
+	if syncs != 2 {
+		t.Errorf("Commits not grouped, %d syncs", syncs)
+	}
+}
@@ -1,6 +1,7 @@
 package pager
 
 import (
+	"context"
 	"fmt"
 	"log"
 )
@@ -8,27 +9,40 @@ import (
 const ABORT_RETRY int = 10
 
 type Transactioner interface {
-	StartTransaction(filename string)
+	StartTransaction(filename string) error
 	EndTransaction() error
 	AbortTransaction()
 }
 
 type TransactionReader interface {
-	StartTransaction(filename string)
+	StartTransaction(filename string) error
 	EndTransaction() error
 	ReadPage(pgNumber uint32) ([]byte, error)
+	PageSize() uint32
 	AbortTransaction()
 }
 
 type ReadTransaction struct {
 	filename string
 	pager    *Pager
+	//Token holding the locks
+	owner   int64
+	walMode bool
+	walMark uint32
+	seq     uint64
 }
 
 type WriteTransaction struct {
 	filename string
 	pager    *Pager
+	owner    int64
+	walMode  bool
 	aborted  bool
+	//Level set for this session, used instead of the level of the file
+	synchronous    uint8
+	hasSynchronous bool
+	//Commit waiting for the log to be synced
+	syncSeq uint64
 }
 
 type WriteTransactionError struct {
@@ -40,15 +54,66 @@ func (e *WriteTransactionError) Error() string {
 	return fmt.Sprintf("%s: %s", e.filename, e.msg)
 }
 
-func (transaction *ReadTransaction) StartTransaction(filename string) {
+func writerLockName(filename string) string {
+	return filename + "-writer"
+}
+
+// Take every lock of a file for work which needs the database alone, the returned function releases them
+func lockDatabaseAlone(filename string) (func(), error) {
+	return lockDatabaseAloneContext(context.Background(), filename)
+}
+
+func lockDatabaseAloneContext(ctx context.Context, filename string) (func(), error) {
+	manager := getLockManger()
+	owner := lockOwnerOf(ctx)
+	if err := manager.AcquireLockExlusive(ctx, writerLockName(filename), owner); err != nil {
+		return nil, err
+	}
+	if err := manager.AcquireLockExlusive(ctx, filename, owner); err != nil {
+		manager.ReleaseLockExlusive(writerLockName(filename), owner)
+		return nil, err
+	}
+	if err := manager.LockDatabase(filename, true); err != nil {
+		manager.ReleaseLockExlusive(filename, owner)
+		manager.ReleaseLockExlusive(writerLockName(filename), owner)
+		return nil, err
+	}
+	return func() {
+		manager.UnlockDatabase(filename, true)
+		manager.ReleaseLockExlusive(filename, owner)
+		manager.ReleaseLockExlusive(writerLockName(filename), owner)
+	}, nil
+}
+
+func (transaction *ReadTransaction) StartTransaction(filename string) error {
+	return transaction.StartTransactionContext(context.Background(), filename)
+}
+
+// Start the transaction, waiting for transactions of this process at most until the context is done
+// Fails with DeadlockError if the wait would never end, the lock owner is taken from the context, see WithLockOwner
+func (transaction *ReadTransaction) StartTransactionContext(ctx context.Context, filename string) error {
 	transaction.filename = filename
+	transaction.owner = lockOwnerOf(ctx)
+	if err := getLockManger().AcquireLockShared(ctx, filename, transaction.owner); err != nil {
+		return err
+	}
+	if err := getLockManger().LockDatabase(filename, false); err != nil {
+		getLockManger().ReleaseLockShared(filename, transaction.owner)
+		return err
+	}
 	transaction.pager = getPagerManager().OpenPager(filename, nil)
-	getLockManger().AcquireLockShared(filename)
+	//The reader pins the database as it is now, the writer keeps going beside it
+	transaction.seq, transaction.walMark, transaction.walMode = transaction.pager.pinSnapshot()
+	return nil
 }
 
 func (transaction *ReadTransaction) EndTransaction() error {
+	if !transaction.walMode {
+		transaction.pager.unpinSnapshot(transaction.seq)
+	}
 	getPagerManager().ClosePager(transaction.filename)
-	getLockManger().ReleaseLockShared(transaction.filename)
+	getLockManger().UnlockDatabase(transaction.filename, false)
+	getLockManger().ReleaseLockShared(transaction.filename, transaction.owner)
 	return nil
 }
 
@@ -57,49 +122,149 @@ func (transaction *ReadTransaction) AbortTransaction() {
 }
 
 func (transaction *ReadTransaction) ReadPage(pgNumber uint32) ([]byte, error) {
-	return transaction.pager.ReadPage(pgNumber)
+	if transaction.walMode {
+		return transaction.pager.readPageAt(pgNumber, transaction.walMark)
+	}
+	return transaction.pager.readPageAtSeq(pgNumber, transaction.seq)
+}
+
+// Number of pages of the database the reader sees
+func (transaction *ReadTransaction) NumPages() (uint32, error) {
+	if transaction.walMode {
+		return transaction.pager.numPagesAt(transaction.walMark)
+	}
+	return transaction.pager.numPagesAtSeq(transaction.seq)
+}
+
+func (transaction *ReadTransaction) PageSize() uint32 {
+	return transaction.pager.pageSize
+}
+
+func (transaction *ReadTransaction) Stats() PagerStats {
+	return transaction.pager.Stats()
+}
+
+func (transaction *WriteTransaction) StartTransaction(filename string) error {
+	return transaction.StartTransactionContext(context.Background(), filename)
 }
 
-func (transaction *WriteTransaction) StartTransaction(filename string) {
+// See ReadTransaction.StartTransactionContext
+func (transaction *WriteTransaction) StartTransactionContext(ctx context.Context, filename string) error {
 	transaction.filename = filename
-	transaction.pager = getPagerManager().OpenPager(filename,
+	transaction.aborted = false
+	transaction.owner = lockOwnerOf(ctx)
+	//Writers only exclude each other, readers of this process keep the shared file lock
+	if err := getLockManger().AcquireLockExlusive(ctx, writerLockName(filename), transaction.owner); err != nil {
+		return err
+	}
+	if err := getLockManger().LockDatabase(filename, true); err != nil {
+		getLockManger().ReleaseLockExlusive(writerLockName(filename), transaction.owner)
+		return err
+	}
+	transaction.pager = getPagerManager().OpenPager(filename, nil)
+	if transaction.hasSynchronous {
+		transaction.pager.setSynchronous(transaction.synchronous)
+	} else {
+		transaction.pager.setSynchronous(getFileConfig(filename).synchronous)
+	}
+	transaction.walMode = transaction.pager.walMode()
+	if transaction.walMode {
+		return nil
+	}
+	transaction.pager.setWriteback(
 		func(filename string, pgData []byte, pgNumber uint32) {
 			transaction.writeBackPage(filename, pgData, pgNumber)
 		})
-	getLockManger().AcquireLockExlusive(filename)
+	if hasHotJournal(filename) {
+		if err := transaction.pager.abortJournal(); err != nil {
+			transaction.pager.setWriteback(nil)
+			getPagerManager().ClosePager(filename)
+			getLockManger().UnlockDatabase(filename, true)
+			getLockManger().ReleaseLockExlusive(writerLockName(filename), transaction.owner)
+			return &RecoveryError{filename, fmt.Sprintf("journal rollback failed, %v", err)}
+		}
+	}
+	return nil
 }
 
 func (transaction *WriteTransaction) writeBackPage(filename string, pgData []byte, pgNumber uint32) {
 	if transaction.aborted {
 		return
 	}
-	//TODO write data to journal
-	err := writePageWithAppend(filename, pgData, pgNumber)
-	if err != nil {
-		transaction.AbortTransaction()
+	if err := transaction.pager.writeBackLocked(pgData, pgNumber); err != nil {
+		//Called inside cache eviction, the rollback is left to EndTransaction or AbortTransaction
+		transaction.aborted = true
 	}
 }
 
 func (transaction *WriteTransaction) Sync() error {
+	if transaction.walMode {
+		return transaction.pager.spillWal()
+	}
 	return transaction.pager.SyncAllToDisk()
 }
 
+func (transaction *WriteTransaction) commit() error {
+	if transaction.walMode {
+		seq, err := transaction.pager.commitWal()
+		if err != nil {
+			return err
+		}
+		transaction.syncSeq = seq
+		transaction.autoCheckpoint()
+		return nil
+	}
+	return transaction.pager.commitJournal()
+}
+
+// Checkpoint when the log grows big, skipped while readers still hold the file
+func (transaction *WriteTransaction) autoCheckpoint() {
+	if transaction.pager.walFrames() < WAL_AUTOCHECKPOINT {
+		return
+	}
+	if !getLockManger().TryAcquireLockExlusive(transaction.filename, transaction.owner) {
+		return
+	}
+	defer getLockManger().ReleaseLockExlusive(transaction.filename, transaction.owner)
+	transaction.pager.checkpoint()
+}
+
 func (transaction *WriteTransaction) EndTransaction() error {
-	defer getLockManger().ReleaseLockExlusive(transaction.filename)
-	defer getPagerManager().ClosePager(transaction.filename)
+	var err error
 	if !transaction.aborted {
-		err := transaction.pager.SyncAllToDisk()
-		if err != nil {
-			for i := 0; i < ABORT_RETRY; i++ {
-				if transaction.abortTransaction() == nil {
-					return err
-				}
-			}
-			log.Panicf("Cannot abort write transaction even when tried recovery for file %s", transaction.filename)
+		transaction.syncSeq = 0
+		err = transaction.commit()
+		if err == nil {
+			return transaction.endCommitted()
 		}
 	}
-	return nil
-	//TODO add delete journal file here after journal module is done
+	defer getLockManger().ReleaseLockExlusive(writerLockName(transaction.filename), transaction.owner)
+	defer getLockManger().UnlockDatabase(transaction.filename, true)
+	defer getPagerManager().ClosePager(transaction.filename)
+	defer transaction.pager.setWriteback(nil)
+	defer transaction.pager.clearSavepoints()
+	for i := 0; i < ABORT_RETRY; i++ {
+		if transaction.abortTransaction() == nil {
+			return err
+		}
+	}
+	log.Panicf("Cannot abort write transaction even when tried recovery for file %s", transaction.filename)
+	return err
+}
+
+// Release the locks of a committed transaction
+func (transaction *WriteTransaction) endCommitted() error {
+	transaction.pager.setWriteback(nil)
+	transaction.pager.clearSavepoints()
+	getLockManger().UnlockDatabase(transaction.filename, true)
+	getLockManger().ReleaseLockExlusive(writerLockName(transaction.filename), transaction.owner)
+	//The next writer may go on while the log is synced, its commit can share the sync
+	var err error
+	if transaction.syncSeq != 0 {
+		err = transaction.pager.syncWalCommit(transaction.syncSeq)
+	}
+	getPagerManager().ClosePager(transaction.filename)
+	return err
 }
 
 func (transaction *WriteTransaction) AbortTransaction() {
@@ -112,10 +277,17 @@ func (transaction *WriteTransaction) AbortTransaction() {
 }
 
 func (transaction *WriteTransaction) abortTransaction() error {
-	//TODO Add rollback here after the journal module is done
 	transaction.aborted = true
-	transaction.pager.PurgeCache()
-	return nil
+	transaction.pager.clearSavepoints()
+	if transaction.walMode {
+		return transaction.pager.rollbackWal()
+	}
+	return transaction.pager.abortJournal()
+}
+
+// Number of pages committed to the database, pages written in this transaction are not counted
+func (transaction *WriteTransaction) NumPages() (uint32, error) {
+	return transaction.pager.numPages()
 }
 
 func (transaction *WriteTransaction) ReadPage(pgNumber uint32) ([]byte, error) {
@@ -126,6 +298,25 @@ func (transaction *WriteTransaction) ReadPage(pgNumber uint32) ([]byte, error) {
 	return data, err
 }
 
+// Pin a page and return the cached data to change in place, see Pager.FetchPage
+func (transaction *WriteTransaction) FetchPage(pgNumber uint32) ([]byte, error) {
+	data, err := transaction.pager.FetchPage(pgNumber)
+	if transaction.aborted {
+		return nil, &WriteTransactionError{transaction.filename, "cannot write back"}
+	}
+	return data, err
+}
+
+func (transaction *WriteTransaction) UnpinPage(pgNumber uint32, dirty bool) error {
+	if err := transaction.pager.UnpinPage(pgNumber, dirty); err != nil {
+		return err
+	}
+	if transaction.aborted {
+		return &WriteTransactionError{transaction.filename, "cannot write back"}
+	}
+	return nil
+}
+
 func (transaction *WriteTransaction) WritePage(pgNumber uint32, page []byte) error {
 	transaction.pager.WritePage(pgNumber, page)
 	if transaction.aborted {
@@ -133,3 +324,47 @@ func (transaction *WriteTransaction) WritePage(pgNumber uint32, page []byte) err
 	}
 	return nil
 }
+
+// Cut the database to numPages pages, pages at or beyond the end read as io.EOF until they are written again
+func (transaction *WriteTransaction) Truncate(numPages uint32) error {
+	if transaction.aborted {
+		return &WriteTransactionError{transaction.filename, "cannot write back"}
+	}
+	return transaction.pager.shrinkFile(numPages)
+}
+
+func (transaction *WriteTransaction) PageSize() uint32 {
+	return transaction.pager.pageSize
+}
+
+// Set the synchronous level for this session, it is kept when the transaction is started again
+func (transaction *WriteTransaction) SetSynchronous(level uint8) error {
+	if err := checkSynchronous(transaction.filename, level); err != nil {
+		return err
+	}
+	transaction.synchronous = level
+	transaction.hasSynchronous = true
+	if transaction.pager != nil {
+		transaction.pager.setSynchronous(level)
+	}
+	return nil
+}
+
+// Savepoints with the same name may be nested, the newest one is used by RollbackTo and Release
+func (transaction *WriteTransaction) Savepoint(name string) {
+	transaction.pager.setSavepoint(name)
+}
+
+// Undo the writes since the savepoint, the savepoint stays set
+func (transaction *WriteTransaction) RollbackTo(name string) error {
+	return transaction.pager.rollbackToSavepoint(name)
+}
+
+// Keep the writes since the savepoint and forget it with the savepoints set after it
+func (transaction *WriteTransaction) Release(name string) error {
+	return transaction.pager.releaseSavepoint(name)
+}
+
+func (transaction *WriteTransaction) Stats() PagerStats {
+	return transaction.pager.Stats()
+}
@@ -1,6 +1,9 @@
 package pager
 
-import "testing"
+import (
+	"os"
+	"testing"
+)
 
 func testWritePage(t *testing.T, wt *WriteTransaction, pgNumber uint32, value byte) {
 	data := make([]byte, PGSIZE)
@@ -27,10 +30,10 @@ func testReadPage(t *testing.T, transaction TransactionReader, pgNumber uint32,
 func TestReadTransaction(t *testing.T) {
 	TestWriteTransaction(t)
 	readTransaction := &ReadTransaction{}
-	readTransaction.StartTransaction("/tmp/this_exists.gsdl")
+	readTransaction.StartTransaction(":memory:this_exists.gsdl")
 	testReadPage(t, readTransaction, 0, 0)
 	readTransaction.EndTransaction()
-	readTransaction.StartTransaction("/tmp/this_does_not_exist.gsdl")
+	readTransaction.StartTransaction(":memory:this_does_not_exist.gsdl")
 	_, err := readTransaction.ReadPage(0)
 	if err == nil {
 		t.Errorf("Error %v\n", err)
@@ -41,7 +44,7 @@ func TestReadTransaction(t *testing.T) {
 
 func TestWriteTransaction(t *testing.T) {
 	writeTransaction := &WriteTransaction{}
-	writeTransaction.StartTransaction("/tmp/this_exists.gsdl")
+	writeTransaction.StartTransaction(":memory:this_exists.gsdl")
 	data := make([]byte, PGSIZE)
 	writeTransaction.WritePage(0, data)
 	err := writeTransaction.EndTransaction()
@@ -51,8 +54,22 @@ func TestWriteTransaction(t *testing.T) {
 }
 
 func TestReadWriteTransaction(t *testing.T) {
+	testReadWriteTransaction(t, ":memory:test_transaction.gsdl")
+	if _, err := os.Stat(":memory:test_transaction.gsdl"); !os.IsNotExist(err) {
+		t.Error("Memory database written to disk")
+	}
+}
+
+func TestReadWriteTransactionOnFile(t *testing.T) {
+	filename := "/tmp/test_transaction.gsdl"
+	removeTestDb(filename)
+	defer removeTestDb(filename)
+	testReadWriteTransaction(t, filename)
+}
+
+func testReadWriteTransaction(t *testing.T, filename string) {
 	wt := &WriteTransaction{}
-	wt.StartTransaction("/tmp/test_transaction.gsdl")
+	wt.StartTransaction(filename)
 	for i := 0; i < 1024; i++ {
 		testWritePage(t, wt, uint32(i), byte(i))
 	}
@@ -64,7 +81,7 @@ func TestReadWriteTransaction(t *testing.T) {
 		t.Error("Error cannot wirte to gsdl file")
 	}
 	rt := &ReadTransaction{}
-	rt.StartTransaction("/tmp/test_transaction.gsdl")
+	rt.StartTransaction(filename)
 	for i := 0; i < 1024; i++ {
 		testReadPage(t, rt, uint32(i), byte(i))
 	}
@@ -74,3 +91,24 @@ func TestReadWriteTransaction(t *testing.T) {
 	}
 
 }
+
+func TestPagerStats(t *testing.T) {
+	filename := ":memory:test_stats.gsdl"
+	removeTestDb(filename)
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	for i := 0; i < 4; i++ {
+		testWritePage(t, wt, uint32(i), 1)
+	}
+	wt.ReadPage(0)
+	stats := wt.Stats()
+	if stats.Hits != 1 || stats.Misses != 0 || stats.CachedPages != 4 {
+		t.Errorf("Wrong cache stats %+v", stats)
+	}
+	wt.Sync()
+	stats = wt.Stats()
+	if stats.Writebacks != 4 || stats.BytesWritten != 4*uint64(PGSIZE+PAGE_TRAILER_SIZE) {
+		t.Errorf("Wrong write stats %+v", stats)
+	}
+	wt.EndTransaction()
+}
@@ -0,0 +1,521 @@
+package pager
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"sort"
+)
+
+const WAL_SUFFIX string = "-wal"
+
+const WAL_AUTOCHECKPOINT uint32 = 1000
+
+const (
+	JOURNAL_MODE_ROLLBACK uint8 = iota
+	JOURNAL_MODE_WAL
+)
+
+const walMagic uint32 = 0x57415347
+
+const walHeaderSize int64 = 12
+
+const walFrameHeaderSize int64 = 16
+
+// The write ahead log keeps committed page images until they are checkpointed into the database file
+// Each frame is the page number, the database size in pages for a commit frame (0 otherwise),
+// the salt of the log and a crc32 checksum, followed by the page data, sealed if the database is encrypted
+type wal struct {
+	filename  string
+	file      Storage
+	pgSize    uint32
+	salt      uint32
+	index     map[uint32][]uint32
+	maxFrame  uint32
+	numFrames uint32
+	numPages  uint32
+	spilled   map[uint32]uint32
+	spillErr  error
+	stats     *PagerStats
+	//Size set by the running writer with shrinkFile
+	shrinking  bool
+	shrinkSize uint32
+}
+
+func walFilename(filename string) string {
+	return filename + WAL_SUFFIX
+}
+
+func hasWal(filename string) bool {
+	return storageExists(walFilename(filename))
+}
+
+func (w *wal) frameOffset(frame uint32) int64 {
+	return walHeaderSize + int64(frame-1)*(walFrameHeaderSize+w.payloadSize())
+}
+
+func (w *wal) payloadSize() int64 {
+	return int64(w.pgSize) + int64(fileCipher(w.filename).overhead())
+}
+
+func walChecksum(header []byte, data []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(header[0:12]), crc32.IEEETable, data)
+}
+
+func openWal(filename string, stats *PagerStats) (*wal, error) {
+	file, err1 := openStorage(walFilename(filename), true)
+	if err1 != nil {
+		return nil, err1
+	}
+	w := &wal{
+		filename: filename,
+		file:     file,
+		pgSize:   PageSize(filename),
+		index:    map[uint32][]uint32{},
+		spilled:  map[uint32]uint32{},
+		stats:    stats,
+	}
+	header := make([]byte, walHeaderSize)
+	_, err2 := file.ReadAt(header, 0)
+	if err2 != nil || binary.LittleEndian.Uint32(header[0:4]) != walMagic {
+		if err3 := w.reset(); err3 != nil {
+			file.Close()
+			return nil, err3
+		}
+		return w, nil
+	}
+	w.salt = binary.LittleEndian.Uint32(header[4:8])
+	if pgSize := binary.LittleEndian.Uint32(header[8:12]); pgSize != w.pgSize {
+		file.Close()
+		return nil, &PageIOError{filename, fmt.Sprintf("log written with page size %d", pgSize)}
+	}
+	if err4 := w.recover(); err4 != nil {
+		file.Close()
+		return nil, err4
+	}
+	return w, nil
+}
+
+// Rebuild the index from the frames of committed transactions, frames after the last commit are cut off
+func (w *wal) recover() error {
+	pending := map[uint32]uint32{}
+	frameHeader := make([]byte, walFrameHeaderSize)
+	data := make([]byte, w.payloadSize())
+	for frame := uint32(1); ; frame++ {
+		offset := w.frameOffset(frame)
+		if _, err := w.file.ReadAt(frameHeader, offset); err != nil {
+			break
+		}
+		if _, err := w.file.ReadAt(data, offset+walFrameHeaderSize); err != nil {
+			break
+		}
+		if binary.LittleEndian.Uint32(frameHeader[8:12]) != w.salt ||
+			binary.LittleEndian.Uint32(frameHeader[12:16]) != walChecksum(frameHeader, data) {
+			break
+		}
+		pending[binary.LittleEndian.Uint32(frameHeader[0:4])] = frame
+		if commitSize := binary.LittleEndian.Uint32(frameHeader[4:8]); commitSize != 0 {
+			w.spilled = pending
+			w.numFrames = frame
+			w.commit(commitSize)
+			pending = map[uint32]uint32{}
+		}
+	}
+	w.numFrames = w.maxFrame
+	return w.file.Truncate(w.frameOffset(w.maxFrame + 1))
+}
+
+// Start an empty log with a fresh salt, so stale frames can never be taken as valid
+func (w *wal) reset() error {
+	w.salt = rand.Uint32()
+	w.index = map[uint32][]uint32{}
+	w.spilled = map[uint32]uint32{}
+	w.spillErr = nil
+	w.maxFrame = 0
+	w.numFrames = 0
+	w.numPages = 0
+	w.shrinking = false
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	header := make([]byte, walHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], walMagic)
+	binary.LittleEndian.PutUint32(header[4:8], w.salt)
+	binary.LittleEndian.PutUint32(header[8:12], w.pgSize)
+	if _, err := w.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	w.stats.addSync()
+	return w.file.Sync()
+}
+
+func (w *wal) readFrame(frame uint32) ([]byte, error) {
+	buf := make([]byte, walFrameHeaderSize+w.payloadSize())
+	if _, err := w.file.ReadAt(buf, w.frameOffset(frame)); err != nil {
+		return nil, err
+	}
+	w.stats.addRead(len(buf) - int(walFrameHeaderSize))
+	pgNumber := binary.LittleEndian.Uint32(buf[0:4])
+	return fileCipher(w.filename).open(w.filename, buf[walFrameHeaderSize:], pgNumber)
+}
+
+func (w *wal) appendFrame(pgNumber uint32, data []byte, commitSize uint32) (uint32, error) {
+	if len(data) != int(w.pgSize) {
+		return 0, &PageIOError{w.filename, "write data length can only be a page"}
+	}
+	frame := w.numFrames + 1
+	data = fileCipher(w.filename).seal(data, pgNumber)
+	frameHeader := make([]byte, walFrameHeaderSize)
+	binary.LittleEndian.PutUint32(frameHeader[0:4], pgNumber)
+	binary.LittleEndian.PutUint32(frameHeader[4:8], commitSize)
+	binary.LittleEndian.PutUint32(frameHeader[8:12], w.salt)
+	binary.LittleEndian.PutUint32(frameHeader[12:16], walChecksum(frameHeader, data))
+	if _, err := w.file.WriteAt(append(frameHeader, data...), w.frameOffset(frame)); err != nil {
+		return 0, err
+	}
+	w.stats.addWrite(len(frameHeader) + len(data))
+	w.numFrames = frame
+	w.spilled[pgNumber] = frame
+	return frame, nil
+}
+
+// Find the newest frame of the page visible to a reader which has seen frames up to mark
+// Returns 0 if the page should be read from the database file
+func (w *wal) findFrame(pgNumber uint32, mark uint32) uint32 {
+	frames := w.index[pgNumber]
+	i := sort.Search(len(frames), func(i int) bool { return frames[i] > mark })
+	if i == 0 {
+		return 0
+	}
+	return frames[i-1]
+}
+
+// Make the frames written since the last commit visible to new readers
+func (w *wal) commit(commitSize uint32) {
+	for pgNumber, frame := range w.spilled {
+		w.index[pgNumber] = append(w.index[pgNumber], frame)
+	}
+	w.spilled = map[uint32]uint32{}
+	w.maxFrame = w.numFrames
+	w.numPages = commitSize
+	w.shrinking = false
+}
+
+// Drop the frames written since the last commit
+func (w *wal) rollback() error {
+	w.spilled = map[uint32]uint32{}
+	w.spillErr = nil
+	w.numFrames = w.maxFrame
+	w.shrinking = false
+	return w.file.Truncate(w.frameOffset(w.maxFrame + 1))
+}
+
+func (w *wal) close() error {
+	return w.file.Close()
+}
+
+func (w *wal) remove() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	return removeStorage(walFilename(w.filename))
+}
+
+func (pager *Pager) walMode() bool {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	return pager.wal != nil
+}
+
+func (pager *Pager) walFrames() uint32 {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	if pager.wal == nil {
+		return 0
+	}
+	return pager.wal.maxFrame
+}
+
+// Read a page as it was when the log ended at frame mark
+// Only the newest committed version of a page is kept in the cache
+func (pager *Pager) readPageAt(pgNumber uint32, mark uint32) ([]byte, error) {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	if pager.err != nil {
+		return nil, pager.err
+	}
+	frame := pager.wal.findFrame(pgNumber, mark)
+	if val, ok := pager.filecache.Peek(pgNumber); ok && !pager.dirtyMap[pgNumber] && pager.frameMap[pgNumber] == frame {
+		pager.stats.Hits++
+		return val, nil
+	}
+	pager.stats.Misses++
+	var data []byte
+	var err error
+	if frame == 0 {
+		data, err = pager.file.loadPage(pgNumber)
+	} else {
+		data, err = pager.wal.readFrame(frame)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if frame == pager.wal.findFrame(pgNumber, pager.wal.maxFrame) && !pager.filecache.Contains(pgNumber) {
+		pager.filecache.Add(pgNumber, data)
+		pager.dirtyMap[pgNumber] = false
+		pager.frameMap[pgNumber] = frame
+	}
+	return data, nil
+}
+
+// Number of pages of the database when the log ended at frame mark, the commit frame at mark holds it
+func (pager *Pager) numPagesAt(mark uint32) (uint32, error) {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	if mark == 0 {
+		return pager.file.numPages()
+	}
+	frameHeader := make([]byte, walFrameHeaderSize)
+	if _, err := pager.wal.file.ReadAt(frameHeader, pager.wal.frameOffset(mark)); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(frameHeader[4:8]), nil
+}
+
+// Write dirty pages to the log without committing them
+func (pager *Pager) spillWal() error {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	if pager.wal.spillErr != nil {
+		return pager.wal.spillErr
+	}
+	for _, pgNumber := range pager.dirtyPagesLocked() {
+		val, _ := pager.filecache.Peek(pgNumber)
+		frame, err := pager.wal.appendFrame(pgNumber, val, 0)
+		if err != nil {
+			return err
+		}
+		pager.stats.Writebacks++
+		pager.dirtyMap[pgNumber] = false
+		pager.frameMap[pgNumber] = frame
+	}
+	return nil
+}
+
+// The frames are synced by syncWalCommit with the returned number, 0 if nothing was written
+func (pager *Pager) commitWal() (uint64, error) {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	w := pager.wal
+	if w.spillErr != nil {
+		return 0, w.spillErr
+	}
+	pgNumbers := pager.dirtyPagesLocked()
+	if len(pgNumbers) == 0 && len(w.spilled) == 0 && !w.shrinking {
+		return 0, nil
+	}
+	numPages, err1 := pager.numPagesLocked()
+	if err1 != nil {
+		return 0, err1
+	}
+	for pgNumber := range w.spilled {
+		if pgNumber >= numPages {
+			numPages = pgNumber + 1
+		}
+	}
+	pages := make([][]byte, 0, len(pgNumbers))
+	for _, pgNumber := range pgNumbers {
+		if pgNumber >= numPages {
+			numPages = pgNumber + 1
+		}
+		val, _ := pager.filecache.Peek(pgNumber)
+		pages = append(pages, val)
+	}
+	changed := append([]uint32(nil), pgNumbers...)
+	for pgNumber := range w.spilled {
+		changed = append(changed, pgNumber)
+	}
+	if w.shrinking {
+		for pgNumber := w.shrinkSize; pgNumber < numPages; pgNumber++ {
+			changed = append(changed, pgNumber)
+		}
+	}
+	if err := pager.trackCommitLocked(changed); err != nil {
+		return 0, err
+	}
+	if w.shrinking {
+		//Cut pages not written again must read as zero pages, the file keeps them until the next checkpoint
+		for pgNumber := w.shrinkSize; pgNumber < numPages; pgNumber++ {
+			if _, ok := w.spilled[pgNumber]; ok || pager.dirtyMap[pgNumber] {
+				continue
+			}
+			if _, err := w.appendFrame(pgNumber, make([]byte, w.pgSize), 0); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if len(pgNumbers) == 0 && len(w.spilled) == 0 {
+		//Only the size has changed, write page 0 again as the commit frame
+		data, _, err2 := pager.loadLatestPage(0)
+		if err2 != nil {
+			return 0, err2
+		}
+		if _, err3 := w.appendFrame(0, data, numPages); err3 != nil {
+			return 0, err3
+		}
+	} else if len(pgNumbers) == 0 {
+		//Every change has been spilled, write one of them again as the commit frame
+		for pgNumber, frame := range w.spilled {
+			data, err2 := w.readFrame(frame)
+			if err2 != nil {
+				return 0, err2
+			}
+			if _, err3 := w.appendFrame(pgNumber, data, numPages); err3 != nil {
+				return 0, err3
+			}
+			break
+		}
+	}
+	frames := make([]uint32, len(pgNumbers))
+	for i, pgNumber := range pgNumbers {
+		var commitSize uint32 = 0
+		if i == len(pgNumbers)-1 {
+			commitSize = numPages
+		}
+		frame, err4 := w.appendFrame(pgNumber, pages[i], commitSize)
+		if err4 != nil {
+			return 0, err4
+		}
+		frames[i] = frame
+	}
+	pager.stats.Writebacks += uint64(len(pgNumbers))
+	w.commit(numPages)
+	pager.changes++
+	for i, pgNumber := range pgNumbers {
+		pager.dirtyMap[pgNumber] = false
+		pager.frameMap[pgNumber] = frames[i]
+	}
+	if pager.synchronous == SYNCHRONOUS_OFF {
+		return 0, nil
+	}
+	return pager.group.add(), nil
+}
+
+func (pager *Pager) rollbackWal() error {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	pager.purgeCacheLocked()
+	return pager.wal.rollback()
+}
+
+// Copy the newest committed frames back to the database file and restart the log
+// The caller must hold both the writer lock and the exclusive file lock, so no reader uses the frames
+func (pager *Pager) checkpoint() error {
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	return pager.checkpointLocked()
+}
+
+func (pager *Pager) checkpointLocked() error {
+	w := pager.wal
+	if w == nil || w.maxFrame == 0 {
+		return nil
+	}
+	for pgNumber, frames := range w.index {
+		data, err1 := w.readFrame(frames[len(frames)-1])
+		if err1 != nil {
+			return err1
+		}
+		if err2 := pager.file.writePage(data, pgNumber); err2 != nil {
+			return err2
+		}
+	}
+	numPages, err3 := pager.file.numPages()
+	if err3 != nil {
+		return err3
+	}
+	if numPages > w.numPages {
+		if err4 := pager.file.truncate(w.numPages); err4 != nil {
+			return err4
+		}
+	}
+	if err5 := pager.file.sync(); err5 != nil {
+		return err5
+	}
+	if err6 := w.reset(); err6 != nil {
+		return err6
+	}
+	for pgNumber := range pager.frameMap {
+		pager.frameMap[pgNumber] = 0
+	}
+	return nil
+}
+
+func Checkpoint(filename string) error {
+	return CheckpointContext(context.Background(), filename)
+}
+
+// Checkpoint with the lock owner of the context, see WithLockOwner
+func CheckpointContext(ctx context.Context, filename string) error {
+	unlock, err := lockDatabaseAloneContext(ctx, filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	pager := getPagerManager().OpenPager(filename, nil)
+	defer getPagerManager().ClosePager(filename)
+	return pager.checkpoint()
+}
+
+func SetJournalMode(filename string, mode uint8) error {
+	unlock, err := lockDatabaseAlone(filename)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	pager := getPagerManager().OpenPager(filename, nil)
+	defer getPagerManager().ClosePager(filename)
+	pager.lock.Lock()
+	defer pager.lock.Unlock()
+	if pager.err != nil {
+		return pager.err
+	}
+	switch mode {
+	case JOURNAL_MODE_WAL:
+		if pager.wal != nil {
+			return nil
+		}
+		rolledBack, err1 := pager.rollbackJournalLocked()
+		if err1 != nil {
+			return err1
+		}
+		if rolledBack {
+			pager.purgeCacheLocked()
+		}
+		pager.wal, err = openWal(filename, &pager.stats)
+	case JOURNAL_MODE_ROLLBACK:
+		if pager.wal == nil {
+			return nil
+		}
+		if err = pager.checkpointLocked(); err != nil {
+			return err
+		}
+		err = pager.wal.remove()
+		pager.wal = nil
+	default:
+		return &PageIOError{filename, "unknown journal mode"}
+	}
+	if err == nil && pager.synchronous == SYNCHRONOUS_FULL {
+		return syncDir(walFilename(filename))
+	}
+	return err
+}
+
+func GetJournalMode(filename string) uint8 {
+	if hasWal(filename) {
+		return JOURNAL_MODE_WAL
+	}
+	return JOURNAL_MODE_ROLLBACK
+}
@@ -0,0 +1,96 @@
+package pager
+
+import "testing"
+
+func removeTestDb(filename string) {
+	removeStorage(filename)
+	removeStorage(journalFilename(filename))
+	removeStorage(walFilename(filename))
+	removeStorage(changesFilename(filename))
+	removeStorage(filename + LOCK_SUFFIX)
+}
+
+func TestWalReaderSnapshot(t *testing.T) {
+	filename := "/tmp/test_wal_snapshot.gsdl"
+	removeTestDb(filename)
+	defer removeTestDb(filename)
+	if err := SetJournalMode(filename, JOURNAL_MODE_WAL); err != nil {
+		t.Fatalf("Cannot switch to wal mode %v", err)
+	}
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	for i := 0; i < 4; i++ {
+		testWritePage(t, wt, uint32(i), 1)
+	}
+	if err := wt.EndTransaction(); err != nil {
+		t.Error("Cannot commit to wal")
+	}
+	rt := &ReadTransaction{}
+	rt.StartTransaction(filename)
+	//The writer must not wait for the reader in wal mode
+	wt.StartTransaction(filename)
+	for i := 0; i < 6; i++ {
+		testWritePage(t, wt, uint32(i), 2)
+	}
+	wt.Sync()
+	expectPageValue(t, rt, 0, 1)
+	if err := wt.EndTransaction(); err != nil {
+		t.Error("Cannot commit to wal")
+	}
+	for i := 0; i < 4; i++ {
+		expectPageValue(t, rt, uint32(i), 1)
+	}
+	if _, err := rt.ReadPage(5); err == nil {
+		t.Error("Reader sees page created after its snapshot")
+	}
+	rt.EndTransaction()
+	rt.StartTransaction(filename)
+	for i := 0; i < 6; i++ {
+		expectPageValue(t, rt, uint32(i), 2)
+	}
+	rt.EndTransaction()
+	if n, _ := countPages(filename); n != 0 {
+		t.Errorf("Database file written before checkpoint, %d pages", n)
+	}
+}
+
+func TestWalRecoveryAndCheckpoint(t *testing.T) {
+	filename := "/tmp/test_wal_checkpoint.gsdl"
+	removeTestDb(filename)
+	defer removeTestDb(filename)
+	SetJournalMode(filename, JOURNAL_MODE_WAL)
+	wt := &WriteTransaction{}
+	wt.StartTransaction(filename)
+	for i := 0; i < 4; i++ {
+		testWritePage(t, wt, uint32(i), 3)
+	}
+	wt.EndTransaction()
+	wt.StartTransaction(filename)
+	testWritePage(t, wt, 1, 4)
+	wt.AbortTransaction()
+	wt.EndTransaction()
+	//Pager is closed here, reopening rebuilds the index from the log
+	rt := &ReadTransaction{}
+	rt.StartTransaction(filename)
+	for i := 0; i < 4; i++ {
+		expectPageValue(t, rt, uint32(i), 3)
+	}
+	rt.EndTransaction()
+	if err := Checkpoint(filename); err != nil {
+		t.Errorf("Cannot checkpoint %v", err)
+	}
+	if n, _ := countPages(filename); n != 4 {
+		t.Errorf("Wrong number of pages after checkpoint %d", n)
+	}
+	if err := SetJournalMode(filename, JOURNAL_MODE_ROLLBACK); err != nil {
+		t.Errorf("Cannot leave wal mode %v", err)
+	}
+	if GetJournalMode(filename) != JOURNAL_MODE_ROLLBACK {
+		t.Error("Log not removed when leaving wal mode")
+	}
+	rt.StartTransaction(filename)
+	for i := 0; i < 4; i++ {
+		expectPageValue(t, rt, uint32(i), 3)
+	}
+	rt.EndTransaction()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/gjc13/gsdl/core"
+)
+
+var key = flag.String("key", "", "hex encoded AES key the backed up database is encrypted with")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-key key] database full_backup [delta ...]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Make the database from a full backup and the deltas made after it, in the order they were made")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var keyData []byte
+	if *key != "" {
+		var err error
+		if keyData, err = hex.DecodeString(*key); err != nil {
+			log.Fatalf("Bad key: %v", err)
+		}
+	}
+	if err := core.RestoreBackup(flag.Arg(0), flag.Arg(1), flag.Args()[2:], keyData); err != nil {
+		log.Fatalf("Cannot restore: %v", err)
+	}
+	id, err := core.BackupId(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Cannot read backup id: %v", err)
+	}
+	fmt.Printf("restored %s at backup id %d\n", flag.Arg(0), id)
+}
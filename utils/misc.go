@@ -2,13 +2,11 @@ package utils
 
 import (
 	"hash/fnv"
-
-	pager "github.com/gjc13/gsdl/pager"
 )
 
-func PadToPage(data []byte) []byte {
+func PadToPage(data []byte, pgSize uint32) []byte {
 	origin_len := len(data)
-	pad_len := int64(pager.PGSIZE) - int64(origin_len)
+	pad_len := int64(pgSize) - int64(origin_len)
 	if pad_len < 0 {
 		panic("Cannot pad, too big input")
 	}
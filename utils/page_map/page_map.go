@@ -20,6 +20,26 @@ func (pageMap *FreePageMap) NextFreePageNumber() uint32 {
 	return 0
 }
 
+// First page of a run of n free pages, 0 if there is none
+// Bytes with all their pages used are skipped whole
+func (pageMap *FreePageMap) NextFreeRun(n int) uint32 {
+	run := 0
+	for i := 0; i < pageMap.Size(); {
+		if i%8 == 0 && i+8 <= pageMap.Size() && pageMap.freeMap[i/8] == 0xff {
+			run = 0
+			i += 8
+			continue
+		}
+		if pageMap.GetAtOffset(i) {
+			run = 0
+		} else if run++; run == n {
+			return pageMap.selfPgNumber + uint32(i+1-n)
+		}
+		i++
+	}
+	return 0
+}
+
 func (pageMap *FreePageMap) assertInRange(pgNumber uint32) {
 	pgOffset := int(pgNumber) - int(pageMap.selfPgNumber)
 	if pgOffset < 0 || pgOffset > pageMap.Size() {
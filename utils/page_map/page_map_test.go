@@ -60,3 +60,20 @@ func TestSerialize(t *testing.T) {
 		t.Errorf("Wrong num free %d\n", freeMap.NumFree())
 	}
 }
+
+func TestFreeRun(t *testing.T) {
+	freeMap := MakeFreePageMap(1, 64)
+	for i := uint32(1); i < 20; i++ {
+		freeMap.Set(i)
+	}
+	freeMap.Set(23)
+	if n := freeMap.NextFreeRun(1); n != 20 {
+		t.Errorf("Wrong first free page %d\n", n)
+	}
+	if n := freeMap.NextFreeRun(4); n != 24 {
+		t.Errorf("Wrong free run %d\n", n)
+	}
+	if n := freeMap.NextFreeRun(64); n != 0 {
+		t.Errorf("Free run bigger than free pages %d\n", n)
+	}
+}
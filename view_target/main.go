@@ -43,10 +43,10 @@ func PrintView(v view.Viewer) {
 }
 
 func main() {
-	if err := core.CreateDatabase("test_db2"); err != nil {
+	if err := core.CreateDatabase("test_db2", nil); err != nil {
 		fmt.Printf("%v\n", err)
 	}
-	ctx, err1 := core.StartUseDatabase("test_db2")
+	ctx, err1 := core.StartUseDatabase("test_db2", nil)
 	if err1 != nil {
 		fmt.Println("Cannot Use database")
 	}